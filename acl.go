@@ -0,0 +1,233 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+// Action is a set of operations governed by an ACL rule.
+type Action uint8
+
+const (
+	// ActionPublish governs publishing to topics.
+	ActionPublish Action = 1 << iota
+
+	// ActionSubscribe governs subscribing to filters.
+	ActionSubscribe
+
+	// ActionAll governs both publishing and subscribing.
+	ActionAll = ActionPublish | ActionSubscribe
+)
+
+// Precedence determines which of the rules matching a topic decides whether
+// an action is permitted.
+type Precedence int
+
+const (
+	// MostSpecificWins decides by the most specific matching rule, i.e. the
+	// one with the most literal words and then the fewest zero-or-more
+	// wildcards. A deny rule wins a tie.
+	MostSpecificWins Precedence = iota
+
+	// DenyWins denies an action if any deny rule matches.
+	DenyWins
+)
+
+// aclRule is the Subscriber stored in the ctrie for each rule. A pattern has
+// at most one allow and one deny rule per action.
+type aclRule struct {
+	id      string
+	action  Action
+	deny    bool
+	pattern *patternNFA
+}
+
+// newACLRule creates a rule for the single action.
+func newACLRule(action Action, deny bool, pattern *patternNFA) *aclRule {
+	id := "subscribe"
+	if action == ActionPublish {
+		id = "publish"
+	}
+	if deny {
+		id += " deny"
+	} else {
+		id += " allow"
+	}
+	return &aclRule{id: id, action: action, deny: deny, pattern: pattern}
+}
+
+// ID returns the rule's ID.
+func (r *aclRule) ID() string {
+	return r.id
+}
+
+// ACL stores allow and deny rules for principals as topic patterns. Actions
+// are denied unless a rule allows them. A principal may publish to a topic if
+// the rules matching it allow publishing, and it may subscribe to a filter if
+// an allow rule matches every topic the filter does and no deny rule which
+// takes precedence matches any of them. ACL is safe for concurrent use.
+type ACL struct {
+	ctrie      *ctrie
+	precedence Precedence
+}
+
+// NewACL creates a new ACL with the given Config and Precedence.
+func NewACL(config *Config, precedence Precedence) *ACL {
+	return &ACL{ctrie: newCtrie(config), precedence: precedence}
+}
+
+// Allow the principal the actions on topics matching the pattern.
+// ErrRangeTooLarge is returned, and no rule added, if the pattern has a ranged
+// wildcard matching more than MaxRangeWords words.
+func (a *ACL) Allow(principal, pattern string, actions Action) error {
+	return a.insert(principal, pattern, actions, false)
+}
+
+// Deny the principal the actions on topics matching the pattern.
+// ErrRangeTooLarge is returned, and no rule added, if the pattern has a ranged
+// wildcard matching more than MaxRangeWords words.
+func (a *ACL) Deny(principal, pattern string, actions Action) error {
+	return a.insert(principal, pattern, actions, true)
+}
+
+// Revoke removes the principal's allow and deny rules for the actions on the
+// pattern.
+func (a *ACL) Revoke(principal, pattern string, actions Action) {
+	keys := a.keys(principal, pattern)
+	for _, action := range []Action{ActionPublish, ActionSubscribe} {
+		if actions&action != 0 {
+			a.ctrie.remove(keys, newACLRule(action, false, nil))
+			a.ctrie.remove(keys, newACLRule(action, true, nil))
+		}
+	}
+}
+
+// insert adds a rule for each of the actions on the pattern.
+func (a *ACL) insert(principal, pattern string, actions Action, deny bool) error {
+	keys := a.keys(principal, pattern)
+	if err := a.ctrie.config.checkRanges(keys[1:]); err != nil {
+		return err
+	}
+	nfa := a.ctrie.config.compilePattern(keys[1:])
+	for _, action := range []Action{ActionPublish, ActionSubscribe} {
+		if actions&action != 0 {
+			a.ctrie.insert(keys, newACLRule(action, deny, nfa), "", false)
+		}
+	}
+	return nil
+}
+
+// keys returns the ctrie keys for the principal's pattern.
+func (a *ACL) keys(principal, pattern string) []string {
+	return append([]string{namespaceKey(principal)}, a.ctrie.config.patternKeys(pattern)...)
+}
+
+// CanPublish indicates if the principal may publish to the topic.
+func (a *ACL) CanPublish(principal, topic string) bool {
+	keys := append([]string{namespaceKey(principal)}, a.ctrie.config.topicKeys(topic)...)
+	var allows, denies []*patternNFA
+	for _, sub := range a.ctrie.lookup(keys) {
+		rule := sub.(*aclRule)
+		switch {
+		case rule.action != ActionPublish:
+		case rule.deny:
+			denies = append(denies, rule.pattern)
+		default:
+			allows = append(allows, rule.pattern)
+		}
+	}
+	return a.permitted(allows, denies)
+}
+
+// CanSubscribe indicates if the principal may subscribe to the filter. The
+// rules are read from a single read-only snapshot. A filter which can't be
+// subscribed to, as it has an oversized ranged wildcard, is never permitted.
+func (a *ACL) CanSubscribe(principal, filter string) bool {
+	var (
+		snapshot = a.ctrie.ReadOnlySnapshot()
+		keys     = snapshot.config.patternKeys(filter)
+		nfa      = snapshot.config.compilePattern(keys)
+		allows   []*patternNFA
+		denies   []*patternNFA
+	)
+	if snapshot.config.checkRanges(keys) != nil {
+		return false
+	}
+	for _, rule := range a.rules(snapshot, principal, ActionSubscribe) {
+		switch {
+		case rule.deny && overlaps(rule.pattern, nfa):
+			denies = append(denies, rule.pattern)
+		case !rule.deny && contains(rule.pattern, nfa):
+			allows = append(allows, rule.pattern)
+		}
+	}
+	return a.permitted(allows, denies)
+}
+
+// permitted decides if an action is permitted given the patterns of the
+// applicable allow and deny rules.
+func (a *ACL) permitted(allows, denies []*patternNFA) bool {
+	if len(allows) == 0 {
+		return false
+	}
+	if a.precedence == DenyWins {
+		return len(denies) == 0
+	}
+	best := allows[0]
+	for _, allow := range allows[1:] {
+		if compareSpecificity(allow, best) > 0 {
+			best = allow
+		}
+	}
+	for _, deny := range denies {
+		if compareSpecificity(deny, best) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rules returns the principal's rules for the action in the snapshot.
+func (a *ACL) rules(snapshot *ctrie, principal string, action Action) []*aclRule {
+	var (
+		rules []*aclRule
+		walk  func(in *iNode)
+	)
+	walk = func(in *iNode) {
+		main := gcasRead(in, snapshot)
+		if main.cNode == nil {
+			return
+		}
+		for _, br := range main.cNode.branches {
+			for _, sub := range br.subs {
+				if rule := sub.(*aclRule); rule.action == action {
+					rules = append(rules, rule)
+				}
+			}
+			if br.iNode != nil {
+				walk(br.iNode)
+			}
+		}
+	}
+	if br := snapshot.exactBranch([]string{namespaceKey(principal)}); br != nil && br.iNode != nil {
+		walk(br.iNode)
+	}
+	return rules
+}
+
+// Snapshot returns a read-only snapshot of the ACL. Modifying the snapshot
+// panics.
+func (a *ACL) Snapshot() *ACL {
+	return &ACL{ctrie: a.ctrie.ReadOnlySnapshot(), precedence: a.precedence}
+}
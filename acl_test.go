@@ -0,0 +1,140 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLMostSpecificWins(t *testing.T) {
+	assert := assert.New(t)
+	acl := NewACL(NewAMQPConfig(), MostSpecificWins)
+	acl.Allow("alice", "tenantA.#", ActionAll)
+	acl.Deny("alice", "tenantA.secret.#", ActionAll)
+	acl.Allow("alice", "tenantA.secret.public", ActionSubscribe)
+	acl.Allow("bob", "tenantB.*", ActionPublish)
+
+	assert.True(acl.CanPublish("alice", "tenantA.orders"))
+	assert.True(acl.CanPublish("alice", "tenantA"))
+	assert.False(acl.CanPublish("alice", "tenantA.secret.keys"))
+	assert.False(acl.CanPublish("alice", "tenantA.secret.public"))
+	assert.False(acl.CanPublish("alice", "tenantB.orders"))
+	assert.False(acl.CanPublish("carol", "tenantA.orders"))
+	assert.True(acl.CanPublish("bob", "tenantB.orders"))
+	assert.False(acl.CanPublish("bob", "tenantB.orders.new"))
+
+	assert.True(acl.CanSubscribe("alice", "tenantA.orders.#"))
+	assert.True(acl.CanSubscribe("alice", "tenantA.orders.*"))
+	// Would receive tenantA.secret.new.
+	assert.False(acl.CanSubscribe("alice", "tenantA.*.new"))
+	assert.False(acl.CanSubscribe("alice", "tenantA.#"))
+	assert.False(acl.CanSubscribe("alice", "tenantA.secret.*"))
+	assert.True(acl.CanSubscribe("alice", "tenantA.secret.public"))
+	assert.False(acl.CanSubscribe("alice", "#"))
+	assert.False(acl.CanSubscribe("bob", "tenantB.orders"))
+
+	// Ties go to deny.
+	acl.Deny("alice", "tenantA.orders", ActionPublish)
+	assert.False(acl.CanPublish("alice", "tenantA.orders"))
+
+	acl.Revoke("alice", "tenantA.secret.#", ActionAll)
+	acl.Revoke("alice", "tenantA.orders", ActionAll)
+	assert.True(acl.CanPublish("alice", "tenantA.orders"))
+	assert.True(acl.CanPublish("alice", "tenantA.secret.keys"))
+	assert.True(acl.CanSubscribe("alice", "tenantA.#"))
+}
+
+func TestACLDenyWins(t *testing.T) {
+	assert := assert.New(t)
+	acl := NewACL(NewAMQPConfig(), DenyWins)
+	acl.Allow("alice", "tenantA.#", ActionAll)
+	acl.Deny("alice", "tenantA.secret.#", ActionAll)
+	acl.Allow("alice", "tenantA.secret.public", ActionAll)
+
+	assert.True(acl.CanPublish("alice", "tenantA.orders"))
+	assert.False(acl.CanPublish("alice", "tenantA.secret.public"))
+	assert.True(acl.CanSubscribe("alice", "tenantA.orders.*"))
+	assert.False(acl.CanSubscribe("alice", "tenantA.secret.public"))
+	assert.False(acl.CanSubscribe("alice", "tenantA.*.public"))
+
+	// Principals are never wildcards.
+	acl.Allow("*", "#", ActionAll)
+	assert.False(acl.CanPublish("bob", "tenantA.orders"))
+	assert.True(acl.CanPublish("*", "tenantA.orders"))
+}
+
+func TestACLSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	acl := NewACL(NewAMQPConfig(), MostSpecificWins)
+	acl.Allow("alice", "a.#", ActionAll)
+	snapshot := acl.Snapshot()
+	acl.Deny("alice", "a.b", ActionAll)
+
+	assert.False(acl.CanPublish("alice", "a.b"))
+	assert.True(snapshot.CanPublish("alice", "a.b"))
+	assert.True(snapshot.CanSubscribe("alice", "a.#"))
+	assert.Panics(func() { snapshot.Allow("alice", "b", ActionAll) })
+}
+
+func TestACLRangeTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+	acl := NewACL(config, MostSpecificWins)
+	assert.Equal(ErrRangeTooLarge, acl.Allow("alice", "a.{1,256}", ActionAll))
+	assert.False(acl.CanPublish("alice", "a.{1,256}"))
+	assert.Nil(acl.Allow("alice", "#", ActionAll))
+	assert.Equal(ErrRangeTooLarge, acl.Deny("alice", "a.{0,1000}", ActionAll))
+	assert.True(acl.CanPublish("alice", "a.b"))
+	assert.True(acl.CanSubscribe("alice", "a.{1,255}"))
+	assert.False(acl.CanSubscribe("alice", "a.{1,256}"))
+}
+
+func TestACLConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	acl := NewACL(NewAMQPConfig(), DenyWins)
+	acl.Allow("alice", "#", ActionAll)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		for i := 0; i < 500; i++ {
+			acl.Deny("alice", "a."+strconv.Itoa(i), ActionAll)
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		for i := 0; i < 500; i++ {
+			acl.CanPublish("alice", "a."+strconv.Itoa(i))
+			acl.CanSubscribe("alice", "a.*")
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+	for i := 0; i < 500; i++ {
+		assert.False(acl.CanPublish("alice", "a."+strconv.Itoa(i)))
+	}
+	assert.True(acl.CanPublish("alice", "b.0"))
+	assert.False(acl.CanSubscribe("alice", "a.*"))
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package admin provides an HTTP handler for administering a live Matchbox. Every
+response is JSON. Reads are served from a read-only snapshot so they never
+contend with subscriptions.
+
+The endpoints are:
+
+	GET    /topics?after=a.b&limit=100  page through the subscribed patterns
+	                                    after the cursor
+	GET    /subscribers?pattern=a.*     the IDs subscribed to a pattern
+	GET    /match?topic=a.b             the IDs matching a topic, with the
+	                                    lookup's explanation if explain=true
+	GET    /stats                       the Matchbox's Stats
+	POST   /subscriptions               subscribe, if writes are allowed
+	DELETE /subscriptions               unsubscribe, if writes are allowed
+
+Subscriptions are written with a body of the form
+{"pattern": "a.*", "subscriber": "id"}.
+
+A Matchbox which is an Enumerator is paged through and has a pattern's
+subscribers looked up without building all of its subscriptions, and its
+patterns are listed in the order it enumerates them. Others are listed sorted.
+*/
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Workiva/matchbox"
+)
+
+const (
+	// DefaultPageSize is the number of topics listed if no limit is given.
+	DefaultPageSize = 100
+
+	// MaxPageSize is the maximum number of topics listed at once.
+	MaxPageSize = 1000
+)
+
+// Options configures an admin Handler.
+type Options struct {
+	// AllowWrites enables subscribing and unsubscribing. Writes are rejected
+	// with 403 Forbidden by default.
+	AllowWrites bool
+
+	// NewSubscriber returns the Subscriber for an ID when subscribing. By
+	// default, Subscribers are identified by their ID alone.
+	NewSubscriber func(id string) (matchbox.Subscriber, error)
+
+	// ErrorLog logs errors writing responses. By default, they are logged
+	// with the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// subscriber is a Subscriber identified by its ID alone.
+type subscriber string
+
+// ID returns the Subscriber's ID.
+func (s subscriber) ID() string {
+	return string(s)
+}
+
+// Handler serves the admin endpoints for a Matchbox.
+type Handler struct {
+	mb   matchbox.Matchbox
+	opts Options
+	mux  *http.ServeMux
+}
+
+// NewHandler returns a Handler administering the Matchbox.
+func NewHandler(mb matchbox.Matchbox, opts Options) *Handler {
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = log.Default()
+	}
+	if opts.NewSubscriber == nil {
+		opts.NewSubscriber = func(id string) (matchbox.Subscriber, error) {
+			return subscriber(id), nil
+		}
+	}
+	h := &Handler{mb: mb, opts: opts, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/topics", h.get(h.topics))
+	h.mux.HandleFunc("/subscribers", h.get(h.subscribers))
+	h.mux.HandleFunc("/match", h.get(h.match))
+	h.mux.HandleFunc("/stats", h.get(h.stats))
+	h.mux.HandleFunc("/subscriptions", h.subscriptions)
+	return h
+}
+
+// ServeHTTP serves an admin request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// TopicsPage is a page of the subscribed patterns after a cursor. Next is the
+// cursor for the following page, or empty if there are no more patterns.
+type TopicsPage struct {
+	Topics []string `json:"topics"`
+	After  string   `json:"after,omitempty"`
+	Limit  int      `json:"limit"`
+	Next   string   `json:"next,omitempty"`
+}
+
+// PatternSubscribers are the IDs of the Subscribers to a pattern, and of the
+// members of each shared subscription group subscribed to it.
+type PatternSubscribers struct {
+	Pattern     string              `json:"pattern"`
+	Subscribers []string            `json:"subscribers"`
+	Groups      map[string][]string `json:"groups,omitempty"`
+}
+
+// Match is the IDs of the Subscribers matching a topic, and the Explanation
+// of the lookup if one was requested.
+type Match struct {
+	Topic       string                `json:"topic"`
+	Subscribers []string              `json:"subscribers"`
+	Explanation *matchbox.Explanation `json:"explanation,omitempty"`
+}
+
+// Subscription is the body of a request to subscribe or unsubscribe.
+type Subscription struct {
+	Pattern    string `json:"pattern"`
+	Subscriber string `json:"subscriber"`
+}
+
+// Error is the body of an error response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// topics serves a page of the subscribed patterns after the cursor.
+func (h *Handler) topics(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", DefaultPageSize)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit == 0 || limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	page := TopicsPage{Topics: []string{}, After: r.URL.Query().Get("after"), Limit: limit}
+
+	// One more pattern than the limit is listed to tell if there are more.
+	matchbox.Enumerate(matchbox.ReadOnly(h.mb), page.After, func(s matchbox.Subscription) bool {
+		page.Topics = append(page.Topics, s.Pattern)
+		return len(page.Topics) <= limit
+	})
+	if len(page.Topics) > limit {
+		page.Topics = page.Topics[:limit]
+		page.Next = page.Topics[limit-1]
+	}
+	h.writeJSON(w, http.StatusOK, page)
+}
+
+// subscribers serves the Subscribers to the pattern as it was subscribed.
+func (h *Handler) subscribers(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		h.writeError(w, http.StatusBadRequest, errors.New("pattern is required"))
+		return
+	}
+	snapshot := matchbox.ReadOnly(h.mb)
+	enumerator, ok := snapshot.(matchbox.Enumerator)
+	if !ok {
+		subs := snapshot.Subscriptions()[pattern]
+		h.writeJSON(w, http.StatusOK, PatternSubscribers{Pattern: pattern, Subscribers: ids(subs)})
+		return
+	}
+	s := enumerator.Subscription(pattern)
+	resp := PatternSubscribers{Pattern: pattern, Subscribers: ids(s.Subscribers)}
+	for group, members := range s.Groups {
+		if resp.Groups == nil {
+			resp.Groups = map[string][]string{}
+		}
+		resp.Groups[group] = ids(members)
+	}
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+// match serves the Subscribers matching the topic.
+func (h *Handler) match(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		h.writeError(w, http.StatusBadRequest, errors.New("topic is required"))
+		return
+	}
+	snapshot := matchbox.ReadOnly(h.mb)
+	match := Match{Topic: topic, Subscribers: ids(snapshot.Subscribers(topic))}
+	if explain, _ := strconv.ParseBool(query.Get("explain")); explain {
+		explainer, ok := snapshot.(matchbox.Explainer)
+		if !ok {
+			h.writeError(w, http.StatusNotImplemented, matchbox.ErrUnsupported)
+			return
+		}
+		explanation := explainer.Explain(topic)
+		match.Explanation = &explanation
+	}
+	h.writeJSON(w, http.StatusOK, match)
+}
+
+// stats serves the Stats of the Matchbox.
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	inspector, ok := h.mb.(matchbox.Inspector)
+	if !ok {
+		h.writeError(w, http.StatusNotImplemented, matchbox.ErrUnsupported)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, inspector.Stats())
+}
+
+// subscriptions subscribes or unsubscribes if writes are allowed.
+func (h *Handler) subscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if !h.opts.AllowWrites {
+		h.writeError(w, http.StatusForbidden, errors.New("writes are disabled"))
+		return
+	}
+	var s Subscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if s.Pattern == "" || s.Subscriber == "" {
+		h.writeError(w, http.StatusBadRequest, errors.New("pattern and subscriber are required"))
+		return
+	}
+	sub, err := h.opts.NewSubscriber(s.Subscriber)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		h.mb.Unsubscribe(s.Pattern, sub)
+		h.writeJSON(w, http.StatusOK, s)
+		return
+	}
+	if err := matchbox.TrySubscribe(h.mb, s.Pattern, sub); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, matchbox.ErrQuotaExceeded):
+			status = http.StatusTooManyRequests
+		case errors.Is(err, matchbox.ErrRangeTooLarge):
+			status = http.StatusBadRequest
+		}
+		h.writeError(w, status, err)
+		return
+	}
+	h.writeJSON(w, http.StatusCreated, s)
+}
+
+// get wraps the handler so it only serves GET and HEAD requests.
+func (h *Handler) get(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// queryInt returns the non-negative integer query parameter, or the default
+// if it is absent.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New(name + " must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// ids returns the sorted IDs of the Subscribers.
+func ids(subs []matchbox.Subscriber) []string {
+	ids := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		ids = append(ids, sub.ID())
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// writeJSON writes the value as the JSON body of a response with the status.
+// The response has been sent by the time encoding fails, so the error is
+// logged.
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.opts.ErrorLog.Printf("admin: writing response: %v", err)
+	}
+}
+
+// writeError writes the error as the JSON body of a response with the status.
+func (h *Handler) writeError(w http.ResponseWriter, status int, err error) {
+	h.writeJSON(w, status, Error{Error: err.Error()})
+}
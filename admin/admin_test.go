@@ -0,0 +1,218 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Workiva/matchbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// request serves the request, decoding the JSON response into v.
+func request(t *testing.T, h http.Handler, method, target, body string, v any) int {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	if v != nil {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+// opaque hides the capabilities of a Matchbox.
+type opaque struct {
+	matchbox.Matchbox
+}
+
+func newMatchbox() matchbox.Matchbox {
+	mb := matchbox.New(matchbox.NewAMQPConfig())
+	mb.Subscribe("a.*", subscriber("def"))
+	mb.Subscribe("a.*", subscriber("abc"))
+	mb.Subscribe("a.b", subscriber("abc"))
+	mb.Subscribe("b.#", subscriber("ghi"))
+	return mb
+}
+
+func TestTopics(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHandler(newMatchbox(), Options{})
+
+	var page TopicsPage
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/topics", "", &page))
+	assert.Equal(TopicsPage{Topics: []string{"a.*", "a.b", "b.#"}, Limit: DefaultPageSize}, page)
+
+	page = TopicsPage{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/topics?limit=2", "", &page))
+	assert.Equal(TopicsPage{Topics: []string{"a.*", "a.b"}, Limit: 2, Next: "a.b"}, page)
+
+	page = TopicsPage{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/topics?after=a.b&limit=1", "", &page))
+	assert.Equal(TopicsPage{Topics: []string{"b.#"}, After: "a.b", Limit: 1}, page)
+
+	page = TopicsPage{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/topics?after=b.%23", "", &page))
+	assert.Equal(TopicsPage{Topics: []string{}, After: "b.#", Limit: DefaultPageSize}, page)
+
+	// Matchboxes which don't enumerate are listed sorted.
+	h = NewHandler(opaque{newMatchbox()}, Options{})
+	page = TopicsPage{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/topics?after=a.*&limit=1", "", &page))
+	assert.Equal(TopicsPage{Topics: []string{"a.b"}, After: "a.*", Limit: 1, Next: "a.b"}, page)
+
+	var e Error
+	assert.Equal(http.StatusBadRequest, request(t, h, "GET", "/topics?limit=-1", "", &e))
+	assert.Equal("limit must be a non-negative integer", e.Error)
+}
+
+func TestSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHandler(newMatchbox(), Options{})
+
+	var subs PatternSubscribers
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/subscribers?pattern=a.*", "", &subs))
+	assert.Equal(PatternSubscribers{Pattern: "a.*", Subscribers: []string{"abc", "def"}}, subs)
+
+	subs = PatternSubscribers{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/subscribers?pattern=c", "", &subs))
+	assert.Equal(PatternSubscribers{Pattern: "c", Subscribers: []string{}}, subs)
+
+	mb := newMatchbox()
+	mb.(matchbox.GroupMatchbox).SubscribeGroup("g", "a.*", subscriber("jkl"))
+	h = NewHandler(mb, Options{})
+	subs = PatternSubscribers{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/subscribers?pattern=a.*", "", &subs))
+	assert.Equal(PatternSubscribers{Pattern: "a.*", Subscribers: []string{"abc", "def"},
+		Groups: map[string][]string{"g": {"jkl"}}}, subs)
+
+	h = NewHandler(opaque{newMatchbox()}, Options{})
+	subs = PatternSubscribers{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/subscribers?pattern=a.*", "", &subs))
+	assert.Equal(PatternSubscribers{Pattern: "a.*", Subscribers: []string{"abc", "def"}}, subs)
+
+	assert.Equal(http.StatusBadRequest, request(t, h, "GET", "/subscribers", "", nil))
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHandler(newMatchbox(), Options{})
+
+	var match Match
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/match?topic=a.b", "", &match))
+	assert.Equal(Match{Topic: "a.b", Subscribers: []string{"abc", "def"}}, match)
+
+	match = Match{}
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/match?topic=b.c.d&explain=true", "", &match))
+	assert.Equal([]string{"ghi"}, match.Subscribers)
+	if assert.NotNil(match.Explanation) {
+		assert.Equal([]matchbox.Contribution{{Pattern: "b.#", Subscribers: []string{"ghi"}}},
+			match.Explanation.Contributions)
+	}
+
+	assert.Equal(http.StatusBadRequest, request(t, h, "GET", "/match", "", nil))
+	assert.Equal(http.StatusMethodNotAllowed, request(t, h, "POST", "/match?topic=a.b", "", nil))
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHandler(newMatchbox(), Options{})
+
+	var stats matchbox.Stats
+	assert.Equal(http.StatusOK, request(t, h, "GET", "/stats", "", &stats))
+	assert.Equal(3, stats.Patterns)
+	assert.Equal(4, stats.Subscriptions)
+}
+
+func TestWrites(t *testing.T) {
+	assert := assert.New(t)
+	mb := newMatchbox()
+
+	var e Error
+	h := NewHandler(mb, Options{})
+	assert.Equal(http.StatusForbidden,
+		request(t, h, "POST", "/subscriptions", `{"pattern": "c", "subscriber": "abc"}`, &e))
+	assert.Equal("writes are disabled", e.Error)
+	assert.Len(mb.Subscribers("c"), 0)
+
+	h = NewHandler(mb, Options{AllowWrites: true})
+	var s Subscription
+	assert.Equal(http.StatusCreated,
+		request(t, h, "POST", "/subscriptions", `{"pattern": "c", "subscriber": "abc"}`, &s))
+	assert.Equal(Subscription{Pattern: "c", Subscriber: "abc"}, s)
+	assert.Equal([]matchbox.Subscriber{subscriber("abc")}, mb.Subscribers("c"))
+
+	assert.Equal(http.StatusOK,
+		request(t, h, "DELETE", "/subscriptions", `{"pattern": "a.*", "subscriber": "def"}`, nil))
+	assert.Len(mb.Subscribers("a.c"), 1)
+
+	assert.Equal(http.StatusBadRequest,
+		request(t, h, "POST", "/subscriptions", `{"pattern": "c"}`, nil))
+	assert.Equal(http.StatusBadRequest, request(t, h, "POST", "/subscriptions", `{`, nil))
+	assert.Equal(http.StatusMethodNotAllowed, request(t, h, "GET", "/subscriptions", "", nil))
+}
+
+func TestWriteErrors(t *testing.T) {
+	assert := assert.New(t)
+	config := matchbox.NewAMQPConfig()
+	config.Limits = matchbox.Limits{MaxDepth: 1}
+	h := NewHandler(matchbox.New(config), Options{
+		AllowWrites: true,
+		NewSubscriber: func(id string) (matchbox.Subscriber, error) {
+			if id == "unknown" {
+				return nil, errors.New("unknown subscriber")
+			}
+			return subscriber(id), nil
+		},
+	})
+
+	var e Error
+	assert.Equal(http.StatusTooManyRequests,
+		request(t, h, "POST", "/subscriptions", `{"pattern": "a.b", "subscriber": "abc"}`, &e))
+	assert.Equal(matchbox.ErrQuotaExceeded.Error(), e.Error)
+
+	e = Error{}
+	assert.Equal(http.StatusBadRequest,
+		request(t, h, "POST", "/subscriptions", `{"pattern": "a", "subscriber": "unknown"}`, &e))
+	assert.Equal("unknown subscriber", e.Error)
+}
+
+// failingWriter is a ResponseWriter whose writes fail.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+// Write fails.
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWriteJSONLogsErrors(t *testing.T) {
+	assert := assert.New(t)
+	var logged bytes.Buffer
+	h := NewHandler(newMatchbox(), Options{ErrorLog: log.New(&logged, "", 0)})
+
+	h.writeJSON(failingWriter{httptest.NewRecorder()}, http.StatusOK, Error{Error: "a"})
+	assert.Equal("admin: writing response: connection reset\n", logged.String())
+}
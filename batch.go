@@ -0,0 +1,195 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sort"
+	"sync"
+)
+
+// minBatchPerWorker is the fewest topics a batch is split into per goroutine.
+const minBatchPerWorker = 64
+
+// query is a topic of a batch lookup.
+type query struct {
+	index int // the position of the topic's first occurrence in the batch
+	keys  []string
+}
+
+// SubscribersBatch returns the Subscribers for each of the topics, in order,
+// looked up from a single read-only snapshot. Repeated topics are looked up
+// once, and the rest are sorted so those with a common prefix walk it once.
+// Large batches are split across the Config's BatchWorkers.
+func (m *matchbox) SubscribersBatch(topics []string) [][]Subscriber {
+	results := m.ReadOnlySnapshot().lookupBatch(topics)
+	for i, subs := range results {
+		results[i] = ungrouped(subs)
+	}
+	return results
+}
+
+// lookupBatch returns the Subscribers for each of the topics from a read-only
+// ctrie.
+func (c *ctrie) lookupBatch(topics []string) [][]Subscriber {
+	if m := c.config.Metrics; m != nil {
+		m.Count(MetricLookups, int64(len(topics)))
+	}
+	first := make(map[string]int, len(topics))
+	queries := make([]query, 0, len(topics))
+	for i, topic := range topics {
+		if _, ok := first[topic]; !ok {
+			first[topic] = i
+			queries = append(queries, query{index: i, keys: c.config.topicKeys(topic)})
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return compareKeys(queries[i].keys, queries[j].keys) < 0
+	})
+
+	results := make([][]Subscriber, len(topics))
+	root := c.readRoot()
+	workers := c.config.BatchWorkers
+	if n := len(queries) / minBatchPerWorker; workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		c.batch(root, queries, results)
+	} else {
+		// Each goroutine takes a contiguous run of the sorted queries, so
+		// they still share prefixes.
+		var wg sync.WaitGroup
+		size := (len(queries) + workers - 1) / workers
+		for start := 0; start < len(queries); start += size {
+			end := start + size
+			if end > len(queries) {
+				end = len(queries)
+			}
+			wg.Add(1)
+			go func(queries []query) {
+				defer wg.Done()
+				c.batch(root, queries, results)
+			}(queries[start:end])
+		}
+		wg.Wait()
+	}
+	for _, q := range queries {
+		results[q.index] = uniqueSubscribers(results[q.index])
+	}
+	for i, topic := range topics {
+		if j := first[topic]; j != i {
+			results[i] = append(make([]Subscriber, 0, len(results[j])), results[j]...)
+		}
+	}
+	return results
+}
+
+// batch looks up the queries from the root, falling back to looking them up
+// one at a time if the walk has to be retried.
+func (c *ctrie) batch(root *iNode, queries []query, results [][]Subscriber) {
+	if c.iBatch(root, queries, 0, root.gen, results) {
+		return
+	}
+	for _, q := range queries {
+		for {
+			if subs, ok := c.ilookup(root, q.keys, nil, root.gen, nil); ok {
+				results[q.index] = subs
+				break
+			}
+		}
+	}
+}
+
+// iBatch attempts to look up the queries, which share the keys before depth,
+// from the I-node, adding the Subscribers to their results. Queries taking the
+// same exact-match branch share its traversal. True is returned if the
+// Subscribers were retrieved, false if the operation needs to be retried.
+func (c *ctrie) iBatch(i *iNode, queries []query, depth int, startGen *generation,
+	results [][]Subscriber) bool {
+
+	main := gcasRead(i, c)
+	if main.cNode == nil {
+		return false
+	}
+	for len(queries) > 0 {
+		// The sorted queries with the same key at this depth are adjacent.
+		key := queries[0].keys[depth]
+		n := 1
+		for n < len(queries) && queries[n].keys[depth] == key {
+			n++
+		}
+		group := queries[:n]
+		queries = queries[n:]
+
+		// The query ending at this depth, if any, sorts first, followed by
+		// those continuing down the exact-match branch.
+		exact, singleWC, zomWC := main.cNode.getBranches(key, c.config)
+		deeper := len(group)
+		for j, q := range group {
+			keys := q.keys[depth:]
+			subs := map[string]Subscriber{}
+			if !c.wLookup(i, nil, main, singleWC, zomWC, keys, startGen, nil, subs) {
+				return false
+			}
+			if len(keys) > 1 {
+				if deeper == len(group) {
+					deeper = j
+				}
+			} else if exact != nil {
+				s, _ := c.bLookup(i, nil, main, exact, keys, startGen, nil)
+				for _, sub := range s {
+					subs[sub.ID()] = sub
+				}
+			}
+			for _, sub := range subs {
+				results[q.index] = append(results[q.index], sub)
+			}
+		}
+		if deeper < len(group) && exact != nil && exact.iNode != nil {
+			if !c.iBatch(exact.iNode, group[deeper:], depth+1, startGen, results) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareKeys compares key paths word by word, a path sorting before those it
+// is a prefix of.
+func compareKeys(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// uniqueSubscribers returns the Subscribers without duplicate IDs.
+func uniqueSubscribers(subs []Subscriber) []Subscriber {
+	seen := make(map[string]bool, len(subs))
+	unique := make([]Subscriber, 0, len(subs))
+	for _, sub := range subs {
+		if !seen[sub.ID()] {
+			seen[sub.ID()] = true
+			unique = append(unique, sub)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribersBatch(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+	mb.Subscribe("a.b", sub1)
+	mb.Subscribe("a.*", sub2)
+	mb.Subscribe("a.b.c", sub3)
+	mb.Subscribe("*.b", sub3)
+	mb.SubscribeGroup("g", "a.b", sub3)
+
+	topics := []string{"a.b.c", "a.b", "x.b", "a.c", "a.b", "a", "z"}
+	results := mb.SubscribersBatch(topics)
+	assert.Len(results, len(topics))
+	for i, topic := range topics {
+		assert.ElementsMatch(mb.Subscribers(topic), results[i], topic)
+	}
+	assert.Equal([]Subscriber{}, results[6])
+	assert.Equal([][]Subscriber{}, mb.SubscribersBatch(nil))
+}
+
+func TestSubscribersBatchMatchesSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen, config.RangeWildcardClose = "{", "}"
+	config.BatchWorkers = 4
+	mb := New(config).(*matchbox)
+	words := []string{"a", "b", "c", "d", "e", "*", "#", "{1,2}"}
+	r := rand.New(rand.NewSource(1))
+	randomTopic := func(words []string) string {
+		topic := make([]string, 1+r.Intn(4))
+		for i := range topic {
+			topic[i] = words[r.Intn(len(words))]
+		}
+		return strings.Join(topic, ".")
+	}
+	for i := 0; i < 200; i++ {
+		mb.Subscribe(randomTopic(words), subscriber(strconv.Itoa(i%20)))
+	}
+
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = randomTopic(words[:5])
+	}
+	results := mb.SubscribersBatch(topics)
+	for i, topic := range topics {
+		assert.ElementsMatch(mb.Subscribers(topic), results[i], topic)
+	}
+}
+
+func BenchmarkSubscribersBatch(b *testing.B) {
+	mb, topics := batchBenchmark(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.SubscribersBatch(topics)
+	}
+}
+
+func BenchmarkSubscribersBatchParallel(b *testing.B) {
+	mb, topics := batchBenchmark(8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.SubscribersBatch(topics)
+	}
+}
+
+func BenchmarkSubscribersLoop(b *testing.B) {
+	mb, topics := batchBenchmark(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, topic := range topics {
+			mb.Subscribers(topic)
+		}
+	}
+}
+
+// batchBenchmark returns a Matchbox and a batch of 10,000 topics with common
+// prefixes to look up.
+func batchBenchmark(workers int) (*matchbox, []string) {
+	config := NewAMQPConfig()
+	config.BatchWorkers = workers
+	mb := New(config).(*matchbox)
+	sub := subscriber("abc")
+	for i := 0; i < 1000; i++ {
+		mb.Subscribe(strconv.Itoa(i%10)+"."+strconv.Itoa(i%50)+"."+strconv.Itoa(i), sub)
+	}
+	mb.Subscribe("*.*.7", sub)
+	mb.Subscribe("3.#", sub)
+	topics := make([]string, 10000)
+	for i := range topics {
+		j := i % 2000
+		topics[i] = strconv.Itoa(j%10) + "." + strconv.Itoa(j%50) + "." + strconv.Itoa(j)
+	}
+	return mb, topics
+}
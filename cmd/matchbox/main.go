@@ -0,0 +1,360 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Command matchbox analyzes routing offline. It loads a subscriptions file, such
+as a dump from production, into a Matchbox and reproduces its routing
+decisions.
+
+Usage:
+
+	matchbox -subs file [flags] command [arguments]
+
+The commands are:
+
+	match topic      print the IDs of the subscribers matching the topic
+	explain topic    explain how the subscribers matching the topic are found
+	stats            print statistics about the trie as JSON
+	overlaps [pattern]
+	                 print the pairs of patterns which overlap, or those the
+	                 pattern forms if given
+	export           export the trie as JSON, or as DOT with -dot
+	bench            benchmark lookups of the topics in the file given by -topics
+
+The subscriptions file has a pattern and a subscriber ID separated by
+whitespace on each line, or is JSON: either an array of objects with "pattern"
+and "subscriber" fields or an object mapping patterns to arrays of subscriber
+IDs.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Workiva/matchbox"
+)
+
+// dialects are the Configs which can be selected with -dialect.
+var dialects = map[string]func() *matchbox.Config{
+	"amqp": matchbox.NewAMQPConfig,
+	"mqtt": func() *matchbox.Config {
+		return &matchbox.Config{SingleWildcard: "+", ZeroOrMoreWildcard: "#", Delimiter: "/"}
+	},
+}
+
+// normalizations are the Normalizations which can be selected with
+// -normalize.
+var normalizations = map[string]matchbox.Normalization{
+	"none": matchbox.NormalizeNone,
+	"nfc":  matchbox.NormalizeNFC,
+	"nfkc": matchbox.NormalizeNFKC,
+}
+
+// errUsage is returned when the command line is invalid.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, "matchbox:", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// run runs the command line, writing output to stdout and usage to stderr.
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("matchbox", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	subs := flags.String("subs", "", "subscriptions `file`")
+	dialect := flags.String("dialect", "amqp", "topic dialect, amqp or mqtt")
+	delimiter := flags.String("delimiter", "", "word delimiter, overriding the dialect's")
+	single := flags.String("single", "", "single-word wildcard, overriding the dialect's")
+	zeroOrMore := flags.String("zero-or-more", "", "zero-or-more-word wildcard, overriding the dialect's")
+	rangeOpen := flags.String("range-open", "", "opening of ranged wildcards, e.g. {")
+	rangeClose := flags.String("range-close", "", "closing of ranged wildcards, e.g. }")
+	escape := flags.String("escape", "", "escape sequence, e.g. \\")
+	foldCase := flags.Bool("fold-case", false, "match case-insensitively")
+	normalize := flags.String("normalize", "none", "Unicode normalization, none, nfc or nfkc")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: matchbox -subs file [flags] match|explain|stats|overlaps|export|bench [arguments]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if *subs == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	newConfig, ok := dialects[*dialect]
+	if !ok {
+		return fmt.Errorf("unknown dialect %q", *dialect)
+	}
+	config := newConfig()
+	if *delimiter != "" {
+		config.Delimiter = *delimiter
+	}
+	if *single != "" {
+		config.SingleWildcard = *single
+	}
+	if *zeroOrMore != "" {
+		config.ZeroOrMoreWildcard = *zeroOrMore
+	}
+	config.RangeWildcardOpen = *rangeOpen
+	config.RangeWildcardClose = *rangeClose
+	config.Escape = *escape
+	config.FoldCase = *foldCase
+	if config.Normalization, ok = normalizations[*normalize]; !ok {
+		return fmt.Errorf("unknown normalization %q", *normalize)
+	}
+
+	f, err := os.Open(*subs)
+	if err != nil {
+		return err
+	}
+	subscriptions, err := readSubscriptions(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", *subs, err)
+	}
+	mb, err := load(config, subscriptions)
+	if err != nil {
+		return err
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "match":
+		return match(mb, args, stdout)
+	case "explain":
+		return explain(mb, args, stdout)
+	case "stats":
+		return stats(mb, stdout)
+	case "overlaps":
+		return overlaps(config, subscriptions, args, stdout)
+	case "export":
+		return export(mb, args, stdout, stderr)
+	case "bench":
+		return bench(mb, args, stdout, stderr)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// match prints the sorted IDs of the Subscribers matching the topic.
+func match(mb matchbox.Matchbox, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: match topic")
+	}
+	ids := []string{}
+	for _, sub := range mb.Subscribers(args[0]) {
+		ids = append(ids, sub.ID())
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if _, err := fmt.Fprintln(stdout, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explain prints the Explanation of the lookup of the topic.
+func explain(mb matchbox.Explainer, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: explain topic")
+	}
+	_, err := io.WriteString(stdout, mb.Explain(args[0]).String())
+	return err
+}
+
+// stats prints the Stats of the trie as JSON.
+func stats(mb matchbox.Inspector, stdout io.Writer) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(mb.Stats())
+}
+
+// overlaps prints each pair of distinct patterns which match a topic in
+// common, noting if either contains the other. Given a pattern, only the pairs
+// it forms with the subscribed patterns are printed. Patterns are bucketed by
+// their leading word, as patterns with different literal leading words never
+// overlap, so only those sharing it or led by a wildcard are compared.
+func overlaps(config *matchbox.Config, subscriptions []subscription, args []string, stdout io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("usage: overlaps [pattern]")
+	}
+	patterns := patterns(subscriptions)
+	if len(args) == 1 {
+		for _, b := range patterns {
+			if b != args[0] {
+				if err := printOverlap(config, args[0], b, stdout); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	// Patterns led by a wildcard are compared with every other pattern, and
+	// those led by a literal with the patterns in their bucket.
+	buckets, wildcards := map[string][]int{}, []int{}
+	leading := make([]string, len(patterns))
+	literal := make([]bool, len(patterns))
+	for i, pattern := range patterns {
+		leading[i], literal[i] = config.LeadingLiteral(pattern)
+		if literal[i] {
+			buckets[leading[i]] = append(buckets[leading[i]], i)
+		} else {
+			wildcards = append(wildcards, i)
+		}
+	}
+	all := make([]int, len(patterns))
+	for i := range all {
+		all[i] = i
+	}
+	for i, a := range patterns {
+		candidates := all
+		if literal[i] {
+			candidates = mergeIndexes(buckets[leading[i]], wildcards)
+		}
+		for _, j := range candidates {
+			if j <= i {
+				continue
+			}
+			if err := printOverlap(config, a, patterns[j], stdout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// printOverlap prints the patterns if they overlap, noting if either contains
+// the other.
+func printOverlap(config *matchbox.Config, a, b string, stdout io.Writer) error {
+	if !config.Overlaps(a, b) {
+		return nil
+	}
+	relation := "overlaps"
+	switch {
+	case config.Contains(a, b) && config.Contains(b, a):
+		relation = "equals"
+	case config.Contains(a, b):
+		relation = "contains"
+	case config.Contains(b, a):
+		relation = "within"
+	}
+	_, err := fmt.Fprintf(stdout, "%s\t%s\t%s\n", a, relation, b)
+	return err
+}
+
+// mergeIndexes merges the sorted indexes.
+func mergeIndexes(a, b []int) []int {
+	merged := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] < b[0] {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	return append(append(merged, a...), b...)
+}
+
+// export writes the structure of the trie as JSON or DOT.
+func export(mb matchbox.Inspector, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dot := flags.Bool("dot", false, "export as Graphviz DOT rather than JSON")
+	maxDepth := flags.Int("max-depth", 0, "maximum levels exported, zero for unlimited")
+	maxFanOut := flags.Int("max-fan-out", 0, "maximum branches exported per node, zero for unlimited")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	opts := matchbox.ExportOptions{MaxDepth: *maxDepth, MaxFanOut: *maxFanOut}
+	if *dot {
+		return mb.ExportDOT(stdout, opts)
+	}
+	return mb.ExportJSON(stdout, opts)
+}
+
+// bench looks up every topic in a file a number of times, printing the
+// throughput.
+func bench(mb matchbox.Matchbox, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	topicsFile := flags.String("topics", "", "`file` with a topic on each line")
+	iterations := flags.Int("n", 1, "number of times to look up every topic")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if *topicsFile == "" || *iterations < 1 {
+		flags.Usage()
+		return errUsage
+	}
+	topics, err := readTopics(*topicsFile)
+	if err != nil {
+		return err
+	}
+
+	lookups, matches := 0, 0
+	start := time.Now()
+	for i := 0; i < *iterations; i++ {
+		for _, topic := range topics {
+			matches += len(mb.Subscribers(topic))
+			lookups++
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(stdout, "topics\t%d\n", len(topics))
+	fmt.Fprintf(stdout, "lookups\t%d\n", lookups)
+	fmt.Fprintf(stdout, "elapsed\t%s\n", elapsed)
+	if lookups > 0 {
+		fmt.Fprintf(stdout, "ns/lookup\t%d\n", elapsed.Nanoseconds()/int64(lookups))
+		fmt.Fprintf(stdout, "lookups/s\t%.0f\n", float64(lookups)/elapsed.Seconds())
+		_, err = fmt.Fprintf(stdout, "matches/lookup\t%.2f\n", float64(matches)/float64(lookups))
+	}
+	return err
+}
+
+// readTopics reads the non-blank lines of a file.
+func readTopics(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	topics := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if topic := strings.TrimSpace(scanner.Text()); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	return topics, scanner.Err()
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Workiva/matchbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFile writes the contents to a file in a temporary directory, returning
+// its name.
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runCommand runs the command line, returning its output.
+func runCommand(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestReadSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	expected := []subscription{{"a.b", "abc"}, {"a.b", "def"}, {"c d.#", "abc"}}
+
+	subs, err := readSubscriptions(strings.NewReader("a.b abc\n\n  a.b\tdef\nc d.# abc\n"))
+	assert.Nil(err)
+	assert.Equal(expected, subs)
+
+	subs, err = readSubscriptions(strings.NewReader(
+		`[{"pattern": "a.b", "subscriber": "abc"}, {"pattern": "a.b", "subscriber": "def"},
+		  {"pattern": "c d.#", "subscriber": "abc"}]`))
+	assert.Nil(err)
+	assert.Equal(expected, subs)
+
+	subs, err = readSubscriptions(strings.NewReader(`{"c d.#": ["abc"], "a.b": ["def", "abc"]}`))
+	assert.Nil(err)
+	assert.Equal(expected, subs)
+
+	_, err = readSubscriptions(strings.NewReader("a.b abc\nc\n"))
+	assert.EqualError(err, "line 2: expected a pattern and a subscriber ID")
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.txt", "a.* def\na.# abc\nb.c abc\n")
+
+	out, err := runCommand("-subs", subs, "match", "a.b")
+	assert.Nil(err)
+	assert.Equal("abc\ndef\n", out)
+
+	out, err = runCommand("-subs", subs, "match", "c")
+	assert.Nil(err)
+	assert.Equal("", out)
+
+	_, err = runCommand("-subs", subs, "match")
+	assert.EqualError(err, "usage: match topic")
+}
+
+func TestDialects(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.txt", "a/+ abc\nA/{2} def\n")
+
+	out, err := runCommand("-subs", subs, "-dialect", "mqtt", "match", "a/b")
+	assert.Nil(err)
+	assert.Equal("abc\n", out)
+
+	out, err = runCommand("-subs", subs, "-dialect", "mqtt", "-fold-case",
+		"-range-open", "{", "-range-close", "}", "match", "a/b/c")
+	assert.Nil(err)
+	assert.Equal("def\n", out)
+
+	_, err = runCommand("-subs", subs, "-dialect", "stomp", "match", "a/b")
+	assert.EqualError(err, `unknown dialect "stomp"`)
+}
+
+func TestExplain(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.txt", "a.* abc\n")
+
+	out, err := runCommand("-subs", subs, "explain", "a.b")
+	assert.Nil(err)
+	assert.Contains(out, `single_wildcard branch "*" for word "b"`)
+	assert.Contains(out, `pattern "a.*" contributed abc`)
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.json", `{"a.b": ["abc", "def"], "c": ["abc"]}`)
+
+	out, err := runCommand("-subs", subs, "stats")
+	assert.Nil(err)
+	var stats matchbox.Stats
+	assert.Nil(json.Unmarshal([]byte(out), &stats))
+	assert.Equal(2, stats.Patterns)
+	assert.Equal(3, stats.Subscriptions)
+}
+
+func TestOverlaps(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.txt", "a.# abc\na.b def\na.*.c abc\nb.* abc\nb.# def\nc abc\n")
+
+	out, err := runCommand("-subs", subs, "overlaps")
+	assert.Nil(err)
+	assert.Equal("a.#\tcontains\ta.*.c\n"+
+		"a.#\tcontains\ta.b\n"+
+		"b.#\tcontains\tb.*\n", out)
+
+	subs = writeFile(t, "subs.txt", "a.*.# abc\na.#.* def\na.*.b abc\na.b.* abc\n")
+	out, err = runCommand("-subs", subs, "overlaps")
+	assert.Nil(err)
+	assert.Contains(out, "a.#.*\tequals\ta.*.#\n")
+	assert.Contains(out, "a.*.b\toverlaps\ta.b.*\n")
+
+	subs = writeFile(t, "subs.txt", "A.b abc\na.* abc\n")
+	out, err = runCommand("-subs", subs, "-fold-case", "overlaps")
+	assert.Nil(err)
+	assert.Equal("A.b\twithin\ta.*\n", out)
+
+	// Patterns led by different literals are never compared, while those led
+	// by wildcards are compared with all others.
+	subs = writeFile(t, "subs.txt", "a.b abc\nb.b abc\n*.b abc\n#.c abc\nb.# abc\n")
+	out, err = runCommand("-subs", subs, "overlaps")
+	assert.Nil(err)
+	assert.Equal("#.c\toverlaps\tb.#\n"+
+		"*.b\tcontains\ta.b\n"+
+		"*.b\toverlaps\tb.#\n"+
+		"*.b\tcontains\tb.b\n"+
+		"b.#\tcontains\tb.b\n", out)
+
+	out, err = runCommand("-subs", subs, "overlaps", "a.*")
+	assert.Nil(err)
+	assert.Equal("a.*\toverlaps\t#.c\n"+
+		"a.*\toverlaps\t*.b\n"+
+		"a.*\tcontains\ta.b\n", out)
+	_, err = runCommand("-subs", subs, "overlaps", "a", "b")
+	assert.NotNil(err)
+}
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.txt", "a.b abc\nc abc\n")
+
+	out, err := runCommand("-subs", subs, "export", "--dot", "--max-fan-out", "1")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(out, "digraph matchbox {"))
+	assert.Contains(out, "1 more branches")
+
+	out, err = runCommand("-subs", subs, "export", "-max-depth", "1")
+	assert.Nil(err)
+	var root matchbox.ExportedINode
+	assert.Nil(json.Unmarshal([]byte(out), &root))
+	assert.True(root.CNode.Branches[0].INode.Truncated)
+}
+
+func TestBench(t *testing.T) {
+	assert := assert.New(t)
+	subs := writeFile(t, "subs.txt", "a.* abc\na.# def\n")
+	topics := writeFile(t, "topics.txt", "a.b\n\nc\n")
+
+	out, err := runCommand("-subs", subs, "bench", "-topics", topics, "-n", "3")
+	assert.Nil(err)
+	assert.Contains(out, "topics\t2\n")
+	assert.Contains(out, "lookups\t6\n")
+	assert.Contains(out, "matches/lookup\t1.00\n")
+
+	_, err = runCommand("-subs", subs, "bench")
+	assert.Equal(errUsage, err)
+}
+
+func TestUsage(t *testing.T) {
+	assert := assert.New(t)
+	_, err := runCommand("match", "a.b")
+	assert.Equal(errUsage, err)
+
+	subs := writeFile(t, "subs.txt", "a.b abc\n")
+	_, err = runCommand("-subs", subs, "route", "a.b")
+	assert.EqualError(err, `unknown command "route"`)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Workiva/matchbox"
+)
+
+// subscriber is a Subscriber identified by the ID in a subscriptions file.
+type subscriber string
+
+// ID returns the Subscriber's ID.
+func (s subscriber) ID() string {
+	return string(s)
+}
+
+// subscription is a pattern subscribed to by the Subscriber with the ID.
+type subscription struct {
+	Pattern    string `json:"pattern"`
+	Subscriber string `json:"subscriber"`
+}
+
+// readSubscriptions reads a subscriptions file. It is either text, with a
+// pattern and a Subscriber ID separated by whitespace on each line, or JSON,
+// either an array of subscriptions or an object mapping patterns to arrays of
+// Subscriber IDs like a dump of Matchbox.Subscriptions.
+func readSubscriptions(r io.Reader) ([]subscription, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return parseJSONSubscriptions(trimmed)
+	}
+	return parseTextSubscriptions(data)
+}
+
+// parseTextSubscriptions parses a subscription from each non-blank line. The
+// Subscriber ID is the last word on the line so patterns may contain spaces.
+func parseTextSubscriptions(data []byte) ([]subscription, error) {
+	subscriptions := []subscription{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected a pattern and a subscriber ID", n)
+		}
+		subscriptions = append(subscriptions, subscription{
+			Pattern:    strings.TrimSpace(line[:i]),
+			Subscriber: line[i+1:],
+		})
+	}
+	return subscriptions, scanner.Err()
+}
+
+// parseJSONSubscriptions parses an array of subscriptions or an object
+// mapping patterns to Subscriber IDs.
+func parseJSONSubscriptions(data []byte) ([]subscription, error) {
+	if data[0] == '[' {
+		subscriptions := []subscription{}
+		if err := json.Unmarshal(data, &subscriptions); err != nil {
+			return nil, err
+		}
+		return subscriptions, nil
+	}
+	patterns := map[string][]string{}
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return nil, err
+	}
+	subscriptions := []subscription{}
+	for pattern, ids := range patterns {
+		for _, id := range ids {
+			subscriptions = append(subscriptions, subscription{Pattern: pattern, Subscriber: id})
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].Pattern != subscriptions[j].Pattern {
+			return subscriptions[i].Pattern < subscriptions[j].Pattern
+		}
+		return subscriptions[i].Subscriber < subscriptions[j].Subscriber
+	})
+	return subscriptions, nil
+}
+
+// loaded is a Matchbox which can be explained and inspected, as those
+// returned by New are.
+type loaded interface {
+	matchbox.Matchbox
+	matchbox.TrySubscriber
+	matchbox.Explainer
+	matchbox.Inspector
+}
+
+// load subscribes the subscriptions to a new Matchbox with the Config.
+func load(config *matchbox.Config, subscriptions []subscription) (loaded, error) {
+	mb := matchbox.New(config).(loaded)
+	for _, s := range subscriptions {
+		if err := mb.TrySubscribe(s.Pattern, subscriber(s.Subscriber)); err != nil {
+			return nil, fmt.Errorf("subscribing %s to %q: %w", s.Subscriber, s.Pattern, err)
+		}
+	}
+	return mb, nil
+}
+
+// patterns returns the distinct patterns of the subscriptions, sorted.
+func patterns(subscriptions []subscription) []string {
+	seen := map[string]bool{}
+	patterns := []string{}
+	for _, s := range subscriptions {
+		if !seen[s.Pattern] {
+			seen[s.Pattern] = true
+			patterns = append(patterns, s.Pattern)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
@@ -0,0 +1,543 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// span is a range of indices [start, end) into one of a Compiled's arrays.
+type span struct {
+	start, end uint32
+}
+
+// compiledEdge is a transition consuming a literal word.
+type compiledEdge struct {
+	word, state uint32
+}
+
+// compiledState is a state of a Compiled automaton. Each span indexes the
+// corresponding array of the Compiled.
+type compiledState struct {
+	edges   span // literal transitions, sorted by word
+	any     span // transitions consuming any word
+	closure span // the states reachable without consuming a word, including this one
+	subs    span // the Subscribers matching topics which end here
+
+	// loop indicates the state consumes any word and remains, i.e. it
+	// follows a zero-or-more wildcard.
+	loop bool
+}
+
+// Compiled is an immutable matcher compiled from a read-only snapshot of a
+// Matchbox. Its trie is flattened into a nondeterministic automaton over
+// interned words, with ranged wildcards unrolled and the states reachable
+// across zero-or-more wildcards precomputed, so lookups neither allocate
+// nodes nor follow pointers between them. Compiled is safe for concurrent
+// use.
+type Compiled struct {
+	config      *Config
+	words       map[string]uint32
+	states      []compiledState
+	edges       []compiledEdge
+	any         []uint32
+	closures    []uint32
+	subs        []uint32
+	subscribers []Subscriber
+	scratch     sync.Pool
+}
+
+// compiledScratch is the working memory of a lookup. Marks record the lookup
+// step a state or Subscriber was last added in, so the sets need not be
+// cleared between steps.
+type compiledScratch struct {
+	mark       uint32
+	stateMarks []uint32
+	subMarks   []uint32
+	current    []uint32
+	next       []uint32
+}
+
+// Compile compiles a read-only snapshot of the Matchbox into an immutable
+// matcher.
+func (m *matchbox) Compile() *Compiled {
+	snapshot := m.ReadOnlySnapshot()
+	c := &compiler{
+		ctrie:     snapshot,
+		words:     map[string]uint32{},
+		subIndex:  map[string]uint32{},
+		compiling: []*compilingState{{}},
+	}
+	c.iNode(0, snapshot.root)
+	return c.compiled()
+}
+
+// Lookup returns the Subscribers for a topic, like Matchbox.Subscribers.
+func (c *Compiled) Lookup(topic string) []Subscriber {
+	return c.lookup(c.config.topicKeys(topic))
+}
+
+// LookupWords returns the Subscribers for a pre-tokenized topic, like
+// Matchbox.SubscribersWords.
+func (c *Compiled) LookupWords(words []string) []Subscriber {
+	if len(words) == 0 {
+		return []Subscriber{}
+	}
+	return c.lookup(c.config.wordKeys(words, true))
+}
+
+// lookup returns the Subscribers for the key path by simulating the automaton
+// over it.
+func (c *Compiled) lookup(keys []string) []Subscriber {
+	sc := c.scratch.Get().(*compiledScratch)
+	defer c.scratch.Put(sc)
+
+	current := c.enter(sc, sc.current[:0], 0, sc.nextMark())
+	for _, key := range keys {
+		if len(current) == 0 {
+			break
+		}
+		word, literal := c.words[key]
+		mark := sc.nextMark()
+		next := sc.next[:0]
+		for _, s := range current {
+			state := &c.states[s]
+			if state.loop {
+				next = c.enter(sc, next, s, mark)
+			}
+			if literal {
+				if t, ok := c.edge(state, word); ok {
+					next = c.enter(sc, next, t, mark)
+				}
+			}
+			for _, t := range c.any[state.any.start:state.any.end] {
+				next = c.enter(sc, next, t, mark)
+			}
+		}
+		sc.current, sc.next = next, current
+		current = next
+	}
+
+	subs := []Subscriber{}
+	mark := sc.nextMark()
+	for _, s := range current {
+		state := &c.states[s]
+		for _, sub := range c.subs[state.subs.start:state.subs.end] {
+			if sc.subMarks[sub] != mark {
+				sc.subMarks[sub] = mark
+				subs = append(subs, c.subscribers[sub])
+			}
+		}
+	}
+	sc.current = current
+	return ungrouped(subs)
+}
+
+// enter adds the closure of the state to the set of states being entered in
+// the lookup step with the given mark.
+func (c *Compiled) enter(sc *compiledScratch, states []uint32, s, mark uint32) []uint32 {
+	closure := c.states[s].closure
+	for _, t := range c.closures[closure.start:closure.end] {
+		if sc.stateMarks[t] != mark {
+			sc.stateMarks[t] = mark
+			states = append(states, t)
+		}
+	}
+	return states
+}
+
+// edge returns the state the literal word transitions to from the state, if
+// any.
+func (c *Compiled) edge(state *compiledState, word uint32) (uint32, bool) {
+	edges := c.edges[state.edges.start:state.edges.end]
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].word >= word })
+	if i < len(edges) && edges[i].word == word {
+		return edges[i].state, true
+	}
+	return 0, false
+}
+
+// nextMark returns the mark for the next lookup step, clearing the marks
+// when they wrap around.
+func (sc *compiledScratch) nextMark() uint32 {
+	sc.mark++
+	if sc.mark == 0 {
+		clear(sc.stateMarks)
+		clear(sc.subMarks)
+		sc.mark = 1
+	}
+	return sc.mark
+}
+
+// compilingState is a state of an automaton being compiled.
+type compilingState struct {
+	edges   []compiledEdge
+	any     []uint32
+	epsilon []uint32
+	subs    []uint32
+	loop    bool
+}
+
+// compiler builds a Compiled from a read-only ctrie.
+type compiler struct {
+	ctrie       *ctrie
+	words       map[string]uint32
+	subIndex    map[string]uint32
+	subscribers []Subscriber
+	compiling   []*compilingState
+}
+
+// state adds a new state and returns it.
+func (c *compiler) state() uint32 {
+	c.compiling = append(c.compiling, &compilingState{})
+	return uint32(len(c.compiling) - 1)
+}
+
+// iNode adds the transitions out of the state for the branches of the
+// I-node's C-node.
+func (c *compiler) iNode(s uint32, in *iNode) {
+	main := gcasRead(in, c.ctrie)
+	if main.cNode == nil {
+		return
+	}
+	keys := make([]string, 0, len(main.cNode.branches))
+	for key := range main.cNode.branches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t := c.state()
+		c.branch(t, main.cNode.branches[key])
+		from := c.compiling[s]
+		if bounds, ok := main.cNode.ranges[key]; ok {
+			c.unroll(s, t, bounds)
+			continue
+		}
+		switch key {
+		case c.ctrie.config.SingleWildcard:
+			from.any = append(from.any, t)
+		case c.ctrie.config.ZeroOrMoreWildcard:
+			from.epsilon = append(from.epsilon, t)
+			c.compiling[t].loop = true
+		default:
+			word, ok := c.words[key]
+			if !ok {
+				word = uint32(len(c.words))
+				c.words[key] = word
+			}
+			from.edges = append(from.edges, compiledEdge{word: word, state: t})
+		}
+	}
+}
+
+// branch makes the state match the branch's Subscribers and adds the
+// transitions for its I-node, if any.
+func (c *compiler) branch(s uint32, br *branch) {
+	for id, sub := range br.subs {
+		index, ok := c.subIndex[id]
+		if !ok {
+			index = uint32(len(c.subscribers))
+			c.subIndex[id] = index
+			c.subscribers = append(c.subscribers, sub)
+		}
+		c.compiling[s].subs = append(c.compiling[s].subs, index)
+	}
+	if br.iNode != nil {
+		c.iNode(s, br.iNode)
+	}
+}
+
+// unroll adds transitions from the state to the target consuming between the
+// bounds' minimum and maximum number of words, through a chain of
+// intermediate states.
+func (c *compiler) unroll(s, target uint32, bounds wordRange) {
+	from := s
+	for n := 0; n < bounds.max; n++ {
+		if n >= bounds.min {
+			c.compiling[from].epsilon = append(c.compiling[from].epsilon, target)
+		}
+		to := target
+		if n < bounds.max-1 {
+			to = c.state()
+		}
+		c.compiling[from].any = append(c.compiling[from].any, to)
+		from = to
+	}
+}
+
+// closure appends the states reachable from the state without consuming a
+// word, which is acyclic, to the closure.
+func (c *compiler) closure(closure []uint32, s uint32) []uint32 {
+	for _, t := range closure {
+		if t == s {
+			return closure
+		}
+	}
+	closure = append(closure, s)
+	for _, t := range c.compiling[s].epsilon {
+		closure = c.closure(closure, t)
+	}
+	return closure
+}
+
+// compiled flattens the states into a Compiled.
+func (c *compiler) compiled() *Compiled {
+	compiled := &Compiled{
+		config:      c.ctrie.config,
+		words:       c.words,
+		states:      make([]compiledState, len(c.compiling)),
+		subscribers: c.subscribers,
+	}
+	for s, state := range c.compiling {
+		sort.Slice(state.edges, func(i, j int) bool { return state.edges[i].word < state.edges[j].word })
+		compiled.states[s] = compiledState{
+			edges:   appendSpan(&compiled.edges, state.edges),
+			any:     appendSpan(&compiled.any, state.any),
+			closure: appendSpan(&compiled.closures, c.closure(nil, uint32(s))),
+			subs:    appendSpan(&compiled.subs, state.subs),
+			loop:    state.loop,
+		}
+	}
+	compiled.scratch.New = func() any {
+		return &compiledScratch{
+			stateMarks: make([]uint32, len(compiled.states)),
+			subMarks:   make([]uint32, len(compiled.subscribers)),
+		}
+	}
+	return compiled
+}
+
+// appendSpan appends the values to the array and returns their span.
+func appendSpan[T any](array *[]T, values []T) span {
+	start := uint32(len(*array))
+	*array = append(*array, values...)
+	return span{start: start, end: uint32(len(*array))}
+}
+
+// RecompileConfig contains configuration parameters for a Recompiling
+// Matchbox.
+type RecompileConfig struct {
+	// Delay is how long to wait after a write before recompiling, so a burst
+	// of writes is compiled once. Defaults to recompiling immediately.
+	Delay time.Duration
+}
+
+// Recompiling is a Matchbox whose lookups are served from a Compiled
+// snapshot. Writes mark it stale, and it is recompiled in the background and
+// swapped in atomically, so lookups reflect writes once it has been.
+type Recompiling struct {
+	Matchbox
+	config   RecompileConfig
+	mu       sync.Mutex
+	compiled atomic.Pointer[Compiled]
+	stale    chan struct{}
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewRecompiling wraps the Matchbox, compiling it and starting a background
+// recompiler which runs until Close is called.
+func NewRecompiling(mb Matchbox, config RecompileConfig) *Recompiling {
+	r := &Recompiling{
+		Matchbox: mb,
+		config:   config,
+		stale:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	r.Recompile()
+	go r.recompile()
+	return r
+}
+
+// Compiled returns the Compiled snapshot lookups are currently served from.
+func (r *Recompiling) Compiled() *Compiled {
+	return r.compiled.Load()
+}
+
+// Recompile compiles the Matchbox and swaps it in immediately.
+func (r *Recompiling) Recompile() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.Matchbox.(Compiler); ok {
+		r.compiled.Store(c.Compile())
+		return
+	}
+	r.compiled.Store(compileSubscriptions(r.Matchbox, r.configuration()))
+}
+
+// compileSubscriptions compiles the subscriptions of a Matchbox which isn't a
+// Compiler by copying them into one built with the Config, or the default
+// Config if it is nil.
+func compileSubscriptions(mb Matchbox, config *Config) *Compiled {
+	if config == nil {
+		config = NewAMQPConfig()
+	}
+	copied := New(config)
+	for topic, subscribers := range mb.Subscriptions() {
+		for _, subscriber := range subscribers {
+			copied.Subscribe(topic, subscriber)
+		}
+	}
+	return copied.(Compiler).Compile()
+}
+
+// Subscribe a Subscriber to a topic.
+func (r *Recompiling) Subscribe(topic string, subscriber Subscriber) {
+	defer r.changed()
+	r.Matchbox.Subscribe(topic, subscriber)
+}
+
+// TrySubscribe subscribes a Subscriber to a topic, returning the reason it
+// wasn't if the wrapped Matchbox reports it.
+func (r *Recompiling) TrySubscribe(topic string, subscriber Subscriber) error {
+	defer r.changed()
+	return TrySubscribe(r.Matchbox, topic, subscriber)
+}
+
+// Unsubscribe a Subscriber from a topic.
+func (r *Recompiling) Unsubscribe(topic string, subscriber Subscriber) {
+	defer r.changed()
+	r.Matchbox.Unsubscribe(topic, subscriber)
+}
+
+// SubscribeWords subscribes a Subscriber to a pre-tokenized topic.
+// ErrUnsupported is returned if the wrapped Matchbox isn't a WordMatchbox.
+func (r *Recompiling) SubscribeWords(words []string, subscriber Subscriber) error {
+	mb, ok := r.Matchbox.(WordMatchbox)
+	if !ok {
+		return ErrUnsupported
+	}
+	defer r.changed()
+	return mb.SubscribeWords(words, subscriber)
+}
+
+// UnsubscribeWords unsubscribes a Subscriber from a pre-tokenized topic. It
+// does nothing if the wrapped Matchbox isn't a WordMatchbox.
+func (r *Recompiling) UnsubscribeWords(words []string, subscriber Subscriber) {
+	if mb, ok := r.Matchbox.(WordMatchbox); ok {
+		defer r.changed()
+		mb.UnsubscribeWords(words, subscriber)
+	}
+}
+
+// configuration returns the wrapped Matchbox's Config, or nil if it doesn't
+// expose it.
+func (r *Recompiling) configuration() *Config {
+	if mb, ok := r.Matchbox.(configured); ok {
+		return mb.configuration()
+	}
+	return nil
+}
+
+// SubscribeGroup subscribes a Subscriber to a topic as a member of a shared
+// subscription group. ErrUnsupported is returned if the wrapped Matchbox isn't
+// a GroupMatchbox.
+func (r *Recompiling) SubscribeGroup(group, topic string, subscriber Subscriber) error {
+	mb, ok := r.Matchbox.(GroupMatchbox)
+	if !ok {
+		return ErrUnsupported
+	}
+	defer r.changed()
+	return mb.SubscribeGroup(group, topic, subscriber)
+}
+
+// UnsubscribeGroup unsubscribes a member of a shared subscription group from
+// a topic. It does nothing if the wrapped Matchbox isn't a GroupMatchbox.
+func (r *Recompiling) UnsubscribeGroup(group, topic string, subscriber Subscriber) {
+	if mb, ok := r.Matchbox.(GroupMatchbox); ok {
+		defer r.changed()
+		mb.UnsubscribeGroup(group, topic, subscriber)
+	}
+}
+
+// Apply makes the Changes atomically. ErrUnsupported is returned if the
+// wrapped Matchbox isn't an Applier.
+func (r *Recompiling) Apply(changes []Change) error {
+	mb, ok := r.Matchbox.(Applier)
+	if !ok {
+		return ErrUnsupported
+	}
+	defer r.changed()
+	return mb.Apply(changes)
+}
+
+// Subscribers returns the Subscribers for a topic from the Compiled snapshot.
+func (r *Recompiling) Subscribers(topic string) []Subscriber {
+	return r.Compiled().Lookup(topic)
+}
+
+// SubscribersWords returns the Subscribers for a pre-tokenized topic from the
+// Compiled snapshot.
+func (r *Recompiling) SubscribersWords(words []string) []Subscriber {
+	return r.Compiled().LookupWords(words)
+}
+
+// SubscribersBytes returns the Subscribers for a topic from the Compiled
+// snapshot.
+func (r *Recompiling) SubscribersBytes(topic []byte) []Subscriber {
+	return r.Compiled().Lookup(string(topic))
+}
+
+// SubscribersBatch returns the Subscribers for each of the topics, in order,
+// from the same Compiled snapshot.
+func (r *Recompiling) SubscribersBatch(topics []string) [][]Subscriber {
+	compiled := r.Compiled()
+	results := make([][]Subscriber, len(topics))
+	for i, topic := range topics {
+		results[i] = compiled.Lookup(topic)
+	}
+	return results
+}
+
+// Close stops the background recompiler. Lookups are not updated after Close
+// unless Recompile is called.
+func (r *Recompiling) Close() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+}
+
+// changed marks the Compiled snapshot stale.
+func (r *Recompiling) changed() {
+	select {
+	case r.stale <- struct{}{}:
+	default:
+	}
+}
+
+// recompile calls Recompile whenever the Compiled snapshot is stale until the
+// Recompiling is closed.
+func (r *Recompiling) recompile() {
+	for {
+		select {
+		case <-r.stale:
+		case <-r.stop:
+			return
+		}
+		if r.config.Delay > 0 {
+			select {
+			case <-time.After(r.config.Delay):
+			case <-r.stop:
+				return
+			}
+		}
+		r.Recompile()
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen, config.RangeWildcardClose = "{", "}"
+	mb := New(config).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+	mb.Subscribe("a.b", sub1)
+	mb.Subscribe("a.*", sub2)
+	mb.Subscribe("a.#.c", sub3)
+	mb.Subscribe("a.{2,3}", sub1)
+	mb.SubscribeGroup("g", "#", sub3)
+
+	compiled := mb.Compile()
+	assert.ElementsMatch([]Subscriber{sub1, sub2, sub3}, compiled.Lookup("a.b"))
+	assert.ElementsMatch([]Subscriber{sub2, sub3}, compiled.Lookup("a.c"))
+	assert.ElementsMatch([]Subscriber{sub1, sub3}, compiled.Lookup("a.b.x"))
+	assert.ElementsMatch([]Subscriber{sub1, sub3}, compiled.Lookup("a.b.x.c"))
+	assert.Equal([]Subscriber{sub3}, compiled.Lookup("a.b.x.y.z"))
+	assert.Equal([]Subscriber{sub3}, compiled.Lookup("b"))
+	assert.ElementsMatch([]Subscriber{sub1, sub2, sub3}, compiled.LookupWords([]string{"a", "b"}))
+
+	// The Compiled snapshot is immutable.
+	mb.Unsubscribe("a.b", sub1)
+	mb.Subscribe("b", sub1)
+	assert.ElementsMatch([]Subscriber{sub1, sub2, sub3}, compiled.Lookup("a.b"))
+	assert.Equal([]Subscriber{sub3}, compiled.Lookup("b"))
+	assert.ElementsMatch([]Subscriber{sub1, sub3}, mb.Compile().Lookup("b"))
+}
+
+func TestCompileMatchesPatterns(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen, config.RangeWildcardClose = "{", "}"
+	mb := New(config).(*matchbox)
+	words := []string{"a", "b", "c", "d", "*", "#", "{0,1}", "{1,2}"}
+	r := rand.New(rand.NewSource(1))
+	randomTopic := func(words []string) string {
+		topic := make([]string, 1+r.Intn(5))
+		for i := range topic {
+			topic[i] = words[r.Intn(len(words))]
+		}
+		return strings.Join(topic, ".")
+	}
+	patterns := map[string]*patternNFA{}
+	for i := 0; i < 100; i++ {
+		pattern := randomTopic(words)
+		mb.Subscribe(pattern, subscriber(pattern))
+		patterns[pattern] = config.compilePattern(config.patternKeys(pattern))
+	}
+
+	compiled := mb.Compile()
+	for i := 0; i < 1000; i++ {
+		topic := randomTopic(words[:4])
+		expected := []Subscriber{}
+		for pattern, nfa := range patterns {
+			states := nfa.start()
+			for _, key := range config.topicKeys(topic) {
+				states = nfa.next(states, key, false)
+			}
+			if nfa.accepting(states) {
+				expected = append(expected, subscriber(pattern))
+			}
+		}
+		assert.ElementsMatch(expected, compiled.Lookup(topic), topic)
+		assert.ElementsMatch(expected, mb.Subscribers(topic), topic)
+	}
+}
+
+func TestCompileMatchesSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen, config.RangeWildcardClose = "{", "}"
+	mb := New(config).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+	mb.Subscribe("#", sub1)
+	mb.Subscribe("#.b", sub2)
+	mb.Subscribe("a.b", sub3)
+	mb.Subscribe("a.#.{1}", sub3)
+	mb.Subscribe("#.b.c", sub3)
+
+	compiled := mb.Compile()
+	for _, topic := range []string{"a.b", "b", "x.y.b", "a.z", "b.c", "b.b.c", "a"} {
+		assert.ElementsMatch(compiled.Lookup(topic), mb.Subscribers(topic), topic)
+	}
+	assert.ElementsMatch([]Subscriber{sub1, sub2, sub3}, mb.Subscribers("a.b"))
+	assert.ElementsMatch([]Subscriber{sub1, sub3}, mb.Subscribers("b.c"))
+}
+
+func TestRecompiling(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig())
+	sub := subscriber("abc")
+	mb.Subscribe("a", sub)
+	r := NewRecompiling(mb, RecompileConfig{})
+	defer r.Close()
+	assert.Equal([]Subscriber{sub}, r.Subscribers("a"))
+
+	compiled := r.Compiled()
+	assert.Nil(r.TrySubscribe("a.*", sub))
+	assert.Eventually(func() bool { return r.Compiled() != compiled }, time.Second, time.Millisecond)
+	assert.Equal([]Subscriber{sub}, r.Subscribers("a.b"))
+	assert.Equal([]Subscriber{sub}, r.SubscribersBytes([]byte("a.b")))
+	assert.Equal([][]Subscriber{{sub}, {}}, r.SubscribersBatch([]string{"a", "b"}))
+
+	r.Unsubscribe("a", sub)
+	assert.Eventually(func() bool { return len(r.Subscribers("a")) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestRecompilingDelay(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRecompiling(New(NewAMQPConfig()), RecompileConfig{Delay: time.Hour})
+	sub := subscriber("abc")
+	r.Subscribe("a", sub)
+	assert.Equal([]Subscriber{}, r.Subscribers("a"))
+
+	// Recompile swaps in the subscription without waiting, and writes are
+	// no longer recompiled once closed.
+	r.Recompile()
+	assert.Equal([]Subscriber{sub}, r.Subscribers("a"))
+	r.Close()
+	r.Subscribe("b", sub)
+	assert.Equal([]Subscriber{}, r.Subscribers("b"))
+}
+
+func BenchmarkCompiledLookup(b *testing.B) {
+	mb, topics := lookupBenchmark()
+	compiled := mb.Compile()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compiled.Lookup(topics[i%len(topics)])
+	}
+}
+
+func BenchmarkCtrieLookup(b *testing.B) {
+	mb, topics := lookupBenchmark()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.Subscribers(topics[i%len(topics)])
+	}
+}
+
+// lookupBenchmark returns a Matchbox with literal and wildcard subscriptions
+// and topics to look up.
+func lookupBenchmark() (*matchbox, []string) {
+	mb := New(NewAMQPConfig()).(*matchbox)
+	for i := 0; i < 1000; i++ {
+		sub := subscriber(strconv.Itoa(i % 100))
+		mb.Subscribe(strconv.Itoa(i%10)+"."+strconv.Itoa(i%50)+"."+strconv.Itoa(i), sub)
+		mb.Subscribe(strconv.Itoa(i%10)+".*."+strconv.Itoa(i), sub)
+	}
+	mb.Subscribe("3.#", subscriber("abc"))
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = strconv.Itoa(i%10) + "." + strconv.Itoa(i%50) + "." + strconv.Itoa(i)
+	}
+	return mb, topics
+}
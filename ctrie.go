@@ -19,6 +19,7 @@ package matchbox
 import (
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -27,11 +28,22 @@ type ctrie struct {
 	root     *iNode
 	config   *Config
 	readOnly bool
+
+	// limiter enforces the Config's Limits if it is set.
+	limiter *limiter
+
+	// interner interns the words keying the branches if the Config has an
+	// Interner. It is either that Interner or, for a writable snapshot, one
+	// staging references to it.
+	interner *Interner
 }
 
 // generation demarcates ctrie snapshots. We use a heap-allocated reference
-// instead of an integer to avoid integer overflows.
-type generation struct{}
+// instead of an integer to avoid integer overflows. It isn't zero-sized, as
+// pointers to distinct zero-sized values may be equal.
+type generation struct {
+	_ byte
+}
 
 // iNode is an indirection node. I-nodes remain present in the ctrie even as
 // nodes above and below change. Thread-safety is achieved in part by
@@ -73,43 +85,50 @@ type mainNode struct {
 type cNode struct {
 	branches map[string]*branch
 	gen      *generation
+
+	// ranges indexes the bounds of the ranged-wildcard branches by key so
+	// lookups don't parse the key of every branch.
+	ranges map[string]wordRange
 }
 
 // newCNode creates a new C-node with the given subscription path.
-func newCNode(keys []string, sub Subscriber, gen *generation) *cNode {
+func newCNode(keys []string, sub Subscriber, topic string, gen *generation, config *Config) *cNode {
+	ranges := withRange(nil, keys[0], config)
 	if len(keys) == 1 {
 		return &cNode{
-			branches: map[string]*branch{
-				keys[0]: &branch{subs: map[string]Subscriber{sub.ID(): sub}}},
-			gen: gen,
+			branches: map[string]*branch{keys[0]: newBranch(sub, topic)},
+			gen:      gen,
+			ranges:   ranges,
 		}
 	}
-	nin := &iNode{main: &mainNode{cNode: newCNode(keys[1:], sub, gen)}, gen: gen}
+	nin := &iNode{main: &mainNode{cNode: newCNode(keys[1:], sub, topic, gen, config)}, gen: gen}
 	return &cNode{
 		branches: map[string]*branch{
 			keys[0]: &branch{subs: map[string]Subscriber{}, iNode: nin}},
-		gen: gen,
+		gen:    gen,
+		ranges: ranges,
 	}
 }
 
 // inserted returns a copy of this C-node with the specified Subscriber
 // inserted.
-func (c *cNode) inserted(keys []string, sub Subscriber, gen *generation) *cNode {
+func (c *cNode) inserted(keys []string, sub Subscriber, topic string, gen *generation,
+	config *Config) *cNode {
 	branches := make(map[string]*branch, len(c.branches)+1)
 	for key, branch := range c.branches {
 		branches[key] = branch
 	}
 	var br *branch
 	if len(keys) == 1 {
-		br = &branch{subs: map[string]Subscriber{sub.ID(): sub}}
+		br = newBranch(sub, topic)
 	} else {
 		br = &branch{
 			subs:  map[string]Subscriber{},
-			iNode: &iNode{main: &mainNode{cNode: newCNode(keys[1:], sub, gen)}, gen: gen},
+			iNode: &iNode{main: &mainNode{cNode: newCNode(keys[1:], sub, topic, gen, config)}, gen: gen},
 		}
 	}
 	branches[keys[0]] = br
-	return &cNode{branches: branches, gen: gen}
+	return &cNode{branches: branches, gen: gen, ranges: withRange(c.ranges, keys[0], config)}
 }
 
 // updatedBranch returns a copy of this C-node with the specified branch
@@ -120,24 +139,42 @@ func (c *cNode) updatedBranch(key string, in *iNode, br *branch, gen *generation
 		branches[key] = branch
 	}
 	branches[key] = br.updated(in)
-	return &cNode{branches: branches, gen: gen}
+	return &cNode{branches: branches, gen: gen, ranges: c.ranges}
 }
 
 // updated returns a copy of this C-node with the specified branch updated.
-func (c *cNode) updated(key string, sub Subscriber, gen *generation) *cNode {
+func (c *cNode) updated(key string, sub Subscriber, topic string, gen *generation,
+	config *Config) *cNode {
 	branches := make(map[string]*branch, len(c.branches))
 	for key, branch := range c.branches {
 		branches[key] = branch
 	}
-	newBranch := &branch{subs: map[string]Subscriber{sub.ID(): sub}}
+	nb := &branch{subs: map[string]Subscriber{}}
 	br, ok := branches[key]
 	if ok {
 		for id, sub := range br.subs {
-			newBranch.subs[id] = sub
+			nb.subs[id] = sub
+		}
+		if len(br.topics) > 0 {
+			nb.topics = make(map[string]string, len(br.topics)+1)
+			for id, topic := range br.topics {
+				nb.topics[id] = topic
+			}
+		}
+		nb.iNode = br.iNode
+		nb.refs = br.refs
+	}
+	nb.subs[sub.ID()] = sub
+	if topic != "" {
+		if nb.topics == nil {
+			nb.topics = map[string]string{}
 		}
+		nb.topics[sub.ID()] = topic
+	} else {
+		delete(nb.topics, sub.ID())
 	}
-	branches[key] = newBranch
-	return &cNode{branches: branches, gen: gen}
+	branches[key] = nb
+	return &cNode{branches: branches, gen: gen, ranges: withRange(c.ranges, key, config)}
 }
 
 // removed returns a copy of this C-node with the Subscriber removed from the
@@ -147,6 +184,7 @@ func (c *cNode) removed(key string, sub Subscriber, gen *generation) *cNode {
 	for key, branch := range c.branches {
 		branches[key] = branch
 	}
+	ranges := c.ranges
 	br, ok := branches[key]
 	if ok {
 		br = br.removed(sub)
@@ -154,11 +192,23 @@ func (c *cNode) removed(key string, sub Subscriber, gen *generation) *cNode {
 			// Remove the branch if it contains no subscribers and doesn't
 			// point anywhere.
 			delete(branches, key)
+			ranges = withoutRange(c.ranges, key)
 		} else {
 			branches[key] = br
 		}
 	}
-	return &cNode{branches: branches, gen: gen}
+	return &cNode{branches: branches, gen: gen, ranges: ranges}
+}
+
+// referenced returns a copy of this C-node with the reference count of the
+// Subscriber on the corresponding branch adjusted by delta.
+func (c *cNode) referenced(key, id string, delta int, gen *generation) *cNode {
+	branches := make(map[string]*branch, len(c.branches))
+	for key, branch := range c.branches {
+		branches[key] = branch
+	}
+	branches[key] = branches[key].referenced(id, delta)
+	return &cNode{branches: branches, gen: gen, ranges: c.ranges}
 }
 
 // getBranches returns the branches for the given key. There are three
@@ -173,18 +223,68 @@ func (c *cNode) getBranch(key string) *branch {
 	return c.branches[key]
 }
 
+// rangeBranch is a branch keyed on a ranged wildcard.
+type rangeBranch struct {
+	*branch
+	bounds wordRange
+}
+
+// getRangeBranches returns the ranged-wildcard branches, if any.
+func (c *cNode) getRangeBranches() []rangeBranch {
+	if len(c.ranges) == 0 {
+		return nil
+	}
+	ranges := make([]rangeBranch, 0, len(c.ranges))
+	for key, bounds := range c.ranges {
+		ranges = append(ranges, rangeBranch{branch: c.branches[key], bounds: bounds})
+	}
+	return ranges
+}
+
+// withRange returns the index of ranged-wildcard branches with the key added
+// if it is a ranged wildcard. The index is returned as is if unchanged.
+func withRange(index map[string]wordRange, key string, config *Config) map[string]wordRange {
+	bounds, ok := config.parseRange(key)
+	if _, indexed := index[key]; !ok || indexed {
+		return index
+	}
+	ranges := make(map[string]wordRange, len(index)+1)
+	for k, r := range index {
+		ranges[k] = r
+	}
+	ranges[key] = bounds
+	return ranges
+}
+
+// withoutRange returns the index of ranged-wildcard branches with the key
+// removed. The index is returned as is if unchanged.
+func withoutRange(index map[string]wordRange, key string) map[string]wordRange {
+	if _, ok := index[key]; !ok {
+		return index
+	}
+	ranges := make(map[string]wordRange, len(index))
+	for k, r := range index {
+		if k != key {
+			ranges[k] = r
+		}
+	}
+	return ranges
+}
+
 // renewed returns a copy of this cNode with the I-nodes below it copied to the
 // given generation.
 func (c *cNode) renewed(gen *generation, ctrie *ctrie) *cNode {
 	branches := make(map[string]*branch, len(c.branches))
 	for key, br := range c.branches {
 		if br.iNode != nil {
-			branches[key] = &branch{iNode: br.iNode.copyToGen(gen, ctrie), subs: br.subs}
+			nb := *br
+			nb.iNode = br.iNode.copyToGen(gen, ctrie)
+			branches[key] = &nb
 		} else {
 			branches[key] = br
 		}
 	}
-	return &cNode{branches: branches, gen: gen}
+	return &cNode{branches: branches, gen: gen, ranges: c.ranges}
 }
 
 // tNode is tomb node which is a special node used to ensure proper ordering
@@ -195,6 +295,24 @@ type tNode struct{}
 type branch struct {
 	iNode *iNode
 	subs  map[string]Subscriber
+
+	// topics maps Subscriber IDs to the pattern as it was subscribed if it
+	// differs from the normalized path to this branch.
+	topics map[string]string
+
+	// refs maps Subscriber IDs to the number of times they were subscribed
+	// if the Config counts references and it is more than once.
+	refs map[string]int
+}
+
+// newBranch creates a new branch with the given Subscriber. The topic is the
+// pattern as subscribed or empty if it is the same as the branch's path.
+func newBranch(sub Subscriber, topic string) *branch {
+	br := &branch{subs: map[string]Subscriber{sub.ID(): sub}}
+	if topic != "" {
+		br.topics = map[string]string{sub.ID(): topic}
+	}
+	return br
 }
 
 // updated returns a copy of this branch updated with the given I-node.
@@ -203,7 +321,7 @@ func (b *branch) updated(in *iNode) *branch {
 	for id, sub := range b.subs {
 		subs[id] = sub
 	}
-	return &branch{subs: subs, iNode: in}
+	return &branch{subs: subs, iNode: in, topics: b.topics, refs: b.refs}
 }
 
 // removed returns a copy of this branch with the given Subscriber removed.
@@ -213,7 +331,55 @@ func (b *branch) removed(sub Subscriber) *branch {
 		subs[id] = sub
 	}
 	delete(subs, sub.ID())
-	return &branch{subs: subs, iNode: b.iNode}
+	var topics map[string]string
+	if _, ok := b.topics[sub.ID()]; ok {
+		topics = make(map[string]string, len(b.topics))
+		for id, topic := range b.topics {
+			topics[id] = topic
+		}
+		delete(topics, sub.ID())
+	} else {
+		topics = b.topics
+	}
+	refs := b.refs
+	if _, ok := refs[sub.ID()]; ok {
+		refs = make(map[string]int, len(b.refs))
+		for id, n := range b.refs {
+			refs[id] = n
+		}
+		delete(refs, sub.ID())
+	}
+	return &branch{subs: subs, iNode: b.iNode, topics: topics, refs: refs}
+}
+
+// refCount returns the number of times the Subscriber with the given ID was
+// subscribed to this branch.
+func (b *branch) refCount(id string) int {
+	if _, ok := b.subs[id]; !ok {
+		return 0
+	}
+	if n, ok := b.refs[id]; ok {
+		return n
+	}
+	return 1
+}
+
+// referenced returns a copy of this branch with the reference count of the
+// Subscriber with the given ID adjusted by delta.
+func (b *branch) referenced(id string, delta int) *branch {
+	refs := make(map[string]int, len(b.refs)+1)
+	for id, n := range b.refs {
+		refs[id] = n
+	}
+	if n := b.refCount(id) + delta; n > 1 {
+		refs[id] = n
+	} else {
+		delete(refs, id)
+	}
+	if len(refs) == 0 {
+		refs = nil
+	}
+	return &branch{subs: b.subs, iNode: b.iNode, topics: b.topics, refs: refs}
 }
 
 // subscribers returns the Subscribers for this branch.
@@ -235,52 +401,303 @@ func newCtrie(config *Config) *ctrie {
 
 // initCtrie creates a new ctrie with the given root and Config.
 func initCtrie(config *Config, root *iNode, readOnly bool) *ctrie {
-	return &ctrie{root: root, config: config, readOnly: readOnly}
+	return &ctrie{root: root, config: config, readOnly: readOnly, interner: config.Interner}
 }
 
 // Insert adds the Subscriber to the ctrie for the given topic.
-func (c *ctrie) Insert(topic string, sub Subscriber) {
+// ErrQuotaExceeded is returned if it would exceed the Limits, ErrRangeTooLarge
+// if the topic has an oversized ranged wildcard.
+func (c *ctrie) Insert(topic string, sub Subscriber) error {
+	keys := c.config.patternKeys(topic)
+	if err := c.config.checkRanges(keys); err != nil {
+		return err
+	}
+	return c.insert(keys, sub, c.config.subscribedTopic(keys, topic), false)
+}
+
+// InsertWords adds the Subscriber to the ctrie for the given pattern words.
+// ErrQuotaExceeded is returned if it would exceed the Limits, ErrNoWords if
+// there are no words and ErrRangeTooLarge if a word is an oversized ranged
+// wildcard.
+func (c *ctrie) InsertWords(words []string, sub Subscriber) error {
+	if len(words) == 0 {
+		return ErrNoWords
+	}
+	keys := c.config.reduceZeroOrMoreWildcards(c.config.wordKeys(words, false))
+	if err := c.config.checkRanges(keys); err != nil {
+		return err
+	}
+	original := ""
+	if c.config.normalizes() {
+		topic := c.config.join(words)
+		if strings.Join(keys, c.config.Delimiter) != topic {
+			original = topic
+		}
+	}
+	return c.insert(keys, sub, original, false)
+}
+
+// insert adds the Subscriber to the ctrie for the given key path. The topic
+// is the pattern as subscribed if it should be retained. If replace is true,
+// a different Subscriber with the same ID is replaced.
+func (c *ctrie) insert(keys []string, sub Subscriber, topic string, replace bool) error {
+	op := &insertion{sub: sub, topic: topic, replace: replace}
+	c.insertOp(keys, op)
+	return op.err
+}
+
+// insertOp performs the insertion for the given key path, after which it
+// reports the outcome.
+func (c *ctrie) insertOp(keys []string, op *insertion) {
 	c.assertReadWrite()
-	keys := strings.Split(topic, c.config.Delimiter)
-	keys = c.config.reduceZeroOrMoreWildcards(keys)
-	rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
-	root := (*iNode)(atomic.LoadPointer(rootPtr))
-	if !c.iinsert(root, keys, sub, nil, root.gen) {
-		c.Insert(topic, sub)
+	c.count(MetricInserts)
+	if op.err = c.limiter.checkDepth(keys); op.err != nil {
+		return
+	}
+	if interner := c.interner; interner != nil {
+		// Release the words which didn't key new branches.
+		keys = interner.intern(keys)
+		defer func() { interner.release(keys[:len(keys)-op.nodes]...) }()
+	}
+	for {
+		rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
+		root := (*iNode)(atomic.LoadPointer(rootPtr))
+		if c.iinsert(root, keys, op, nil, root.gen) {
+			return
+		}
+		c.count(MetricInsertRetries)
+	}
+}
+
+// insertion is an insert into the ctrie. If a quota is set, capacity is
+// reserved for a new subscription before it is committed and released again
+// if the commit fails, so the quota holds across retries.
+type insertion struct {
+	sub     Subscriber
+	topic   string
+	replace bool
+	quota   quota
+
+	// added indicates if a new subscription was added, nodes the number of
+	// branches created for it, and err is the error of the quota or Limits
+	// if they were exceeded.
+	added bool
+	nodes int
+	err   error
+}
+
+// commit replaces the I-node's main node to make the change, reserving quota
+// for it first. True is returned if the operation completed, including if a
+// quota was exceeded, false if it needs to be retried.
+func (c *ctrie) commit(i *iNode, old, n *mainNode, op *insertion, change insertChange) bool {
+	var quotas []quota
+	if op.quota != nil {
+		quotas = append(quotas, op.quota)
+	}
+	if c.limiter != nil {
+		quotas = append(quotas, c.limiter)
 	}
+	for j, q := range quotas {
+		if err := q.reserve(change); err != nil {
+			for _, q := range quotas[:j] {
+				q.release(change)
+			}
+			op.err = err
+			return true
+		}
+	}
+	if !gcas(i, old, n, c) {
+		for _, q := range quotas {
+			q.release(change)
+		}
+		return false
+	}
+	op.added, op.nodes = true, change.nodes
+	return true
 }
 
 // Lookup returns the Subscribers for the given topic.
 func (c *ctrie) Lookup(topic string) []Subscriber {
-	keys := strings.Split(topic, c.config.Delimiter)
-	rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
-	root := (*iNode)(atomic.LoadPointer(rootPtr))
-	result, ok := c.ilookup(root, keys, nil, false, root.gen)
-	if !ok {
-		return c.Lookup(topic)
+	return c.lookup(c.config.topicKeys(topic))
+}
+
+// LookupWords returns the Subscribers for the given topic words.
+func (c *ctrie) LookupWords(words []string) []Subscriber {
+	if len(words) == 0 {
+		return []Subscriber{}
+	}
+	return c.lookup(c.config.wordKeys(words, true))
+}
+
+// LookupBytes returns the Subscribers for the given topic.
+func (c *ctrie) LookupBytes(topic []byte) []Subscriber {
+	return c.lookup(c.config.bytesKeys(topic))
+}
+
+// lookup returns the Subscribers for the given key path.
+func (c *ctrie) lookup(keys []string) []Subscriber {
+	if c.config.Metrics != nil {
+		return c.measuredLookup(keys)
+	}
+	for {
+		rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
+		root := (*iNode)(atomic.LoadPointer(rootPtr))
+		if result, ok := c.ilookup(root, keys, nil, root.gen, nil); ok {
+			return result
+		}
+	}
+}
+
+// measuredLookup returns the Subscribers for the given key path, reporting
+// the lookup to the Config's Metrics.
+func (c *ctrie) measuredLookup(keys []string) []Subscriber {
+	metrics := c.config.Metrics
+	metrics.Count(MetricLookups, 1)
+	start := time.Now()
+	for {
+		rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
+		root := (*iNode)(atomic.LoadPointer(rootPtr))
+		if result, ok := c.ilookup(root, keys, nil, root.gen, nil); ok {
+			metrics.Observe(MetricLookupLatency, time.Since(start).Seconds())
+			metrics.Observe(MetricLookupResults, float64(len(result)))
+			return result
+		}
+		metrics.Count(MetricLookupRetries, 1)
+	}
+}
+
+// exactBranch returns the branch at the end of the key path, matching each key
+// exactly rather than as a wildcard, or nil if there is none.
+func (c *ctrie) exactBranch(keys []string) *branch {
+	i := c.readRoot()
+	for {
+		main := gcasRead(i, c)
+		if main.cNode == nil {
+			return nil
+		}
+		br := main.cNode.getBranch(keys[0])
+		if br == nil || len(keys) == 1 {
+			return br
+		}
+		if br.iNode == nil {
+			return nil
+		}
+		i, keys = br.iNode, keys[1:]
 	}
-	return result
 }
 
 // Remove will remove the Subscriber from the topic if it is subscribed.
 func (c *ctrie) Remove(topic string, sub Subscriber) {
+	c.remove(c.config.patternKeys(topic), sub)
+}
+
+// RemoveWords will remove the Subscriber from the pattern words if it is
+// subscribed.
+func (c *ctrie) RemoveWords(words []string, sub Subscriber) {
+	if len(words) == 0 {
+		return
+	}
+	c.remove(c.config.reduceZeroOrMoreWildcards(c.config.wordKeys(words, false)), sub)
+}
+
+// remove will remove the Subscriber from the key path if it is subscribed.
+func (c *ctrie) remove(keys []string, sub Subscriber) {
+	c.removeOp(keys, &removal{sub: sub})
+}
+
+// removeOp performs the removal for the given key path, after which it
+// reports the outcome.
+func (c *ctrie) removeOp(keys []string, op *removal) {
 	c.assertReadWrite()
-	keys := strings.Split(topic, c.config.Delimiter)
-	keys = c.config.reduceZeroOrMoreWildcards(keys)
-	rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
-	root := (*iNode)(atomic.LoadPointer(rootPtr))
-	if !c.iremove(root, keys, sub, nil, root.gen) {
-		c.Remove(topic, sub)
+	c.count(MetricRemoves)
+	for {
+		rootPtr := (*unsafe.Pointer)(unsafe.Pointer(&c.root))
+		root := (*iNode)(atomic.LoadPointer(rootPtr))
+		if c.iremove(root, keys, op, nil, root.gen) {
+			return
+		}
+		c.count(MetricRemoveRetries)
+	}
+}
+
+// removal is a removal from the ctrie.
+type removal struct {
+	sub Subscriber
+
+	// removed indicates if the subscription was removed, and lastOnPattern
+	// if it was the last one on its pattern.
+	removed       bool
+	lastOnPattern bool
+}
+
+// removeBranch removes the branch for the key from the root C-node, along
+// with everything below it, in a single CAS. True is returned if there was
+// such a branch.
+func (c *ctrie) removeBranch(key string) bool {
+	c.assertReadWrite()
+	for {
+		root := c.readRoot()
+		main := gcasRead(root, c)
+		cn := main.cNode
+		if cn.getBranch(key) == nil {
+			return false
+		}
+		if cn.gen != root.gen {
+			cn = cn.renewed(root.gen, c)
+		}
+		branches := make(map[string]*branch, len(cn.branches))
+		for k, br := range cn.branches {
+			if k != key {
+				branches[k] = br
+			}
+		}
+		ncn := &cNode{branches: branches, gen: root.gen, ranges: withoutRange(cn.ranges, key)}
+		if gcas(root, main, &mainNode{cNode: ncn}, c) {
+			if c.limiter != nil || c.interner != nil {
+				c.released(key, cn.getBranch(key))
+			}
+			return true
+		}
+	}
+}
+
+// released releases the capacity and interned words used by the detached
+// branch for the key and everything below it.
+func (c *ctrie) released(key string, br *branch) {
+	for _, sub := range br.subs {
+		c.limiter.removed(sub, 0)
+	}
+	c.limiter.pruned(1)
+	c.interner.release(key)
+	if br.iNode == nil {
+		return
+	}
+	if main := gcasRead(br.iNode, c); main.cNode != nil {
+		for key, child := range main.cNode.branches {
+			c.released(key, child)
+		}
 	}
 }
 
-// Snapshot returns a stable, point-in-time snapshot of the ctrie.
+// namespaceKey returns the root ctrie key for a tenant or principal. It is
+// prefixed so that it never collides with a wildcard, which would otherwise
+// match across namespaces.
+func namespaceKey(name string) string {
+	return "\x00" + name
+}
+
+// Snapshot returns a stable, point-in-time snapshot of the ctrie. Its usage of
+// the Limits is counted relative to the ctrie's, which still applies to it. It
+// shares the ctrie's interned words but counts its own references to them.
 func (c *ctrie) Snapshot() *ctrie {
 	for {
 		root := c.readRoot()
 		main := gcasRead(root, c)
 		if c.rdcssRoot(root, main, root.copyToGen(&generation{}, c)) {
-			return initCtrie(c.config, root.copyToGen(&generation{}, c), c.readOnly)
+			snapshot := initCtrie(c.config, root.copyToGen(&generation{}, c), c.readOnly)
+			snapshot.limiter = c.limiter.derived()
+			snapshot.interner = c.interner.staged()
+			return snapshot
 		}
 	}
 }
@@ -300,15 +717,54 @@ func (c *ctrie) ReadOnlySnapshot() *ctrie {
 	}
 }
 
+// maxTransactAttempts is the number of times transact makes its writes
+// before giving up on the trie going unmodified for long enough.
+const maxTransactAttempts = 100
+
+// transact makes the writes of fn to a writable snapshot which then replaces
+// the trie, so lookups see either none or all of them. fn is called again if
+// the trie was modified in the meantime, and ErrContended is returned if it
+// was modified every time. If fn returns an error, none of its writes are
+// made. References to interned words are only taken and released once the
+// writes are made.
+func (c *ctrie) transact(fn func(staged *ctrie) error) error {
+	c.assertReadWrite()
+	for attempt := 0; attempt < maxTransactAttempts; attempt++ {
+		root := c.readRoot()
+		main := gcasRead(root, c)
+
+		// Move the trie to a new generation so writes in progress restart
+		// from its root, which they must then modify before committing.
+		fresh := root.copyToGen(&generation{}, c)
+		if !c.rdcssRoot(root, main, fresh) {
+			continue
+		}
+		staged := initCtrie(c.config, fresh.copyToGen(&generation{}, c), false)
+		staged.limiter = c.limiter.derived()
+		staged.interner = c.interner.staged()
+		if err := fn(staged); err != nil {
+			return err
+		}
+		if c.rdcssRoot(fresh, main, staged.readRoot()) {
+			c.limiter.add(staged.limiter)
+			c.interner.commit(staged.interner)
+			return nil
+		}
+	}
+	return ErrContended
+}
+
 func (c *ctrie) assertReadWrite() {
 	if c.readOnly {
 		panic("Cannot modify read-only snapshot")
 	}
 }
 
-// iinsert attempts to add the Subscriber to the key path. True is returned if
-// the Subscriber was added, false if the operation needs to be retried.
-func (c *ctrie) iinsert(i *iNode, keys []string, sub Subscriber, parent *iNode, startGen *generation) bool {
+// iinsert attempts to perform the insertion at the key path. True is returned
+// if the Subscriber was added or the insertion otherwise completed, false if
+// the operation needs to be retried.
+func (c *ctrie) iinsert(i *iNode, keys []string, op *insertion, parent *iNode, startGen *generation) bool {
+
 	// Linearization point.
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
@@ -323,8 +779,8 @@ func (c *ctrie) iinsert(i *iNode, keys []string, sub Subscriber, parent *iNode,
 			if cn.gen != i.gen {
 				rn = cn.renewed(i.gen, c)
 			}
-			ncn := &mainNode{cNode: rn.inserted(keys, sub, i.gen)}
-			return gcas(i, main, ncn, c)
+			ncn := &mainNode{cNode: rn.inserted(keys, op.sub, op.topic, i.gen, c.config)}
+			return c.commit(i, main, ncn, op, insertChange{sub: op.sub, nodes: len(keys)})
 		} else {
 			// If the relevant key is present in the map, its corresponding
 			// branch is read.
@@ -335,10 +791,10 @@ func (c *ctrie) iinsert(i *iNode, keys []string, sub Subscriber, parent *iNode,
 					// If the branch has an I-node, iinsert is called
 					// recursively.
 					if startGen == br.iNode.gen {
-						return c.iinsert(br.iNode, keys[1:], sub, i, startGen)
+						return c.iinsert(br.iNode, keys[1:], op, i, startGen)
 					}
 					if gcas(i, main, &mainNode{cNode: cn.renewed(startGen, c)}, c) {
-						return c.iinsert(i, keys, sub, parent, startGen)
+						return c.iinsert(i, keys, op, parent, startGen)
 					}
 					return false
 				}
@@ -348,31 +804,45 @@ func (c *ctrie) iinsert(i *iNode, keys []string, sub Subscriber, parent *iNode,
 				if cn.gen != i.gen {
 					rn = cn.renewed(i.gen, c)
 				}
-				nin := &iNode{main: &mainNode{cNode: newCNode(keys[1:], sub, i.gen)}, gen: i.gen}
+				nin := &iNode{main: &mainNode{cNode: newCNode(keys[1:], op.sub, op.topic, i.gen, c.config)}, gen: i.gen}
 				ncn := &mainNode{cNode: rn.updatedBranch(keys[0], nin, br, i.gen)}
+				return c.commit(i, main, ncn, op, insertChange{sub: op.sub, nodes: len(keys) - 1})
+			}
+			existing, ok := br.subs[op.sub.ID()]
+			if ok && (!op.replace || existing == op.sub) {
+				if !c.config.RefCount {
+					// Already subscribed.
+					return true
+				}
+				// Count the reference by copying the C-node and updating the
+				// respective branch. The linearization point is a successful
+				// CAS.
+				ncn := &mainNode{cNode: cn.referenced(keys[0], op.sub.ID(), 1, i.gen)}
 				return gcas(i, main, ncn, c)
 			}
-			if _, ok := br.subs[sub.ID()]; ok {
-				// Already subscribed.
-				return true
+			ncn := &mainNode{cNode: cn.updated(keys[0], op.sub, op.topic, i.gen, c.config)}
+			if ok {
+				// Replace the Subscriber by copying the C-node and updating the
+				// respective branch. The linearization point is a successful
+				// CAS.
+				return gcas(i, main, ncn, c)
 			}
 			// Insert the Subscriber by copying the C-node and updating the
 			// respective branch. The linearization point is a successful CAS.
-			ncn := &mainNode{cNode: cn.updated(keys[0], sub, i.gen)}
-			return gcas(i, main, ncn, c)
+			return c.commit(i, main, ncn, op, insertChange{sub: op.sub, subscribers: len(br.subs)})
 		}
 	case main.tNode != nil:
-		clean(parent)
+		clean(parent, c)
 		return false
 	default:
 		panic("Ctrie is in an invalid state")
 	}
 }
 
-// iremove attempts to remove the Subscriber from the key path. True is
-// returned if the Subscriber was removed (or didn't exist), false if the
-// operation needs to be retried.
-func (c *ctrie) iremove(i *iNode, keys []string, sub Subscriber, parent *iNode, startGen *generation) bool {
+// iremove attempts to perform the removal at the key path. True is returned
+// if the Subscriber was removed (or didn't exist), false if the operation
+// needs to be retried.
+func (c *ctrie) iremove(i *iNode, keys []string, op *removal, parent *iNode, startGen *generation) bool {
 	// Linearization point.
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
@@ -393,26 +863,38 @@ func (c *ctrie) iremove(i *iNode, keys []string, sub Subscriber, parent *iNode,
 					// If the branch has an I-node, iremove is called
 					// recursively.
 					if c.readOnly || startGen == br.iNode.gen {
-						return c.iremove(br.iNode, keys[1:], sub, i, startGen)
+						return c.iremove(br.iNode, keys[1:], op, i, startGen)
 					}
 					if gcas(i, main, &mainNode{cNode: cn.renewed(startGen, c)}, c) {
-						return c.iremove(i, keys, sub, parent, startGen)
+						return c.iremove(i, keys, op, parent, startGen)
 					}
 				}
 				// Otherwise, the subscription doesn't exist.
 				return true
 			}
-			if _, ok := br.subs[sub.ID()]; !ok {
+			if _, ok := br.subs[op.sub.ID()]; !ok {
 				// Not subscribed.
 				return true
 			}
+			if br.refCount(op.sub.ID()) > 1 {
+				// Release a reference by copying the C-node and updating the
+				// respective branch. The linearization point is a successful
+				// CAS.
+				ncn := &mainNode{cNode: cn.referenced(keys[0], op.sub.ID(), -1, i.gen)}
+				return gcas(i, main, ncn, c)
+			}
 			// Remove the Subscriber by copying the C-node without it. A
 			// contraction of the copy is then created. A successful CAS will
 			// substitute the old C-node with the copied C-node, thus removing
 			// the Subscriber from the trie - this is the linearization point.
-			ncn := cn.removed(keys[0], sub, i.gen)
+			ncn := cn.removed(keys[0], op.sub, i.gen)
 			cntr := c.toContracted(ncn, i)
 			if gcas(i, main, cntr, c) {
+				op.removed, op.lastOnPattern = true, len(br.subs) == 1
+				c.limiter.removed(op.sub, len(cn.branches)-len(ncn.branches))
+				if len(ncn.branches) < len(cn.branches) {
+					c.interner.release(keys[0])
+				}
 				if parent != nil {
 					main = gcasRead(i, c)
 					if main.tNode != nil {
@@ -424,7 +906,7 @@ func (c *ctrie) iremove(i *iNode, keys []string, sub Subscriber, parent *iNode,
 			return false
 		}
 	case main.tNode != nil:
-		clean(parent)
+		clean(parent, c)
 		return false
 	default:
 		panic("Ctrie is in an invalid state")
@@ -434,7 +916,9 @@ func (c *ctrie) iremove(i *iNode, keys []string, sub Subscriber, parent *iNode,
 // ilookup attempts to retrieve the Subscribers for the key path. True is
 // returned if the Subscribers were retrieved, false if the operation needs to
 // be retried.
-func (c *ctrie) ilookup(i *iNode, keys []string, parent *iNode, zeroOrMore bool, startGen *generation) ([]Subscriber, bool) {
+func (c *ctrie) ilookup(i *iNode, keys []string, parent *iNode, startGen *generation,
+	trace *explainer) ([]Subscriber, bool) {
+
 	// Linearization point.
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
@@ -444,8 +928,11 @@ func (c *ctrie) ilookup(i *iNode, keys []string, parent *iNode, zeroOrMore bool,
 		// zero-or-more-wildcard branch.
 		exact, singleWC, zomWC := main.cNode.getBranches(keys[0], c.config)
 		subs := map[string]Subscriber{}
+		trace.visit(keys[0], main.cNode)
 		if exact != nil {
-			s, ok := c.bLookup(i, parent, main, exact, keys, false, startGen)
+			trace.enter(ExplainExact, keys[0], keys[0])
+			s, ok := c.bLookup(i, parent, main, exact, keys, startGen, trace)
+			trace.leave()
 			if !ok {
 				return nil, false
 			}
@@ -453,27 +940,8 @@ func (c *ctrie) ilookup(i *iNode, keys []string, parent *iNode, zeroOrMore bool,
 				subs[sub.ID()] = sub
 			}
 		}
-		if singleWC != nil {
-			s, ok := c.bLookup(i, parent, main, singleWC, keys, false, startGen)
-			if !ok {
-				return nil, false
-			}
-			for _, sub := range s {
-				subs[sub.ID()] = sub
-			}
-		}
-		if zomWC != nil {
-			s, ok := c.bLookup(i, parent, main, zomWC, keys, true, startGen)
-			if !ok {
-				return nil, false
-			}
-			for _, sub := range s {
-				subs[sub.ID()] = sub
-			}
-		}
-		if zeroOrMore && len(keys) > 1 && exact == nil && singleWC == nil && zomWC == nil {
-			// Loopback on zero-or-more wildcard.
-			return c.ilookup(i, keys[1:], parent, true, startGen)
+		if !c.wLookup(i, parent, main, singleWC, zomWC, keys, startGen, trace, subs) {
+			return nil, false
 		}
 		s := make([]Subscriber, len(subs))
 		i := 0
@@ -483,88 +951,211 @@ func (c *ctrie) ilookup(i *iNode, keys []string, parent *iNode, zeroOrMore bool,
 		}
 		return s, true
 	case main.tNode != nil:
-		clean(parent)
+		clean(parent, c)
 		return nil, false
 	default:
 		panic("Ctrie is in an invalid state")
 	}
 }
 
+// wLookup adds the Subscribers along the C-node's single-word-wildcard,
+// zero-or-more-wildcard, and ranged-wildcard branches for the key path to
+// subs. True is returned if the Subscribers were retrieved, false if the
+// operation needs to be retried.
+func (c *ctrie) wLookup(i, parent *iNode, main *mainNode, singleWC, zomWC *branch, keys []string,
+	startGen *generation, trace *explainer, subs map[string]Subscriber) bool {
+
+	if singleWC != nil {
+		trace.enter(ExplainSingleWildcard, keys[0], c.config.SingleWildcard)
+		s, ok := c.bLookup(i, parent, main, singleWC, keys, startGen, trace)
+		trace.leave()
+		if !ok {
+			return false
+		}
+		for _, sub := range s {
+			subs[sub.ID()] = sub
+		}
+	}
+	if zomWC != nil {
+		trace.enter(ExplainZeroOrMoreWildcard, keys[0], c.config.ZeroOrMoreWildcard)
+		s, ok := c.zLookup(i, parent, main, zomWC, keys, startGen, trace)
+		trace.leave()
+		if !ok {
+			return false
+		}
+		for _, sub := range s {
+			subs[sub.ID()] = sub
+		}
+	}
+	for _, rb := range main.cNode.getRangeBranches() {
+		trace.enter(ExplainRangeWildcard, keys[0], c.config.formatRange(rb.bounds))
+		s, ok := c.rLookup(i, parent, main, rb, keys, startGen, trace)
+		trace.leave()
+		if !ok {
+			return false
+		}
+		for _, sub := range s {
+			subs[sub.ID()] = sub
+		}
+	}
+	return true
+}
+
 // bLookup attempts to retrieve the Subscribers from the key path along the
 // given branch. True is returned if the Subscribers were retrieved, false if
 // the operation needs to be retried.
 func (c *ctrie) bLookup(i, parent *iNode, main *mainNode, b *branch, keys []string,
-	zeroOrMore bool, startGen *generation) ([]Subscriber, bool) {
+	startGen *generation, trace *explainer) ([]Subscriber, bool) {
 
 	if len(keys) > 1 {
 		// If more than 1 key is present in the path, the tree must be
 		// traversed deeper.
 		if b.iNode == nil {
-			if zeroOrMore {
-				// Loopback on zero-or-more wildcard.
-				return c.bLookup(i, parent, main, b, keys[1:], true, startGen)
-			}
 			// If the branch doesn't point to an I-node, no subscribers
 			// exist.
 			return nil, true
 		}
 		// If the branch has an I-node, ilookup is called recursively.
 		if c.readOnly || startGen == b.iNode.gen {
-			return c.ilookup(b.iNode, keys[1:], i, zeroOrMore, startGen)
+			return c.ilookup(b.iNode, keys[1:], i, startGen, trace)
 		}
 		if gcas(i, main, &mainNode{cNode: main.cNode.renewed(startGen, c)}, c) {
-			return c.ilookup(i, keys, parent, zeroOrMore, startGen)
+			return c.ilookup(i, keys, parent, startGen, trace)
 		}
+		return nil, false
 	}
 
 	// Retrieve the subscribers from the branch.
 	subscribers := b.subscribers()
+	trace.contribute(subscribers)
 
-	// Is there a zero-or-more wildcard following this node? If so, get its
-	// subscribers.
+	// Are there wildcards following this node which match zero words? If
+	// so, get their subscribers.
 	if b.iNode != nil {
 		subscribers = append(subscribers,
-			c.getZeroOrMoreWildcardSubscribers(b.iNode)...)
+			c.getZeroOrMoreWildcardSubscribers(b.iNode, trace)...)
 	}
 
-	// Were we looping on a zero-or-more wildcard? If so, check for the tail
-	// and get its subscribers.
-	if zeroOrMore && b.iNode != nil {
-		subscribers = append(subscribers, c.getSubscribers(b.iNode, keys[0])...)
-	}
+	return subscribers, true
+}
 
+// zLookup attempts to retrieve the Subscribers from the key path along the
+// given zero-or-more-wildcard branch. The wildcard loops back over keys,
+// consuming anywhere from none to all of them before continuing down the
+// branch. True is returned if the Subscribers were retrieved, false if the
+// operation needs to be retried.
+func (c *ctrie) zLookup(i, parent *iNode, main *mainNode, b *branch, keys []string,
+	startGen *generation, trace *explainer) ([]Subscriber, bool) {
+
+	var subscribers []Subscriber
+	for n := 0; n <= len(keys); n++ {
+		if n > 0 && n < len(keys) {
+			// Loopback on zero-or-more wildcard.
+			trace.loopback(keys[n-1])
+		}
+		if n == len(keys) {
+			// The wildcard consumed the remaining keys, so retrieve the
+			// subscribers from the branch.
+			subscribers = append(subscribers, b.subscribers()...)
+			trace.contribute(b.subscribers())
+			if b.iNode != nil {
+				subscribers = append(subscribers,
+					c.getZeroOrMoreWildcardSubscribers(b.iNode, trace)...)
+			}
+			continue
+		}
+		if b.iNode == nil {
+			// If the branch doesn't point to an I-node, no subscribers exist
+			// for the remaining keys.
+			continue
+		}
+		// If the branch has an I-node, ilookup is called recursively with the
+		// keys following the consumed ones.
+		if c.readOnly || startGen == b.iNode.gen {
+			s, ok := c.ilookup(b.iNode, keys[n:], i, startGen, trace)
+			if !ok {
+				return nil, false
+			}
+			subscribers = append(subscribers, s...)
+			continue
+		}
+		if gcas(i, main, &mainNode{cNode: main.cNode.renewed(startGen, c)}, c) {
+			return c.ilookup(i, keys, parent, startGen, trace)
+		}
+		return nil, false
+	}
 	return subscribers, true
 }
 
-// getZeroOrMoreWildcardSubscribers returns the Subscribers on the I-node's
-// C-node's zero-or-more-wildcard branch, if it exists.
-func (c *ctrie) getZeroOrMoreWildcardSubscribers(i *iNode) []Subscriber {
-	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
-	main := (*mainNode)(atomic.LoadPointer(mainPtr))
-	if main.cNode != nil {
-		if br := main.cNode.getBranch(c.config.ZeroOrMoreWildcard); br != nil {
-			return br.subscribers()
+// rLookup attempts to retrieve the Subscribers from the key path along the
+// given ranged-wildcard branch. Like the zero-or-more wildcard, the branch
+// loops back over keys, consuming between its minimum and maximum number of
+// them before continuing down the branch. True is returned if the
+// Subscribers were retrieved, false if the operation needs to be retried.
+func (c *ctrie) rLookup(i, parent *iNode, main *mainNode, rb rangeBranch, keys []string,
+	startGen *generation, trace *explainer) ([]Subscriber, bool) {
+
+	var subscribers []Subscriber
+	for n := rb.bounds.min; n <= rb.bounds.max && n <= len(keys); n++ {
+		if n == len(keys) {
+			// The ranged wildcard consumed the remaining keys, so retrieve the
+			// subscribers from the branch.
+			subscribers = append(subscribers, rb.subscribers()...)
+			trace.contribute(rb.subscribers())
+			if rb.iNode != nil {
+				subscribers = append(subscribers,
+					c.getZeroOrMoreWildcardSubscribers(rb.iNode, trace)...)
+			}
+			continue
+		}
+		if rb.iNode == nil {
+			// If the branch doesn't point to an I-node, no subscribers exist
+			// for the remaining keys.
+			continue
+		}
+		// If the branch has an I-node, ilookup is called recursively with the
+		// keys following the consumed ones.
+		if c.readOnly || startGen == rb.iNode.gen {
+			s, ok := c.ilookup(rb.iNode, keys[n:], i, startGen, trace)
+			if !ok {
+				return nil, false
+			}
+			subscribers = append(subscribers, s...)
+			continue
+		}
+		if gcas(i, main, &mainNode{cNode: main.cNode.renewed(startGen, c)}, c) {
+			return c.ilookup(i, keys, parent, startGen, trace)
 		}
+		return nil, false
 	}
-	return nil
+	return subscribers, true
 }
 
-// getSubscribers returns the Subscribers for the given key on the I-node's
-// C-node, if it exists.
-func (c *ctrie) getSubscribers(i *iNode, key string) []Subscriber {
+// getZeroOrMoreWildcardSubscribers returns the Subscribers on the I-node's
+// C-node's zero-or-more-wildcard branch, if it exists, along with those on any
+// ranged-wildcard branches which match zero words. Wildcards following those
+// branches which match zero words are followed too. The keys are the path to
+// the I-node from the branch the lookup ended on.
+func (c *ctrie) getZeroOrMoreWildcardSubscribers(i *iNode, trace *explainer, keys ...string) []Subscriber {
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
-	subs := []Subscriber{}
-	if main.cNode != nil {
-		exact, singleWC, zomWC := main.cNode.getBranches(key, c.config)
-		if exact != nil {
-			subs = append(subs, exact.subscribers()...)
+	var subs []Subscriber
+	follow := func(br *branch, key string) {
+		path := append(append([]string{}, keys...), key)
+		subs = append(subs, br.subscribers()...)
+		trace.contribute(br.subscribers(), path...)
+		if br.iNode != nil {
+			subs = append(subs, c.getZeroOrMoreWildcardSubscribers(br.iNode, trace, path...)...)
 		}
-		if singleWC != nil {
-			subs = append(subs, singleWC.subscribers()...)
+	}
+	if main.cNode != nil {
+		if br := main.cNode.getBranch(c.config.ZeroOrMoreWildcard); br != nil {
+			follow(br, c.config.ZeroOrMoreWildcard)
 		}
-		if zomWC != nil {
-			subs = append(subs, zomWC.subscribers()...)
+		for _, rb := range main.cNode.getRangeBranches() {
+			if rb.bounds.min == 0 {
+				follow(rb.branch, c.config.formatRange(rb.bounds))
+			}
 		}
 	}
 	return subs
@@ -582,12 +1173,15 @@ func (c *ctrie) toContracted(cn *cNode, parent *iNode) *mainNode {
 
 // clean replaces an I-node's C-node with a copy that has any tombed I-nodes
 // resurrected.
-func clean(i *iNode) {
+func clean(i *iNode, c *ctrie) {
+	c.count(MetricCleans)
 	mainPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 	main := (*mainNode)(atomic.LoadPointer(mainPtr))
 	if main.cNode != nil {
-		atomic.CompareAndSwapPointer(mainPtr,
-			unsafe.Pointer(main), unsafe.Pointer(toCompressed(main.cNode)))
+		ncn := toCompressed(main.cNode)
+		if atomic.CompareAndSwapPointer(mainPtr, unsafe.Pointer(main), unsafe.Pointer(ncn)) {
+			c.pruned(main.cNode, ncn.cNode)
+		}
 	}
 }
 
@@ -596,6 +1190,7 @@ func clean(i *iNode) {
 // longer reachable, some other thread has already completed the contraction.
 // If it is reachable, the C-node below p is replaced with its contraction.
 func cleanParent(parent, i *iNode, c *ctrie, key string, startGen *generation) {
+	c.count(MetricCleanParents)
 	var (
 		mainPtr  = (*unsafe.Pointer)(unsafe.Pointer(&i.main))
 		main     = (*mainNode)(atomic.LoadPointer(mainPtr))
@@ -609,8 +1204,9 @@ func cleanParent(parent, i *iNode, c *ctrie, key string, startGen *generation) {
 			}
 			if main.tNode != nil {
 				ncn := toCompressed(pMain.cNode)
-				if !gcas(parent, pMain, c.toContracted(ncn.cNode, parent), c) &&
-					c.readRoot().gen == startGen {
+				if gcas(parent, pMain, c.toContracted(ncn.cNode, parent), c) {
+					c.pruned(pMain.cNode, ncn.cNode)
+				} else if c.readRoot().gen == startGen {
 					cleanParent(parent, i, c, key, startGen)
 				}
 			}
@@ -618,16 +1214,33 @@ func cleanParent(parent, i *iNode, c *ctrie, key string, startGen *generation) {
 	}
 }
 
+// pruned releases the capacity and interned words used by the branches of
+// the C-node which its compressed copy no longer has.
+func (c *ctrie) pruned(cn, compressed *cNode) {
+	c.limiter.pruned(len(cn.branches) - len(compressed.branches))
+	if c.interner == nil {
+		return
+	}
+	for key := range cn.branches {
+		if _, ok := compressed.branches[key]; !ok {
+			c.interner.release(key)
+		}
+	}
+}
+
 // toCompressed prunes any branches to tombed I-nodes and returns the
 // compressed main node.
 func toCompressed(cn *cNode) *mainNode {
 	branches := make(map[string]*branch, len(cn.branches))
+	ranges := cn.ranges
 	for key, br := range cn.branches {
-		if !prunable(br) {
+		if prunable(br) {
+			ranges = withoutRange(ranges, key)
+		} else {
 			branches[key] = br
 		}
 	}
-	return &mainNode{cNode: &cNode{branches: branches, gen: cn.gen}}
+	return &mainNode{cNode: &cNode{branches: branches, gen: cn.gen, ranges: ranges}}
 }
 
 // prunable indicates if the branch can be pruned. A branch can be pruned if
@@ -657,8 +1270,11 @@ func gcas(in *iNode, old, n *mainNode, ct *ctrie) bool {
 		(*unsafe.Pointer)(unsafe.Pointer(&in.main)),
 		unsafe.Pointer(old), unsafe.Pointer(n)) {
 		gcasComplete(in, n, ct)
-		return atomic.LoadPointer(prevPtr) == nil
+		if atomic.LoadPointer(prevPtr) == nil {
+			return true
+		}
 	}
+	ct.count(MetricGCASFailures)
 	return false
 }
 
@@ -689,8 +1305,8 @@ func gcasComplete(i *iNode, m *mainNode, ctrie *ctrie) *mainNode {
 			// Signals GCAS failure. Swap old value back into I-node.
 			fn := prev.failed
 			if atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&i.main)),
-				unsafe.Pointer(m), unsafe.Pointer(fn.prev)) {
-				return fn.prev
+				unsafe.Pointer(m), unsafe.Pointer(fn)) {
+				return fn
 			}
 			m = (*mainNode)(atomic.LoadPointer(
 				(*unsafe.Pointer)(unsafe.Pointer(&i.main))))
@@ -25,6 +25,35 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func TestInsertPrefix(t *testing.T) {
+	assert := assert.New(t)
+	ctrie := newCtrie(NewAMQPConfig())
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	// Subscribing to a prefix of an existing topic keeps the longer topic.
+	ctrie.Insert("a.b", sub1)
+	ctrie.Insert("a", sub2)
+	assert.Equal([]Subscriber{sub1}, ctrie.Lookup("a.b"))
+	assert.Equal([]Subscriber{sub2}, ctrie.Lookup("a"))
+}
+
+func TestCNodeUpdatedKeepsINode(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	gen := &generation{}
+	in := &iNode{gen: gen}
+	cn := &cNode{branches: map[string]*branch{"a": {subs: map[string]Subscriber{}, iNode: in}}, gen: gen}
+
+	// Adding a Subscriber to a branch keeps the I-node of the longer
+	// patterns below it.
+	updated := cn.updated("a", subscriber("abc"), "", gen, config)
+	assert.True(updated.branches["a"].iNode == in)
+	assert.Equal([]Subscriber{subscriber("abc")}, updated.branches["a"].subscribers())
+	assert.True(cn.branches["a"].iNode == in)
+	assert.Empty(cn.branches["a"].subs)
+}
+
 func TestSnapshot(t *testing.T) {
 	assert := assert.New(t)
 	ctrie := newCtrie(NewAMQPConfig())
@@ -102,3 +131,45 @@ func TestConcurrency(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestSnapshotConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	ctrie := newCtrie(NewAMQPConfig())
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			ctrie.Insert("a."+strconv.Itoa(i)+".b", subscriber(strconv.Itoa(i)))
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			val := ctrie.ReadOnlySnapshot().Lookup("a." + strconv.Itoa(i) + ".b")
+			if len(val) > 0 {
+				assert.Equal(subscriber(strconv.Itoa(i)), val[0])
+			}
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+	for i := 0; i < 1000; i++ {
+		assert.Equal([]Subscriber{subscriber(strconv.Itoa(i))}, ctrie.Lookup("a."+strconv.Itoa(i)+".b"))
+	}
+}
+
+func TestGCASFailureRestoresMainNode(t *testing.T) {
+	assert := assert.New(t)
+	ctrie := newCtrie(NewAMQPConfig())
+	old := &mainNode{cNode: &cNode{branches: map[string]*branch{}}}
+
+	// A GCAS on an I-node of a generation other than the root's fails and
+	// swaps the previous main node back in.
+	in := &iNode{main: old, gen: &generation{}}
+	assert.False(gcas(in, old, &mainNode{cNode: &cNode{branches: map[string]*branch{}}}, ctrie))
+	assert.True(in.main == old)
+	assert.True(gcasRead(in, ctrie) == old)
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind int
+
+const (
+	// ChangeUnsubscribe unsubscribes a Subscriber from a topic.
+	ChangeUnsubscribe ChangeKind = iota
+
+	// ChangeSubscribe subscribes a Subscriber to a topic.
+	ChangeSubscribe
+)
+
+// String returns the name of the ChangeKind.
+func (k ChangeKind) String() string {
+	if k == ChangeSubscribe {
+		return "subscribe"
+	}
+	return "unsubscribe"
+}
+
+// Change is a subscription which differs between two Matchboxes. Group is the
+// shared subscription group the Subscriber is a member of, if any.
+type Change struct {
+	Kind       ChangeKind
+	Topic      string
+	Group      string
+	Subscriber Subscriber
+}
+
+// Diff returns the Changes which converge the subscriptions of a to those of
+// b. Subscriptions are compared by pattern and Subscriber ID, not reference
+// count. The Matchboxes are compared as of read-only snapshots, walking both
+// tries in parallel and skipping the nodes they share, such as those of a
+// writable Snapshot which have not been modified since it was taken.
+// Unsubscribes are ordered before subscribes, so a Subscriber whose pattern
+// was subscribed differently, e.g. before normalization, is unsubscribed from
+// the old one before being subscribed to the new one.
+func Diff(a, b Matchbox) []Change {
+	d := &differ{changes: []Change{}}
+	ra, rb := ReadOnly(a), ReadOnly(b)
+	ma, okA := ra.(*matchbox)
+	mb, okB := rb.(*matchbox)
+	if okA && okB {
+		d.a, d.b = ma.ctrie, mb.ctrie
+		d.iNodes(ma.root, mb.root, nil)
+	} else {
+		d.subscriptions(ra.Subscriptions(), rb.Subscriptions())
+	}
+	sort.Slice(d.changes, func(i, j int) bool {
+		ci, cj := d.changes[i], d.changes[j]
+		if ci.Kind != cj.Kind {
+			return ci.Kind < cj.Kind
+		}
+		if ci.Topic != cj.Topic {
+			return ci.Topic < cj.Topic
+		}
+		if ci.Group != cj.Group {
+			return ci.Group < cj.Group
+		}
+		return ci.Subscriber.ID() < cj.Subscriber.ID()
+	})
+	return d.changes
+}
+
+// differ accumulates the Changes between two read-only snapshots.
+type differ struct {
+	a, b    *ctrie
+	changes []Change
+}
+
+// iNodes compares the I-nodes at the key path.
+func (d *differ) iNodes(a, b *iNode, keys []string) {
+	if a == b {
+		return
+	}
+	ca, cb := d.cNode(d.a, a), d.cNode(d.b, b)
+	if ca == cb {
+		return
+	}
+	var branchesA, branchesB map[string]*branch
+	if ca != nil {
+		branchesA = ca.branches
+	}
+	if cb != nil {
+		branchesB = cb.branches
+	}
+	for key, br := range branchesA {
+		d.branches(br, branchesB[key], append(keys[:len(keys):len(keys)], key))
+	}
+	for key, br := range branchesB {
+		if _, ok := branchesA[key]; !ok {
+			d.branches(nil, br, append(keys[:len(keys):len(keys)], key))
+		}
+	}
+}
+
+// cNode returns the C-node of the I-node in the snapshot, or nil if there is
+// none.
+func (d *differ) cNode(c *ctrie, in *iNode) *cNode {
+	if in == nil {
+		return nil
+	}
+	return gcasRead(in, c).cNode
+}
+
+// branches compares the branches at the key path, either of which may be nil.
+func (d *differ) branches(a, b *branch, keys []string) {
+	if a == b {
+		return
+	}
+	var inA, inB *iNode
+	if a != nil {
+		inA = a.iNode
+		for id, sub := range a.subs {
+			topic := branchTopic(a, id, keys, d.a.config)
+			if b == nil || b.subs[id] == nil || branchTopic(b, id, keys, d.b.config) != topic {
+				d.add(ChangeUnsubscribe, topic, sub)
+			}
+		}
+	}
+	if b != nil {
+		inB = b.iNode
+		for id, sub := range b.subs {
+			topic := branchTopic(b, id, keys, d.b.config)
+			if a == nil || a.subs[id] == nil || branchTopic(a, id, keys, d.a.config) != topic {
+				d.add(ChangeSubscribe, topic, sub)
+			}
+		}
+	}
+	d.iNodes(inA, inB, keys)
+}
+
+// subscriptions compares subscriptions by topic when the Matchboxes are not
+// backed by tries. Groups are not distinguished.
+func (d *differ) subscriptions(a, b map[string][]Subscriber) {
+	for topic, subs := range a {
+		for _, sub := range subs {
+			if !containsID(b[topic], sub.ID()) {
+				d.add(ChangeUnsubscribe, topic, sub)
+			}
+		}
+	}
+	for topic, subs := range b {
+		for _, sub := range subs {
+			if !containsID(a[topic], sub.ID()) {
+				d.add(ChangeSubscribe, topic, sub)
+			}
+		}
+	}
+}
+
+// add records a Change for the Subscriber, which may be a group member.
+func (d *differ) add(kind ChangeKind, topic string, sub Subscriber) {
+	change := Change{Kind: kind, Topic: topic, Subscriber: sub}
+	if member, ok := sub.(*groupMember); ok {
+		change.Group, change.Subscriber = member.group, member.subscriber
+	}
+	d.changes = append(d.changes, change)
+}
+
+// branchTopic returns the pattern the Subscriber with the ID subscribed
+// to the branch at the key path with.
+func branchTopic(br *branch, id string, keys []string, config *Config) string {
+	if topic, ok := br.topics[id]; ok {
+		return topic
+	}
+	return strings.Join(keys, config.Delimiter)
+}
+
+// containsID indicates if one of the Subscribers has the ID.
+func containsID(subs []Subscriber, id string) bool {
+	for _, sub := range subs {
+		if sub.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply makes the Changes atomically, so lookups see either none or all of
+// them. They are made to a writable snapshot which then replaces the trie,
+// retrying if it was modified in the meantime. If a Change would exceed the
+// Config's Limits, ErrQuotaExceeded is returned and none are made, as is
+// ErrContended if the trie was modified during every attempt. References
+// to interned words are only taken and released once the Changes are made.
+func (m *matchbox) Apply(changes []Change) error {
+	var joined, left []*groupMember
+	err := m.transact(func(staged *ctrie) (err error) {
+		joined, left, err = staged.apply(changes)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, member := range joined {
+		m.groups.joined(member)
+	}
+	for _, member := range left {
+		m.groups.left(member)
+	}
+	return nil
+}
+
+// apply makes the Changes to the ctrie one at a time, returning the group
+// members which subscribed and unsubscribed.
+func (c *ctrie) apply(changes []Change) (joined, left []*groupMember, err error) {
+	for _, change := range changes {
+		var (
+			sub    = change.Subscriber
+			member *groupMember
+			keys   = c.config.patternKeys(change.Topic)
+		)
+		if change.Group != "" {
+			member = newGroupMember(change.Group, sub)
+			sub = member
+		}
+		if change.Kind == ChangeUnsubscribe {
+			op := &removal{sub: sub}
+			c.removeOp(keys, op)
+			if member != nil && op.removed {
+				left = append(left, member)
+			}
+			continue
+		}
+		if err := c.config.checkRanges(keys); err != nil {
+			return nil, nil, err
+		}
+		op := &insertion{sub: sub, topic: c.config.subscribedTopic(keys, change.Topic)}
+		if c.insertOp(keys, op); op.err != nil {
+			return nil, nil, op.err
+		}
+		if member != nil && op.added {
+			joined = append(joined, member)
+		}
+	}
+	return joined, left, nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	a := New(NewAMQPConfig()).(*matchbox)
+	a.Subscribe("a.b", sub1)
+	a.Subscribe("a.b", sub2)
+	a.Subscribe("a.*.c", sub1)
+	a.Subscribe("d", sub1)
+	a.SubscribeGroup("workers", "e.#", sub1)
+	b := New(NewAMQPConfig()).(*matchbox)
+	b.Subscribe("a.b", sub2)
+	b.Subscribe("a.*.c", sub1)
+	b.Subscribe("a.*.c", sub2)
+	b.Subscribe("f", sub1)
+	b.SubscribeGroup("workers", "e.#", sub2)
+
+	assert.Equal([]Change{}, Diff(a, a))
+	changes := Diff(a, b)
+	assert.Equal([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.b", Subscriber: sub1},
+		{Kind: ChangeUnsubscribe, Topic: "d", Subscriber: sub1},
+		{Kind: ChangeUnsubscribe, Topic: "e.#", Group: "workers", Subscriber: sub1},
+		{Kind: ChangeSubscribe, Topic: "a.*.c", Subscriber: sub2},
+		{Kind: ChangeSubscribe, Topic: "e.#", Group: "workers", Subscriber: sub2},
+		{Kind: ChangeSubscribe, Topic: "f", Subscriber: sub1},
+	}, changes)
+	assert.Equal("unsubscribe", changes[0].Kind.String())
+
+	assert.Nil(a.Apply(changes))
+	assert.Equal([]Change{}, Diff(a, b))
+	assert.Equal([]Subscriber{sub2}, a.SubscribersForDelivery("e.x"))
+	assert.Len(a.Subscribers("d"), 0)
+}
+
+func TestDiffSharedStructure(t *testing.T) {
+	assert := assert.New(t)
+	blue := New(NewAMQPConfig())
+	for i := 0; i < 100; i++ {
+		blue.Subscribe("a."+strconv.Itoa(i)+".b", subscriber(strconv.Itoa(i)))
+	}
+	green := &matchbox{ctrie: blue.(*matchbox).Snapshot()}
+	green.Unsubscribe("a.5.b", subscriber("5"))
+	green.Subscribe("a.5.c", subscriber("5"))
+
+	assert.Equal([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.5.b", Subscriber: subscriber("5")},
+		{Kind: ChangeSubscribe, Topic: "a.5.c", Subscriber: subscriber("5")},
+	}, Diff(blue, green))
+	assert.Equal([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.5.c", Subscriber: subscriber("5")},
+		{Kind: ChangeSubscribe, Topic: "a.5.b", Subscriber: subscriber("5")},
+	}, Diff(green, blue))
+}
+
+func TestDiffNormalizedTopics(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.FoldCase = true
+	a := New(config).(*matchbox)
+	a.Subscribe("A.b", subscriber("abc"))
+	b := New(config)
+	b.Subscribe("a.B", subscriber("abc"))
+
+	changes := Diff(a, b)
+	assert.Equal([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "A.b", Subscriber: subscriber("abc")},
+		{Kind: ChangeSubscribe, Topic: "a.B", Subscriber: subscriber("abc")},
+	}, changes)
+	assert.Nil(a.Apply(changes))
+	assert.Equal(map[string][]Subscriber{"a.B": {subscriber("abc")}}, a.Subscriptions())
+}
+
+// opaque hides the trie backing a Matchbox.
+type opaque struct {
+	Matchbox
+}
+
+func (o opaque) ReadOnly() Matchbox {
+	return opaque{ReadOnly(o.Matchbox)}
+}
+
+func TestDiffOpaque(t *testing.T) {
+	assert := assert.New(t)
+	a := New(NewAMQPConfig())
+	a.Subscribe("a.*", subscriber("abc"))
+	b := New(NewAMQPConfig())
+	b.Subscribe("a.*", subscriber("def"))
+
+	assert.Equal([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.*", Subscriber: subscriber("abc")},
+		{Kind: ChangeSubscribe, Topic: "a.*", Subscriber: subscriber("def")},
+	}, Diff(opaque{a}, b))
+}
+
+func TestApplyLimits(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 2}
+	mb := New(config).(*matchbox)
+	mb.Subscribe("a", subscriber("abc"))
+
+	err := mb.Apply([]Change{
+		{Kind: ChangeSubscribe, Topic: "b", Subscriber: subscriber("abc")},
+		{Kind: ChangeSubscribe, Topic: "c", Subscriber: subscriber("abc")},
+	})
+	assert.Equal(ErrQuotaExceeded, err)
+	assert.Equal([]string{"a"}, mb.Topics())
+
+	assert.Nil(mb.Apply([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a", Subscriber: subscriber("abc")},
+		{Kind: ChangeSubscribe, Topic: "b", Subscriber: subscriber("abc")},
+		{Kind: ChangeSubscribe, Topic: "c", Subscriber: subscriber("abc")},
+	}))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("d", subscriber("abc")))
+	mb.Unsubscribe("b", subscriber("abc"))
+	assert.Nil(mb.TrySubscribe("d", subscriber("abc")))
+
+	assert.Panics(func() { mb.ReadOnly().(Applier).Apply(nil) })
+}
+
+func TestApplyContended(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	attempts := 0
+	err := mb.transact(func(staged *ctrie) error {
+		// Every attempt is spoiled by another write.
+		attempts++
+		mb.Subscribe("c."+strconv.Itoa(attempts), subscriber("def"))
+		return staged.insert([]string{"a"}, subscriber("abc"), "", false)
+	})
+	assert.Equal(ErrContended, err)
+	assert.Equal(maxTransactAttempts, attempts)
+	assert.Equal([]Subscriber{}, mb.Subscribers("a"))
+	assert.Len(mb.Subscriptions(), maxTransactAttempts)
+}
+
+func TestApplyConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	changes := []Change{
+		{Kind: ChangeSubscribe, Topic: "a.*", Subscriber: subscriber("abc")},
+		{Kind: ChangeSubscribe, Topic: "b.#", Subscriber: subscriber("abc")},
+	}
+	undo := []Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.*", Subscriber: subscriber("abc")},
+		{Kind: ChangeUnsubscribe, Topic: "b.#", Subscriber: subscriber("abc")},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			mb.Subscribe("c."+strconv.Itoa(i), subscriber("def"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			assert.Nil(mb.Apply(changes))
+			assert.Nil(mb.Apply(undo))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			// Both changes are visible or neither is.
+			a, b := len(mb.Subscribers("a.x")), len(mb.Subscribers("b.x"))
+			if a != b {
+				assert.Equal(len(mb.Subscribers("a.x")), len(mb.Subscribers("b.x")))
+			}
+		}
+	}()
+	wg.Wait()
+
+	assert.Len(mb.Subscriptions(), 1000)
+	for i := 0; i < 1000; i++ {
+		assert.Len(mb.Subscribers("c."+strconv.Itoa(i)), 1)
+	}
+}
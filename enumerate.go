@@ -0,0 +1,180 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import "sort"
+
+// Subscription is the Subscribers to a pattern as it was subscribed.
+// Subscribers are those subscribed outside of shared subscription groups, and
+// Groups the members of each group subscribed to it, if any. Both are sorted
+// by ID.
+type Subscription struct {
+	Pattern     string
+	Subscribers []Subscriber
+	Groups      map[string][]Subscriber
+}
+
+// add adds the Subscriber, which may be a group member, to the Subscription.
+func (s *Subscription) add(sub Subscriber) {
+	member, ok := sub.(*groupMember)
+	if !ok {
+		s.Subscribers = append(s.Subscribers, sub)
+		return
+	}
+	if s.Groups == nil {
+		s.Groups = map[string][]Subscriber{}
+	}
+	s.Groups[member.group] = append(s.Groups[member.group], member.subscriber)
+}
+
+// Subscription returns the Subscribers to the pattern as it was subscribed,
+// looked up from a read-only snapshot by walking the branch for the pattern
+// alone.
+func (m *matchbox) Subscription(pattern string) Subscription {
+	s := Subscription{Pattern: pattern, Subscribers: []Subscriber{}}
+	keys := m.config.patternKeys(pattern)
+	br := m.ReadOnlySnapshot().exactBranch(keys)
+	if br == nil {
+		return s
+	}
+	for _, sub := range sortedSubscribers(br) {
+		if branchTopic(br, sub.ID(), keys, m.config) == pattern {
+			s.add(sub)
+		}
+	}
+	return s
+}
+
+// Enumerate calls fn with the Subscription to each pattern after the cursor,
+// in order, until it returns false. Patterns are ordered by their words, and
+// then as they were subscribed. An empty cursor starts from the first
+// pattern, and the last pattern enumerated resumes after it. Subscriptions
+// are enumerated from a read-only snapshot, walking only the branches after
+// the cursor.
+func (m *matchbox) Enumerate(after string, fn func(Subscription) bool) {
+	var cursor []string
+	if after != "" {
+		cursor = m.config.patternKeys(after)
+	}
+	e := &enumerator{config: m.config, after: after, fn: fn}
+	e.cNode(m.ReadOnlySnapshot().root.main.cNode, nil, cursor)
+}
+
+// enumerator walks a read-only snapshot in order for Enumerate.
+type enumerator struct {
+	config *Config
+	after  string
+	fn     func(Subscription) bool
+}
+
+// cNode enumerates the branches of the C-node at the key path in order,
+// skipping those before the rest of the cursor. It returns false once
+// enumeration stops.
+func (e *enumerator) cNode(cn *cNode, keys, cursor []string) bool {
+	if cn == nil {
+		return true
+	}
+	sorted := make([]string, 0, len(cn.branches))
+	for key := range cn.branches {
+		if len(cursor) == 0 || key >= cursor[0] {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		br, path := cn.branches[key], append(keys[:len(keys):len(keys)], key)
+		var rest []string
+		if len(cursor) > 1 && key == cursor[0] {
+			// The branch's own patterns are before the cursor.
+			rest = cursor[1:]
+		} else if !e.branch(br, path, len(cursor) == 1 && key == cursor[0]) {
+			return false
+		}
+		if br.iNode != nil && !e.cNode(br.iNode.main.cNode, path, rest) {
+			return false
+		}
+	}
+	return true
+}
+
+// branch enumerates the patterns subscribed to the branch at the key path in
+// order, only those after the cursor's pattern if it ends on the branch.
+func (e *enumerator) branch(br *branch, keys []string, atCursor bool) bool {
+	if len(br.subs) == 0 {
+		return true
+	}
+	patterns := map[string]*Subscription{}
+	for _, sub := range sortedSubscribers(br) {
+		pattern := branchTopic(br, sub.ID(), keys, e.config)
+		if atCursor && pattern <= e.after {
+			continue
+		}
+		s, ok := patterns[pattern]
+		if !ok {
+			s = &Subscription{Pattern: pattern, Subscribers: []Subscriber{}}
+			patterns[pattern] = s
+		}
+		s.add(sub)
+	}
+	sorted := make([]string, 0, len(patterns))
+	for pattern := range patterns {
+		sorted = append(sorted, pattern)
+	}
+	sort.Strings(sorted)
+	for _, pattern := range sorted {
+		if !e.fn(*patterns[pattern]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedSubscribers returns the branch's Subscribers sorted by ID.
+func sortedSubscribers(br *branch) []Subscriber {
+	subs := make([]Subscriber, 0, len(br.subs))
+	for _, sub := range br.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID() < subs[j].ID() })
+	return subs
+}
+
+// Enumerate calls fn with the Subscription to each pattern of the Matchbox
+// after the cursor, in order, until it returns false. If the Matchbox isn't an
+// Enumerator, its patterns are sorted from its Subscriptions, and group
+// members aren't told apart from other Subscribers.
+func Enumerate(mb Matchbox, after string, fn func(Subscription) bool) {
+	if e, ok := mb.(Enumerator); ok {
+		e.Enumerate(after, fn)
+		return
+	}
+	subscriptions := mb.Subscriptions()
+	patterns := make([]string, 0, len(subscriptions))
+	for pattern := range subscriptions {
+		if after == "" || pattern > after {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		subs := append([]Subscriber(nil), subscriptions[pattern]...)
+		sort.Slice(subs, func(i, j int) bool { return subs[i].ID() < subs[j].ID() })
+		if !fn(Subscription{Pattern: pattern, Subscribers: subs}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// enumerated returns the patterns enumerated after the cursor, at most limit
+// of them.
+func enumerated(e Enumerator, after string, limit int) []string {
+	patterns := []string{}
+	e.Enumerate(after, func(s Subscription) bool {
+		patterns = append(patterns, s.Pattern)
+		return len(patterns) < limit
+	})
+	return patterns
+}
+
+func TestEnumerate(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.FoldCase = true
+	mb := New(config)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	mb.Subscribe("a.b", sub1)
+	mb.Subscribe("A.b", sub2)
+	mb.Subscribe("a.b", subscriber("ghi"))
+	mb.Subscribe("a", sub1)
+	mb.Subscribe("a.*.c", sub1)
+	mb.Subscribe("#", sub1)
+	mb.Subscribe("b", sub2)
+	mb.(GroupMatchbox).SubscribeGroup("g", "c", sub1)
+	mb.(GroupMatchbox).SubscribeGroup("g", "a", sub2)
+	mb.(GroupMatchbox).SubscribeGroup("h", "a", sub1)
+	e := mb.(Enumerator)
+
+	all := []string{"#", "a", "a.*.c", "A.b", "a.b", "b", "c"}
+	assert.Equal(all, enumerated(e, "", 100))
+	for i, pattern := range all {
+		assert.Equal(all[i+1:], enumerated(e, pattern, 100))
+	}
+	assert.Equal([]string{"a", "a.*.c"}, enumerated(e, "#", 2))
+	// A cursor needn't be subscribed.
+	assert.Equal([]string{"A.b", "a.b", "b", "c"}, enumerated(e, "a.a", 100))
+	assert.Equal([]string{"b", "c"}, enumerated(e, "a.b.c", 100))
+
+	var subs []Subscriber
+	e.Enumerate("A.b", func(s Subscription) bool {
+		subs = s.Subscribers
+		return false
+	})
+	assert.Equal([]Subscriber{sub1, subscriber("ghi")}, subs)
+
+	assert.Equal(Subscription{Pattern: "a.b", Subscribers: []Subscriber{sub1, subscriber("ghi")}}, e.Subscription("a.b"))
+	assert.Equal(Subscription{Pattern: "A.b", Subscribers: []Subscriber{sub2}}, e.Subscription("A.b"))
+	assert.Equal(Subscription{Pattern: "c", Subscribers: []Subscriber{}, Groups: map[string][]Subscriber{"g": {sub1}}},
+		e.Subscription("c"))
+	assert.Equal(Subscription{Pattern: "a", Subscribers: []Subscriber{sub1},
+		Groups: map[string][]Subscriber{"g": {sub2}, "h": {sub1}}}, e.Subscription("a"))
+	assert.Equal(Subscription{Pattern: "a.b.c", Subscribers: []Subscriber{}}, e.Subscription("a.b.c"))
+	assert.Equal(Subscription{Pattern: "a.B", Subscribers: []Subscriber{}}, e.Subscription("a.B"))
+}
+
+func TestEnumerateFallback(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig())
+	mb.Subscribe("b", subscriber("def"))
+	mb.Subscribe("b", subscriber("abc"))
+	mb.Subscribe("a.*", subscriber("abc"))
+	mb.Subscribe("c", subscriber("abc"))
+
+	subscriptions := []Subscription{}
+	Enumerate(opaque{mb}, "a.*", func(s Subscription) bool {
+		subscriptions = append(subscriptions, s)
+		return len(subscriptions) < 1
+	})
+	assert.Equal([]Subscription{{Pattern: "b", Subscribers: []Subscriber{subscriber("abc"), subscriber("def")}}},
+		subscriptions)
+}
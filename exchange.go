@@ -0,0 +1,293 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrExchangeClosed is returned when binding to or publishing on a closed
+	// Exchange.
+	ErrExchangeClosed = errors.New("exchange closed")
+
+	// ErrInvalidConsumerConfig is returned when binding with a ConsumerConfig
+	// which has a negative buffer size or an unknown overflow policy.
+	ErrInvalidConsumerConfig = errors.New("invalid consumer config")
+)
+
+// exchanges counts the Exchanges created, numbering the prefix of their
+// Consumers' IDs.
+var exchanges uint64
+
+// OverflowPolicy determines what happens when a message is published to a
+// Consumer whose buffer is full.
+type OverflowPolicy int
+
+const (
+	// Block waits for room in the buffer until the publishing context is done.
+	Block OverflowPolicy = iota
+
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest
+
+	// DropNewest discards the published message.
+	DropNewest
+
+	// Disconnect discards the published message and closes the Consumer.
+	Disconnect
+)
+
+// Message is a payload published to a topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// ConsumerConfig contains configuration parameters for a Consumer.
+type ConsumerConfig struct {
+	// BufferSize is the number of messages buffered for the Consumer before
+	// its Overflow policy applies.
+	BufferSize int
+
+	// Overflow determines what happens when a message is published to the
+	// Consumer while its buffer is full.
+	Overflow OverflowPolicy
+}
+
+// Exchange is an in-process publish/subscribe exchange which routes published
+// messages to the Consumers bound to matching patterns.
+type Exchange struct {
+	mb             Matchbox
+	consumerConfig ConsumerConfig
+	idPrefix       string
+	nextID         uint64
+	mu             sync.Mutex
+	consumers      map[*Consumer]struct{}
+	closed         bool
+}
+
+// NewExchange creates a new Exchange with the given Config. Consumers created
+// with Bind use the given ConsumerConfig.
+func NewExchange(config *Config, consumerConfig ConsumerConfig) *Exchange {
+	return &Exchange{
+		mb:             New(config),
+		consumerConfig: consumerConfig,
+		idPrefix:       "exchange-" + strconv.FormatUint(atomic.AddUint64(&exchanges, 1), 10) + "/",
+		consumers:      map[*Consumer]struct{}{},
+	}
+}
+
+// Matchbox returns the Matchbox which routes the Exchange's messages.
+func (e *Exchange) Matchbox() Matchbox {
+	return e.mb
+}
+
+// Bind returns a new Consumer which receives the messages published to topics
+// matching the pattern.
+func (e *Exchange) Bind(pattern string) (*Consumer, error) {
+	return e.BindConfig(pattern, e.consumerConfig)
+}
+
+// BindConfig returns a new Consumer with the given ConsumerConfig which
+// receives the messages published to topics matching the pattern.
+func (e *Exchange) BindConfig(pattern string, config ConsumerConfig) (*Consumer, error) {
+	if config.BufferSize < 0 || config.Overflow < Block || config.Overflow > Disconnect {
+		return nil, ErrInvalidConsumerConfig
+	}
+	c := &Consumer{
+		id:       e.idPrefix + strconv.FormatUint(atomic.AddUint64(&e.nextID, 1), 10),
+		pattern:  pattern,
+		exchange: e,
+		config:   config,
+		messages: make(chan Message, config.BufferSize),
+		done:     make(chan struct{}),
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrExchangeClosed
+	}
+	if err := TrySubscribe(e.mb, pattern, c); err != nil {
+		return nil, err
+	}
+	e.consumers[c] = struct{}{}
+	return c, nil
+}
+
+// Publish delivers the payload to the Consumers bound to patterns matching the
+// topic. Subscribers of the Exchange's Matchbox which are not Consumers are
+// skipped. ErrExchangeClosed is returned if the Exchange is closed. Otherwise
+// the payload is delivered to every Consumer and the errors of those it could
+// not be delivered to, because the context is done while waiting on a
+// Consumer with the Block overflow policy, are returned joined.
+func (e *Exchange) Publish(ctx context.Context, topic string, payload []byte) error {
+	e.mu.Lock()
+	closed := e.closed
+	e.mu.Unlock()
+	if closed {
+		return ErrExchangeClosed
+	}
+	msg := Message{Topic: topic, Payload: payload}
+	var errs []error
+	for _, sub := range e.mb.Subscribers(topic) {
+		c, ok := sub.(*Consumer)
+		if !ok {
+			continue
+		}
+		if err := c.deliver(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the Exchange and all of its Consumers.
+func (e *Exchange) Close() {
+	e.mu.Lock()
+	e.closed = true
+	consumers := make([]*Consumer, 0, len(e.consumers))
+	for c := range e.consumers {
+		consumers = append(consumers, c)
+	}
+	e.mu.Unlock()
+	for _, c := range consumers {
+		c.Close()
+	}
+}
+
+// Consumer receives the messages published to topics matching the pattern it
+// is bound to. It is a Subscriber of the Exchange's Matchbox.
+type Consumer struct {
+	id       string
+	pattern  string
+	exchange *Exchange
+	config   ConsumerConfig
+	messages chan Message
+	done     chan struct{}
+	once     sync.Once
+	dropped  uint64
+
+	// mu guards closing the messages channel against in-flight deliveries.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// ID returns a string which uniquely identifies the Consumer. It is prefixed
+// with the Exchange's own prefix, so it doesn't collide with the IDs of other
+// Exchanges' Consumers or, unless they take the same form, of other
+// Subscribers of the Exchange's Matchbox.
+func (c *Consumer) ID() string {
+	return c.id
+}
+
+// Pattern returns the pattern the Consumer is bound to.
+func (c *Consumer) Pattern() string {
+	return c.pattern
+}
+
+// Messages returns the channel on which messages are received. It is closed
+// when the Consumer is closed.
+func (c *Consumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Done returns a channel which is closed when the Consumer is closed, either
+// explicitly or by the Disconnect overflow policy.
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// Dropped returns the number of messages discarded by the overflow policy.
+func (c *Consumer) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Close unbinds the Consumer and closes its messages channel. Messages already
+// buffered can still be received.
+func (c *Consumer) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.exchange.mb.Unsubscribe(c.pattern, c)
+		c.exchange.mu.Lock()
+		delete(c.exchange.consumers, c)
+		c.exchange.mu.Unlock()
+		c.mu.Lock()
+		c.closed = true
+		close(c.messages)
+		c.mu.Unlock()
+	})
+}
+
+// deliver sends the message to the Consumer, applying its overflow policy if
+// the buffer is full. An error is returned if the context is done while
+// blocking.
+func (c *Consumer) deliver(ctx context.Context, msg Message) error {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return nil
+	}
+	select {
+	case c.messages <- msg:
+		c.mu.RUnlock()
+		return nil
+	default:
+	}
+	disconnect := false
+	switch c.config.Overflow {
+	case Block:
+		select {
+		case c.messages <- msg:
+		case <-c.done:
+		case <-ctx.Done():
+			c.mu.RUnlock()
+			return ctx.Err()
+		}
+	case DropOldest:
+		if cap(c.messages) == 0 {
+			atomic.AddUint64(&c.dropped, 1)
+			break
+		}
+		for sent := false; !sent; {
+			select {
+			case <-c.messages:
+				atomic.AddUint64(&c.dropped, 1)
+			default:
+			}
+			select {
+			case c.messages <- msg:
+				sent = true
+			default:
+			}
+		}
+	case DropNewest:
+		atomic.AddUint64(&c.dropped, 1)
+	case Disconnect:
+		atomic.AddUint64(&c.dropped, 1)
+		disconnect = true
+	}
+	c.mu.RUnlock()
+	if disconnect {
+		c.Close()
+	}
+	return nil
+}
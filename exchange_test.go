@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// drain returns the messages buffered on the Consumer.
+func drain(c *Consumer) []string {
+	payloads := []string{}
+	for {
+		select {
+		case msg, ok := <-c.Messages():
+			if !ok {
+				return payloads
+			}
+			payloads = append(payloads, string(msg.Payload))
+		default:
+			return payloads
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	ex := NewExchange(NewAMQPConfig(), ConsumerConfig{BufferSize: 10})
+	stocks, err := ex.Bind("price.stock.*")
+	assert.Nil(err)
+	all, err := ex.Bind("price.#")
+	assert.Nil(err)
+	assert.NotEqual(stocks.ID(), all.ID())
+	assert.Equal("price.#", all.Pattern())
+
+	assert.Nil(ex.Publish(ctx, "price.stock.msft", []byte("1")))
+	assert.Nil(ex.Publish(ctx, "price.forex.eur", []byte("2")))
+	assert.Nil(ex.Publish(ctx, "volume.stock.msft", []byte("3")))
+	msg := <-stocks.Messages()
+	assert.Equal(Message{Topic: "price.stock.msft", Payload: []byte("1")}, msg)
+	assert.Equal([]string{}, drain(stocks))
+	assert.Equal([]string{"1", "2"}, drain(all))
+
+	stocks.Close()
+	stocks.Close()
+	_, ok := <-stocks.Messages()
+	assert.False(ok)
+	assert.Nil(ex.Publish(ctx, "price.stock.msft", []byte("4")))
+	assert.Equal([]string{"4"}, drain(all))
+	assert.Equal([]string{"price.#"}, subscribedTopics(ex.Matchbox().Subscriptions()))
+
+	ex.Close()
+	<-all.Done()
+	assert.Equal(ErrExchangeClosed, ex.Publish(ctx, "price.stock.msft", nil))
+	_, err = ex.Bind("price.#")
+	assert.Equal(ErrExchangeClosed, err)
+
+	_, err = NewExchange(NewAMQPConfig(), ConsumerConfig{BufferSize: -1}).Bind("a")
+	assert.Equal(ErrInvalidConsumerConfig, err)
+	_, err = NewExchange(NewAMQPConfig(), ConsumerConfig{Overflow: Disconnect + 1}).Bind("a")
+	assert.Equal(ErrInvalidConsumerConfig, err)
+}
+
+func subscribedTopics(subscriptions map[string][]Subscriber) []string {
+	topics := []string{}
+	for topic := range subscriptions {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func TestExchangeOverflow(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	ex := NewExchange(NewAMQPConfig(), ConsumerConfig{})
+	oldest, _ := ex.BindConfig("a", ConsumerConfig{BufferSize: 2, Overflow: DropOldest})
+	newest, _ := ex.BindConfig("a", ConsumerConfig{BufferSize: 2, Overflow: DropNewest})
+	disconnect, _ := ex.BindConfig("a", ConsumerConfig{BufferSize: 2, Overflow: Disconnect})
+	unbuffered, _ := ex.BindConfig("a", ConsumerConfig{Overflow: DropOldest})
+
+	for i := 1; i <= 4; i++ {
+		assert.Nil(ex.Publish(ctx, "a", []byte(strconv.Itoa(i))))
+	}
+	assert.Equal([]string{"3", "4"}, drain(oldest))
+	assert.Equal(uint64(2), oldest.Dropped())
+	assert.Equal([]string{"1", "2"}, drain(newest))
+	assert.Equal(uint64(2), newest.Dropped())
+	<-disconnect.Done()
+	assert.Equal([]string{"1", "2"}, drain(disconnect))
+	assert.Equal(uint64(1), disconnect.Dropped())
+	assert.Equal([]string{}, drain(unbuffered))
+	assert.Equal(uint64(4), unbuffered.Dropped())
+	assert.Len(ex.Matchbox().Subscribers("a"), 3)
+}
+
+func TestExchangeBlock(t *testing.T) {
+	assert := assert.New(t)
+	ex := NewExchange(NewAMQPConfig(), ConsumerConfig{BufferSize: 1, Overflow: Block})
+	c, _ := ex.Bind("a")
+	assert.Nil(ex.Publish(context.Background(), "a", []byte("1")))
+
+	// The publisher gives up when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(ex.Publish(ctx, "a", []byte("2")), context.DeadlineExceeded)
+
+	// The publisher resumes once there is room.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		assert.Nil(ex.Publish(context.Background(), "a", []byte("3")))
+		wg.Done()
+	}()
+	assert.Equal("1", string((<-c.Messages()).Payload))
+	wg.Wait()
+	assert.Equal([]string{"3"}, drain(c))
+
+	// Closing the Consumer releases a blocked publisher.
+	assert.Nil(ex.Publish(context.Background(), "a", []byte("4")))
+	wg.Add(1)
+	go func() {
+		assert.Nil(ex.Publish(context.Background(), "a", []byte("5")))
+		wg.Done()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	wg.Wait()
+	assert.Equal([]string{"4"}, drain(c))
+}
+
+func TestExchangePublishAll(t *testing.T) {
+	assert := assert.New(t)
+	ex := NewExchange(NewAMQPConfig(), ConsumerConfig{BufferSize: 1, Overflow: Block})
+	full, _ := ex.Bind("a")
+	assert.Nil(ex.Publish(context.Background(), "a", []byte("1")))
+	c, _ := ex.Bind("a")
+
+	// Subscribers other than Consumers are skipped, and don't collide with
+	// them even if they are numbered alike.
+	ex.Matchbox().Subscribe("a", subscriber("abc"))
+	ex.Matchbox().Subscribe("a", subscriber("2"))
+	assert.Len(ex.Matchbox().Subscribers("a"), 4)
+	other, _ := NewExchange(NewAMQPConfig(), ConsumerConfig{}).Bind("a")
+	assert.NotEqual(c.ID(), other.ID())
+
+	// A Consumer which can't be delivered to doesn't stop delivery to the
+	// others.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(ex.Publish(ctx, "a", []byte("2")), context.DeadlineExceeded)
+	assert.Equal([]string{"1"}, drain(full))
+	assert.Equal([]string{"2"}, drain(c))
+}
+
+func TestExchangeConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	ex := NewExchange(NewAMQPConfig(), ConsumerConfig{BufferSize: 1, Overflow: DropOldest})
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			c, err := ex.Bind("a.*")
+			assert.Nil(err)
+			c.Close()
+		}
+		wg.Done()
+	}()
+
+	for j := 0; j < 2; j++ {
+		go func() {
+			for i := 0; i < 1000; i++ {
+				assert.Nil(ex.Publish(context.Background(), "a."+strconv.Itoa(i), nil))
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+	ex.Close()
+}
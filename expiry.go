@@ -0,0 +1,377 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// systemClock is a Clock which tells the system time.
+type systemClock struct{}
+
+// Now returns the current system time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ExpiryConfig contains configuration parameters for an Expiring Matchbox.
+type ExpiryConfig struct {
+	// Interval is how often expired subscriptions are reaped in the
+	// background. If zero, no background reaper is started and Reap must be
+	// called to remove expired subscriptions.
+	Interval time.Duration
+
+	// Clock tells the time leases are measured against. Defaults to the
+	// system clock.
+	Clock Clock
+
+	// OnExpire, if set, is called for each subscription removed because its
+	// lease expired.
+	OnExpire func(topic string, subscriber Subscriber)
+}
+
+// leaseKey identifies a leased subscription by its normalized pattern, its
+// group if it is a member of a shared subscription group, and its Subscriber's
+// ID.
+type leaseKey struct {
+	pattern string
+	group   string
+	id      string
+}
+
+// lease tracks when a leased subscription expires.
+type lease struct {
+	topic      string
+	subscriber Subscriber
+	ttl        time.Duration
+	expires    time.Time
+}
+
+// configured is implemented by Matchboxes which expose their Config.
+type configured interface {
+	configuration() *Config
+}
+
+// configuration returns the Matchbox's Config.
+func (m *matchbox) configuration() *Config {
+	return m.config
+}
+
+// Expiring is a Matchbox whose subscriptions can be leased for a TTL, after
+// which they are unsubscribed unless renewed. Leases are kept for patterns as
+// the wrapped Matchbox normalizes them, so a lease is renewed and cancelled by
+// any pattern for the same subscription. Subscribing or unsubscribing any
+// other way, including with Apply, cancels the subscription's lease.
+type Expiring struct {
+	Matchbox
+	config ExpiryConfig
+	clock  Clock
+	mu     sync.Mutex
+	leases map[leaseKey]*lease
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewExpiring wraps the Matchbox with support for leased subscriptions. If
+// the ExpiryConfig has an Interval, a background reaper is started which runs
+// until Close is called.
+func NewExpiring(mb Matchbox, config ExpiryConfig) *Expiring {
+	e := &Expiring{
+		Matchbox: mb,
+		config:   config,
+		clock:    config.Clock,
+		leases:   map[leaseKey]*lease{},
+		stop:     make(chan struct{}),
+	}
+	if e.clock == nil {
+		e.clock = systemClock{}
+	}
+	if config.Interval > 0 {
+		go e.reap(config.Interval)
+	}
+	return e
+}
+
+// configuration returns the wrapped Matchbox's Config, or nil if it doesn't
+// expose it.
+func (e *Expiring) configuration() *Config {
+	if mb, ok := e.Matchbox.(configured); ok {
+		return mb.configuration()
+	}
+	return nil
+}
+
+// key returns the leaseKey for the Subscriber's subscription to the pattern.
+// If the wrapped Matchbox exposes its Config, the pattern is keyed by its
+// ctrie keys, so it is the same as the words it consists of.
+func (e *Expiring) key(group, topic string, subscriber Subscriber) leaseKey {
+	if config := e.configuration(); config != nil {
+		return leaseKey{pattern: patternKey(config.patternKeys(topic)), group: group, id: subscriber.ID()}
+	}
+	return leaseKey{pattern: topic, group: group, id: subscriber.ID()}
+}
+
+// wordsKey returns the leaseKey for the Subscriber's subscription to the
+// pattern words. If the wrapped Matchbox exposes its Config, the words are
+// keyed by their ctrie keys, so it is the same as the pattern they make up.
+func (e *Expiring) wordsKey(words []string, subscriber Subscriber) leaseKey {
+	config := e.configuration()
+	if config == nil {
+		return leaseKey{pattern: strings.Join(words, "\x00"), id: subscriber.ID()}
+	}
+	keys := config.reduceZeroOrMoreWildcards(config.wordKeys(words, false))
+	return leaseKey{pattern: patternKey(keys), id: subscriber.ID()}
+}
+
+// patternKey returns the lease key of the pattern with the ctrie keys. Each
+// key is quoted, so words containing the delimiter are told apart from the
+// words it separates.
+func patternKey(keys []string) string {
+	return fmt.Sprintf("%q", keys)
+}
+
+// Subscribe a Subscriber to a topic without a lease. Any existing lease for
+// the subscription is cancelled.
+func (e *Expiring) Subscribe(topic string, subscriber Subscriber) {
+	e.TrySubscribe(topic, subscriber)
+}
+
+// TrySubscribe subscribes a Subscriber to a topic without a lease like
+// Subscribe, returning the reason it wasn't if the wrapped Matchbox reports
+// it. The lease is kept if the subscription isn't made.
+func (e *Expiring) TrySubscribe(topic string, subscriber Subscriber) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := TrySubscribe(e.Matchbox, topic, subscriber); err != nil {
+		return err
+	}
+	delete(e.leases, e.key("", topic, subscriber))
+	return nil
+}
+
+// SubscribeWithTTL subscribes a Subscriber to a topic with a lease which
+// expires after the TTL unless renewed with Touch.
+func (e *Expiring) SubscribeWithTTL(topic string, subscriber Subscriber, ttl time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := TrySubscribe(e.Matchbox, topic, subscriber); err != nil {
+		return err
+	}
+	e.leased(e.key("", topic, subscriber), topic, subscriber, ttl)
+	return nil
+}
+
+// SubscribeWords subscribes a Subscriber to a pre-tokenized topic without a
+// lease. Any existing lease for the subscription is cancelled. ErrUnsupported
+// is returned if the wrapped Matchbox isn't a WordMatchbox.
+func (e *Expiring) SubscribeWords(words []string, subscriber Subscriber) error {
+	mb, ok := e.Matchbox.(WordMatchbox)
+	if !ok {
+		return ErrUnsupported
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := mb.SubscribeWords(words, subscriber); err != nil {
+		return err
+	}
+	delete(e.leases, e.wordsKey(words, subscriber))
+	return nil
+}
+
+// SubscribeGroup subscribes a Subscriber to a topic as a member of a shared
+// subscription group without a lease. Any existing lease for the membership
+// is cancelled. ErrUnsupported is returned if the wrapped Matchbox isn't a
+// GroupMatchbox.
+func (e *Expiring) SubscribeGroup(group, topic string, subscriber Subscriber) error {
+	mb, ok := e.Matchbox.(GroupMatchbox)
+	if !ok {
+		return ErrUnsupported
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := mb.SubscribeGroup(group, topic, subscriber); err != nil {
+		return err
+	}
+	delete(e.leases, e.key(group, topic, subscriber))
+	return nil
+}
+
+// SubscribeGroupWithTTL subscribes a Subscriber to a topic as a member of a
+// shared subscription group with a lease which expires after the TTL unless
+// renewed with TouchGroup. ErrUnsupported is returned if the wrapped Matchbox
+// isn't a GroupMatchbox.
+func (e *Expiring) SubscribeGroupWithTTL(group, topic string, subscriber Subscriber,
+	ttl time.Duration) error {
+
+	mb, ok := e.Matchbox.(GroupMatchbox)
+	if !ok {
+		return ErrUnsupported
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := mb.SubscribeGroup(group, topic, subscriber); err != nil {
+		return err
+	}
+	e.leased(e.key(group, topic, subscriber), topic, subscriber, ttl)
+	return nil
+}
+
+// leased records the lease of the subscription with the key.
+func (e *Expiring) leased(key leaseKey, topic string, subscriber Subscriber, ttl time.Duration) {
+	e.leases[key] = &lease{
+		topic:      topic,
+		subscriber: subscriber,
+		ttl:        ttl,
+		expires:    e.clock.Now().Add(ttl),
+	}
+}
+
+// Touch renews the lease of a subscription for its TTL. False is returned if
+// the subscription has no lease.
+func (e *Expiring) Touch(topic string, subscriber Subscriber) bool {
+	return e.touch(e.key("", topic, subscriber))
+}
+
+// TouchGroup renews the lease of a shared subscription group membership for
+// its TTL. False is returned if the membership has no lease.
+func (e *Expiring) TouchGroup(group, topic string, subscriber Subscriber) bool {
+	return e.touch(e.key(group, topic, subscriber))
+}
+
+// touch renews the lease with the key for its TTL.
+func (e *Expiring) touch(key leaseKey) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l, ok := e.leases[key]
+	if ok {
+		l.expires = e.clock.Now().Add(l.ttl)
+	}
+	return ok
+}
+
+// Unsubscribe a Subscriber from a topic, cancelling any lease.
+func (e *Expiring) Unsubscribe(topic string, subscriber Subscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.leases, e.key("", topic, subscriber))
+	e.Matchbox.Unsubscribe(topic, subscriber)
+}
+
+// UnsubscribeWords unsubscribes a Subscriber from a pre-tokenized topic,
+// cancelling any lease. It does nothing if the wrapped Matchbox isn't a
+// WordMatchbox.
+func (e *Expiring) UnsubscribeWords(words []string, subscriber Subscriber) {
+	mb, ok := e.Matchbox.(WordMatchbox)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.leases, e.wordsKey(words, subscriber))
+	mb.UnsubscribeWords(words, subscriber)
+}
+
+// UnsubscribeGroup unsubscribes a member of a shared subscription group from
+// a topic, cancelling any lease. It does nothing if the wrapped Matchbox isn't
+// a GroupMatchbox.
+func (e *Expiring) UnsubscribeGroup(group, topic string, subscriber Subscriber) {
+	mb, ok := e.Matchbox.(GroupMatchbox)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.leases, e.key(group, topic, subscriber))
+	mb.UnsubscribeGroup(group, topic, subscriber)
+}
+
+// Apply makes the Changes atomically, cancelling the leases of the
+// subscriptions they change once they are made. ErrUnsupported is returned if
+// the wrapped Matchbox isn't an Applier.
+func (e *Expiring) Apply(changes []Change) error {
+	mb, ok := e.Matchbox.(Applier)
+	if !ok {
+		return ErrUnsupported
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := mb.Apply(changes); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		delete(e.leases, e.key(change.Group, change.Topic, change.Subscriber))
+	}
+	return nil
+}
+
+// Reap unsubscribes every subscription whose lease has expired and returns
+// the number removed.
+func (e *Expiring) Reap() int {
+	var expired []*lease
+	e.mu.Lock()
+	now := e.clock.Now()
+	for key, l := range e.leases {
+		if now.Before(l.expires) {
+			continue
+		}
+		delete(e.leases, key)
+		if mb, ok := e.Matchbox.(GroupMatchbox); ok && key.group != "" {
+			mb.UnsubscribeGroup(key.group, l.topic, l.subscriber)
+		} else {
+			e.Matchbox.Unsubscribe(l.topic, l.subscriber)
+		}
+		expired = append(expired, l)
+	}
+	e.mu.Unlock()
+	if e.config.OnExpire != nil {
+		for _, l := range expired {
+			e.config.OnExpire(l.topic, l.subscriber)
+		}
+	}
+	return len(expired)
+}
+
+// Close stops the background reaper, if any. Leases are not reaped after
+// Close unless Reap is called.
+func (e *Expiring) Close() {
+	e.once.Do(func() {
+		close(e.stop)
+	})
+}
+
+// reap calls Reap at every interval until the Expiring is closed.
+func (e *Expiring) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Reap()
+		case <-e.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestExpiring(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	expired := map[string]Subscriber{}
+	mb := NewExpiring(New(NewAMQPConfig()), ExpiryConfig{
+		Clock: clock,
+		OnExpire: func(topic string, sub Subscriber) {
+			expired[topic] = sub
+		},
+	})
+	defer mb.Close()
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	mb.SubscribeWithTTL("a.*", sub1, time.Minute)
+	mb.SubscribeWithTTL("b", sub1, 2*time.Minute)
+	mb.Subscribe("a.*", sub2)
+	assert.Len(mb.Subscribers("a.b"), 2)
+
+	clock.Advance(59 * time.Second)
+	assert.Equal(0, mb.Reap())
+	assert.True(mb.Touch("a.*", sub1))
+	assert.False(mb.Touch("a.*", sub2))
+	assert.False(mb.Touch("c", sub1))
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(0, mb.Reap())
+	clock.Advance(time.Minute)
+	assert.Equal(2, mb.Reap())
+	assert.Equal(map[string]Subscriber{"a.*": sub1, "b": sub1}, expired)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("a.b"))
+	assert.Equal([]Subscriber{}, mb.Subscribers("b"))
+	assert.False(mb.Touch("a.*", sub1))
+
+	// Subscribing without a TTL cancels the lease.
+	mb.SubscribeWithTTL("c", sub1, time.Second)
+	mb.Subscribe("c", sub1)
+	clock.Advance(time.Hour)
+	assert.Equal(0, mb.Reap())
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("c"))
+
+	// Unsubscribing cancels the lease.
+	mb.SubscribeWithTTL("d", sub1, time.Second)
+	mb.Unsubscribe("d", sub1)
+	mb.Matchbox.Subscribe("d", sub1)
+	clock.Advance(time.Hour)
+	assert.Equal(0, mb.Reap())
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("d"))
+}
+
+func TestExpiringNormalizesPatterns(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config := NewAMQPConfig()
+	config.FoldCase = true
+	mb := NewExpiring(New(config), ExpiryConfig{Clock: clock})
+	defer mb.Close()
+	sub1 := subscriber("abc")
+
+	// Leases are kept for patterns as the Matchbox normalizes them.
+	mb.SubscribeWithTTL("A.b", sub1, time.Second)
+	assert.True(mb.Touch("a.B", sub1))
+	mb.Subscribe("a.b", sub1)
+	assert.False(mb.Touch("A.b", sub1))
+	mb.SubscribeWithTTL("a.#.#", sub1, time.Second)
+	mb.Unsubscribe("a.#", sub1)
+	mb.Matchbox.Subscribe("a.#", sub1)
+	clock.Advance(time.Hour)
+	assert.Equal(0, mb.Reap())
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.c"))
+
+	// Words are leased as the pattern they make up, so subscribing to a word
+	// containing the delimiter keeps the lease of the pattern, whose
+	// reference is released once the lease expires.
+	config.RefCount = true
+	mb = NewExpiring(New(config), ExpiryConfig{Clock: clock})
+	defer mb.Close()
+	mb.SubscribeWithTTL("B.c", sub1, time.Second)
+	mb.SubscribeWords([]string{"b.c"}, sub1)
+	mb.SubscribeWords([]string{"B", "c"}, sub1)
+	assert.False(mb.Touch("b.c", sub1))
+	mb.SubscribeWithTTL("b.d", sub1, time.Second)
+	mb.SubscribeWords([]string{"b.d"}, sub1)
+	clock.Advance(time.Hour)
+	assert.Equal(1, mb.Reap())
+	assert.Equal(0, mb.Matchbox.(RefCounter).RefCount("b.d", sub1.ID()))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("b.c"))
+
+	// Wrapped Matchboxes expose the Config.
+	r := NewRecompiling(New(config), RecompileConfig{})
+	defer r.Close()
+	assert.Equal(config, NewExpiring(r, ExpiryConfig{}).configuration())
+}
+
+func TestExpiringBookkeeping(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	mb := NewExpiring(New(NewAMQPConfig()), ExpiryConfig{Clock: clock})
+	defer mb.Close()
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	// Subscribing to and unsubscribing from words cancels the lease.
+	mb.SubscribeWithTTL("a.b", sub1, time.Second)
+	mb.SubscribeWords([]string{"a", "b"}, sub1)
+	assert.False(mb.Touch("a.b", sub1))
+	mb.SubscribeWithTTL("a.c", sub1, time.Second)
+	mb.UnsubscribeWords([]string{"a", "c"}, sub1)
+	assert.False(mb.Touch("a.c", sub1))
+
+	// A word containing the delimiter is a different subscription from the
+	// words it separates.
+	mb.SubscribeWithTTL("a.d", sub1, time.Second)
+	mb.UnsubscribeWords([]string{"a.d"}, sub1)
+	assert.True(mb.Touch("a.d", sub1))
+	mb.UnsubscribeWords([]string{"a", "d"}, sub1)
+	assert.False(mb.Touch("a.d", sub1))
+
+	// Group memberships are leased separately.
+	mb.SubscribeWithTTL("b", sub1, time.Second)
+	mb.SubscribeGroupWithTTL("g", "b", sub1, 2*time.Second)
+	mb.SubscribeGroupWithTTL("g", "c", sub2, time.Second)
+	assert.True(mb.TouchGroup("g", "b", sub1))
+	assert.False(mb.TouchGroup("h", "b", sub1))
+	mb.SubscribeGroup("g", "c", sub2)
+	assert.False(mb.TouchGroup("g", "c", sub2))
+	clock.Advance(time.Second)
+	assert.Equal(1, mb.Reap())
+	assert.Equal([]Subscriber{sub1}, mb.Matchbox.(GroupMatchbox).SubscribersForDelivery("b"))
+	clock.Advance(time.Second)
+	assert.Equal(1, mb.Reap())
+	assert.Equal([]Subscriber{}, mb.Subscribers("b"))
+	mb.SubscribeGroupWithTTL("g", "d", sub2, time.Second)
+	mb.UnsubscribeGroup("g", "d", sub2)
+	assert.False(mb.TouchGroup("g", "d", sub2))
+
+	// Applying Changes cancels their leases.
+	mb.SubscribeWithTTL("e", sub1, time.Second)
+	mb.SubscribeGroupWithTTL("g", "e", sub2, time.Second)
+	assert.Nil(mb.Apply([]Change{
+		{Kind: ChangeSubscribe, Topic: "e", Subscriber: sub1},
+		{Kind: ChangeUnsubscribe, Topic: "e", Subscriber: sub2, Group: "g"},
+	}))
+	assert.False(mb.Touch("e", sub1))
+	assert.False(mb.TouchGroup("g", "e", sub2))
+	clock.Advance(time.Hour)
+	assert.Equal(0, mb.Reap())
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("e"))
+}
+
+func TestExpiringReaper(t *testing.T) {
+	assert := assert.New(t)
+	expired := make(chan string, 1)
+	mb := NewExpiring(New(NewAMQPConfig()), ExpiryConfig{
+		Interval: time.Millisecond,
+		OnExpire: func(topic string, sub Subscriber) {
+			expired <- topic
+		},
+	})
+	defer mb.Close()
+	mb.SubscribeWithTTL("a", subscriber("abc"), time.Millisecond)
+	select {
+	case topic := <-expired:
+		assert.Equal("a", topic)
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not reaped")
+	}
+	assert.Equal([]Subscriber{}, mb.Subscribers("a"))
+	mb.Close()
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExplainStepKind is the kind of a step taken by a lookup.
+type ExplainStepKind string
+
+const (
+	// ExplainVisit is a visit to a C-node.
+	ExplainVisit ExplainStepKind = "visit"
+
+	// ExplainExact follows the branch matching the word exactly.
+	ExplainExact ExplainStepKind = "exact"
+
+	// ExplainSingleWildcard follows the single-word-wildcard branch.
+	ExplainSingleWildcard ExplainStepKind = "single_wildcard"
+
+	// ExplainZeroOrMoreWildcard follows the zero-or-more-wildcard branch.
+	ExplainZeroOrMoreWildcard ExplainStepKind = "zero_or_more_wildcard"
+
+	// ExplainRangeWildcard follows a ranged-wildcard branch.
+	ExplainRangeWildcard ExplainStepKind = "range_wildcard"
+
+	// ExplainLoopback consumes the word with a zero-or-more wildcard and
+	// loops back to match the following words at the same C-node.
+	ExplainLoopback ExplainStepKind = "loopback"
+)
+
+// ExplainStep is a step taken by a lookup.
+type ExplainStep struct {
+	Kind ExplainStepKind `json:"kind"`
+
+	// Path is the pattern prefix of the C-node the step was taken from, at
+	// the given depth in the trie, and Word the word of the topic being
+	// matched.
+	Path  string `json:"path"`
+	Depth int    `json:"depth"`
+	Word  string `json:"word"`
+
+	// Branch is the key of the branch followed, and Branches the number of
+	// branches of a C-node which was visited.
+	Branch   string `json:"branch,omitempty"`
+	Branches int    `json:"branches,omitempty"`
+}
+
+// Contribution is a pattern which contributed Subscribers to a lookup.
+type Contribution struct {
+	Pattern     string   `json:"pattern"`
+	Subscribers []string `json:"subscribers"`
+}
+
+// Explanation records how the Subscribers for a topic were found: the steps
+// the lookup took through the trie and the patterns which contributed
+// Subscribers to the result.
+type Explanation struct {
+	Topic         string         `json:"topic"`
+	Steps         []ExplainStep  `json:"steps"`
+	Contributions []Contribution `json:"contributions"`
+
+	// Subscribers are the IDs of the Subscribers found.
+	Subscribers []string `json:"subscribers"`
+}
+
+// String renders the Explanation as indented text, one step per line.
+func (e Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "topic %q\n", e.Topic)
+	for _, step := range e.Steps {
+		indent := strings.Repeat("  ", step.Depth+1)
+		switch step.Kind {
+		case ExplainVisit:
+			fmt.Fprintf(&b, "%svisit %q with %d branches for word %q\n",
+				indent, step.Path, step.Branches, step.Word)
+		case ExplainLoopback:
+			fmt.Fprintf(&b, "%sloopback at %q consuming word %q\n", indent, step.Path, step.Word)
+		default:
+			fmt.Fprintf(&b, "%s%s branch %q for word %q\n", indent, step.Kind, step.Branch, step.Word)
+		}
+	}
+	for _, c := range e.Contributions {
+		fmt.Fprintf(&b, "pattern %q contributed %s\n", c.Pattern, strings.Join(c.Subscribers, ", "))
+	}
+	fmt.Fprintf(&b, "subscribers %s\n", strings.Join(e.Subscribers, ", "))
+	return b.String()
+}
+
+// Explain looks up the Subscribers for a topic in a read-only snapshot,
+// recording the steps taken.
+func (m *matchbox) Explain(topic string) Explanation {
+	snapshot := m.ReadOnlySnapshot()
+	keys := m.config.topicKeys(topic)
+	for {
+		trace := &explainer{config: m.config, contributions: map[string]map[string]bool{}}
+		subs, ok := snapshot.ilookup(snapshot.root, keys, nil, snapshot.root.gen, trace)
+		if ok {
+			return trace.explanation(topic, ungrouped(subs))
+		}
+	}
+}
+
+// explainer records the steps taken by a lookup of a read-only snapshot,
+// which never renews the C-nodes it visits, as it descends and ascends the
+// trie. Its methods do nothing on a nil explainer, so lookups trace nothing
+// unless explaining.
+type explainer struct {
+	config        *Config
+	path          []string
+	steps         []ExplainStep
+	contributions map[string]map[string]bool
+}
+
+// pathString returns the current path joined into a pattern.
+func (e *explainer) pathString(keys ...string) string {
+	return strings.Join(append(append([]string{}, e.path...), keys...), e.config.Delimiter)
+}
+
+// visit records a visit to a C-node.
+func (e *explainer) visit(word string, cn *cNode) {
+	if e != nil {
+		e.steps = append(e.steps, ExplainStep{
+			Kind: ExplainVisit, Path: e.pathString(), Depth: len(e.path), Word: word,
+			Branches: len(cn.branches)})
+	}
+}
+
+// enter records following the branch and descends into it.
+func (e *explainer) enter(kind ExplainStepKind, word, key string) {
+	if e != nil {
+		e.steps = append(e.steps, ExplainStep{
+			Kind: kind, Path: e.pathString(), Depth: len(e.path), Word: word, Branch: key})
+		e.path = append(e.path, key)
+	}
+}
+
+// leave ascends from the branch last entered.
+func (e *explainer) leave() {
+	if e != nil {
+		e.path = e.path[:len(e.path)-1]
+	}
+}
+
+// loopback records a zero-or-more wildcard consuming the word.
+func (e *explainer) loopback(word string) {
+	if e != nil {
+		e.steps = append(e.steps, ExplainStep{
+			Kind: ExplainLoopback, Path: e.pathString(), Depth: len(e.path), Word: word})
+	}
+}
+
+// contribute records the Subscribers as found on the current path extended
+// by the keys.
+func (e *explainer) contribute(subs []Subscriber, keys ...string) {
+	if e == nil || len(subs) == 0 {
+		return
+	}
+	pattern := e.pathString(keys...)
+	ids, ok := e.contributions[pattern]
+	if !ok {
+		ids = map[string]bool{}
+		e.contributions[pattern] = ids
+	}
+	for _, sub := range ungrouped(subs) {
+		ids[sub.ID()] = true
+	}
+}
+
+// explanation returns the Explanation of the lookup of the topic which found
+// the Subscribers.
+func (e *explainer) explanation(topic string, subs []Subscriber) Explanation {
+	explanation := Explanation{
+		Topic:         topic,
+		Steps:         e.steps,
+		Contributions: make([]Contribution, 0, len(e.contributions)),
+		Subscribers:   make([]string, 0, len(subs)),
+	}
+	for pattern, ids := range e.contributions {
+		c := Contribution{Pattern: pattern, Subscribers: make([]string, 0, len(ids))}
+		for id := range ids {
+			c.Subscribers = append(c.Subscribers, id)
+		}
+		sort.Strings(c.Subscribers)
+		explanation.Contributions = append(explanation.Contributions, c)
+	}
+	sort.Slice(explanation.Contributions, func(i, j int) bool {
+		return explanation.Contributions[i].Pattern < explanation.Contributions[j].Pattern
+	})
+	for _, sub := range subs {
+		explanation.Subscribers = append(explanation.Subscribers, sub.ID())
+	}
+	sort.Strings(explanation.Subscribers)
+	return explanation
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// explainSteps returns the kind, path and branch of each step.
+func explainSteps(e Explanation) []string {
+	steps := make([]string, len(e.Steps))
+	for i, step := range e.Steps {
+		steps[i] = string(step.Kind) + " " + step.Path + " " + step.Branch
+	}
+	return steps
+}
+
+func TestExplain(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	mb.Subscribe("a.#", sub1)
+	mb.Subscribe("a.b", sub2)
+	mb.Subscribe("b.*", sub2)
+
+	e := mb.Explain("a.b")
+	assert.Equal("a.b", e.Topic)
+	assert.Equal([]string{
+		"visit  ",
+		"exact  a",
+		"visit a ",
+		"exact a b",
+		"zero_or_more_wildcard a #",
+	}, explainSteps(e))
+	assert.Equal([]Contribution{
+		{Pattern: "a.#", Subscribers: []string{"abc"}},
+		{Pattern: "a.b", Subscribers: []string{"def"}},
+	}, e.Contributions)
+	assert.Equal([]string{"abc", "def"}, e.Subscribers)
+
+	// Zero-or-more wildcards loop back over words.
+	loop := New(NewAMQPConfig()).(*matchbox)
+	loop.Subscribe("a.#.d", sub2)
+	e = loop.Explain("a.x.y.d")
+	assert.Contains(explainSteps(e), "loopback a.# ")
+	assert.Equal([]Contribution{{Pattern: "a.#.d", Subscribers: []string{"def"}}}, e.Contributions)
+	assert.Equal([]string{"def"}, e.Subscribers)
+
+	// Misses are explained too.
+	e = mb.Explain("c.d")
+	assert.Equal([]string{"visit  "}, explainSteps(e))
+	assert.Equal([]Contribution{}, e.Contributions)
+	assert.Equal([]string{}, e.Subscribers)
+}
+
+func TestExplainRender(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	mb.SubscribeGroup("workers", "a.*", subscriber("abc"))
+
+	e := mb.Explain("a.b")
+	assert.Equal(`topic "a.b"
+  visit "" with 1 branches for word "a"
+  exact branch "a" for word "a"
+    visit "a" with 1 branches for word "b"
+    single_wildcard branch "*" for word "b"
+pattern "a.*" contributed abc
+subscribers abc
+`, e.String())
+
+	var decoded Explanation
+	data, err := json.Marshal(e)
+	assert.Nil(err)
+	assert.True(strings.Contains(string(data), `"kind":"single_wildcard"`))
+	assert.Nil(json.Unmarshal(data, &decoded))
+	assert.Equal(e, decoded)
+}
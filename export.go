@@ -0,0 +1,234 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExportOptions controls the export of the trie structure.
+type ExportOptions struct {
+	// MaxDepth is the maximum number of levels of branches exported. I-nodes
+	// below the deepest level are exported as truncated. Zero means
+	// unlimited.
+	MaxDepth int
+
+	// MaxFanOut is the maximum number of branches exported for a C-node.
+	// Beyond it, branches are collapsed into a summary. Zero means unlimited.
+	MaxFanOut int
+}
+
+// ExportedINode is an exported I-node. Generations are numbered in the order
+// they are first encountered, starting with the root I-node's.
+type ExportedINode struct {
+	Generation int            `json:"generation"`
+	CNode      *ExportedCNode `json:"cnode,omitempty"`
+
+	// Tombed indicates the I-node points to a T-node, and Truncated that the
+	// C-node it points to was not exported because of MaxDepth.
+	Tombed    bool `json:"tombed,omitempty"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExportedCNode is an exported C-node with its branches sorted by key.
+type ExportedCNode struct {
+	Generation int                `json:"generation"`
+	Branches   []ExportedBranch   `json:"branches"`
+	Collapsed  *CollapsedBranches `json:"collapsed,omitempty"`
+}
+
+// ExportedBranch is an exported branch with the number of Subscribers to the
+// pattern ending at it.
+type ExportedBranch struct {
+	Key         string         `json:"key"`
+	Subscribers int            `json:"subscribers"`
+	INode       *ExportedINode `json:"inode,omitempty"`
+}
+
+// CollapsedBranches summarizes the branches of a C-node beyond MaxFanOut.
+// Subscribers is the number of Subscribers on the collapsed branches
+// themselves, not counting any below them.
+type CollapsedBranches struct {
+	Branches    int `json:"branches"`
+	Subscribers int `json:"subscribers"`
+}
+
+// ExportJSON writes the structure of the trie, walked from a read-only
+// snapshot, as JSON: the root ExportedINode with everything below it.
+func (m *matchbox) ExportJSON(w io.Writer, opts ExportOptions) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m.export(opts))
+}
+
+// ExportDOT writes the structure of the trie, walked from a read-only
+// snapshot, as a Graphviz DOT digraph. I-nodes are drawn as circles, C-nodes
+// as boxes and edges are labeled with branch keys and Subscriber counts.
+func (m *matchbox) ExportDOT(w io.Writer, opts ExportOptions) error {
+	d := &dotWriter{w: bufio.NewWriter(w)}
+	d.printf("digraph matchbox {\n")
+	d.printf("  node [fontname=\"monospace\"];\n")
+	d.iNode(m.export(opts))
+	d.printf("}\n")
+	if d.err != nil {
+		return d.err
+	}
+	return d.w.Flush()
+}
+
+// export walks a read-only snapshot, returning its root I-node.
+func (m *matchbox) export(opts ExportOptions) *ExportedINode {
+	snapshot := m.ReadOnlySnapshot()
+	e := &exporter{ctrie: snapshot, opts: opts, gens: map[*generation]int{}}
+	return e.iNode(snapshot.root, 0)
+}
+
+// exporter exports the nodes of a read-only snapshot.
+type exporter struct {
+	ctrie *ctrie
+	opts  ExportOptions
+	gens  map[*generation]int
+}
+
+// generation returns the number of the generation.
+func (e *exporter) generation(gen *generation) int {
+	n, ok := e.gens[gen]
+	if !ok {
+		n = len(e.gens)
+		e.gens[gen] = n
+	}
+	return n
+}
+
+// iNode exports the I-node whose C-node is at the given level.
+func (e *exporter) iNode(in *iNode, level int) *ExportedINode {
+	exported := &ExportedINode{Generation: e.generation(in.gen)}
+	main := gcasRead(in, e.ctrie)
+	switch {
+	case main.tNode != nil:
+		exported.Tombed = true
+	case e.opts.MaxDepth > 0 && level >= e.opts.MaxDepth:
+		exported.Truncated = true
+	case main.cNode != nil:
+		exported.CNode = e.cNode(main.cNode, level)
+	}
+	return exported
+}
+
+// cNode exports the C-node at the given level.
+func (e *exporter) cNode(cn *cNode, level int) *ExportedCNode {
+	keys := make([]string, 0, len(cn.branches))
+	for key := range cn.branches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	exported := &ExportedCNode{Generation: e.generation(cn.gen), Branches: []ExportedBranch{}}
+	if e.opts.MaxFanOut > 0 && len(keys) > e.opts.MaxFanOut {
+		exported.Collapsed = &CollapsedBranches{Branches: len(keys) - e.opts.MaxFanOut}
+		for _, key := range keys[e.opts.MaxFanOut:] {
+			exported.Collapsed.Subscribers += len(cn.branches[key].subs)
+		}
+		keys = keys[:e.opts.MaxFanOut]
+	}
+	for _, key := range keys {
+		br := cn.branches[key]
+		eb := ExportedBranch{Key: key, Subscribers: len(br.subs)}
+		if br.iNode != nil {
+			eb.INode = e.iNode(br.iNode, level+1)
+		}
+		exported.Branches = append(exported.Branches, eb)
+	}
+	return exported
+}
+
+// dotWriter writes exported nodes as DOT, remembering the first error.
+type dotWriter struct {
+	w     *bufio.Writer
+	nodes int
+	err   error
+}
+
+// printf writes formatted output unless an error has occurred.
+func (d *dotWriter) printf(format string, args ...any) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// node returns a new, unique node name.
+func (d *dotWriter) node(prefix string) string {
+	d.nodes++
+	return prefix + strconv.Itoa(d.nodes)
+}
+
+// iNode writes the I-node and everything below it, returning its name.
+func (d *dotWriter) iNode(in *ExportedINode) string {
+	name := d.node("i")
+	lines := []string{fmt.Sprintf("I gen %d", in.Generation)}
+	switch {
+	case in.Tombed:
+		lines = append(lines, "T-node")
+	case in.Truncated:
+		lines = append(lines, "...")
+	}
+	d.printf("  %s [shape=circle, label=%s];\n", name, dotLabel(lines...))
+	if in.CNode != nil {
+		d.printf("  %s -> %s;\n", name, d.cNode(in.CNode))
+	}
+	return name
+}
+
+// cNode writes the C-node and everything below it, returning its name.
+func (d *dotWriter) cNode(cn *ExportedCNode) string {
+	name := d.node("c")
+	d.printf("  %s [shape=box, label=%s];\n", name, dotLabel(fmt.Sprintf("C gen %d", cn.Generation)))
+	for _, br := range cn.Branches {
+		label := fmt.Sprintf("%s (%d)", strconv.Quote(br.Key), br.Subscribers)
+		if br.INode == nil {
+			leaf := d.node("b")
+			d.printf("  %s [shape=point];\n", leaf)
+			d.printf("  %s -> %s [label=%s];\n", name, leaf, dotLabel(label))
+			continue
+		}
+		d.printf("  %s -> %s [label=%s];\n", name, d.iNode(br.INode), dotLabel(label))
+	}
+	if cn.Collapsed != nil {
+		collapsed := d.node("b")
+		d.printf("  %s [shape=note, label=%s];\n", collapsed, dotLabel(
+			fmt.Sprintf("%d more branches", cn.Collapsed.Branches),
+			fmt.Sprintf("%d subscribers", cn.Collapsed.Subscribers)))
+		d.printf("  %s -> %s [style=dashed];\n", name, collapsed)
+	}
+	return name
+}
+
+// dotEscaper escapes text within a DOT string.
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// dotLabel returns a DOT string of the lines.
+func dotLabel(lines ...string) string {
+	for i, line := range lines {
+		lines[i] = dotEscaper.Replace(line)
+	}
+	return `"` + strings.Join(lines, `\n`) + `"`
+}
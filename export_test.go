@@ -0,0 +1,118 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportJSON(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	mb.Subscribe("a.b", sub1)
+	mb.Subscribe("a.b", sub2)
+	mb.Subscribe("a.c.d", sub1)
+	mb.Subscribe("b", sub2)
+
+	var buf bytes.Buffer
+	assert.Nil(mb.ExportJSON(&buf, ExportOptions{}))
+	var root ExportedINode
+	assert.Nil(json.Unmarshal(buf.Bytes(), &root))
+	assert.Equal(0, root.Generation)
+	assert.Len(root.CNode.Branches, 2)
+	a := root.CNode.Branches[0]
+	assert.Equal("a", a.Key)
+	assert.Equal(0, a.Subscribers)
+	assert.Equal([]string{"b", "c"}, []string{a.INode.CNode.Branches[0].Key, a.INode.CNode.Branches[1].Key})
+	assert.Equal(2, a.INode.CNode.Branches[0].Subscribers)
+	assert.Nil(a.INode.CNode.Branches[0].INode)
+	d := a.INode.CNode.Branches[1].INode.CNode.Branches[0]
+	assert.Equal(ExportedBranch{Key: "d", Subscribers: 1}, d)
+	assert.Equal(ExportedBranch{Key: "b", Subscribers: 1}, root.CNode.Branches[1])
+
+	// Depth is limited to the given number of levels of branches.
+	root = ExportedINode{}
+	buf.Reset()
+	assert.Nil(mb.ExportJSON(&buf, ExportOptions{MaxDepth: 1}))
+	assert.Nil(json.Unmarshal(buf.Bytes(), &root))
+	assert.True(root.CNode.Branches[0].INode.Truncated)
+	assert.Nil(root.CNode.Branches[0].INode.CNode)
+
+	// Large fan-outs are collapsed.
+	root = ExportedINode{}
+	buf.Reset()
+	assert.Nil(mb.ExportJSON(&buf, ExportOptions{MaxFanOut: 1}))
+	assert.Nil(json.Unmarshal(buf.Bytes(), &root))
+	assert.Len(root.CNode.Branches, 1)
+	assert.Equal(&CollapsedBranches{Branches: 1, Subscribers: 1}, root.CNode.Collapsed)
+	assert.Equal(&CollapsedBranches{Branches: 1, Subscribers: 0}, root.CNode.Branches[0].INode.CNode.Collapsed)
+}
+
+func TestExportGenerations(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig())
+	mb.Subscribe("a.b", subscriber("abc"))
+	mb.(*matchbox).ReadOnlySnapshot()
+	mb.Subscribe("c", subscriber("abc"))
+
+	// The insert after the snapshot renewed the root C-node and copied the
+	// I-nodes below it to the new generation, but the C-node below "a" is
+	// still from the original generation.
+	root := mb.(*matchbox).export(ExportOptions{})
+	assert.Equal(0, root.Generation)
+	assert.Equal(0, root.CNode.Generation)
+	assert.Equal(0, root.CNode.Branches[0].INode.Generation)
+	assert.Equal(1, root.CNode.Branches[0].INode.CNode.Generation)
+}
+
+func TestExportDOT(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	mb.Subscribe("a.b", subscriber("abc"))
+	mb.Subscribe(`c"d`, subscriber("abc"))
+	mb.Subscribe("e", subscriber("abc"))
+
+	var buf bytes.Buffer
+	assert.Nil(mb.ExportDOT(&buf, ExportOptions{MaxFanOut: 2}))
+	dot := buf.String()
+	assert.True(strings.HasPrefix(dot, "digraph matchbox {\n"))
+	assert.True(strings.HasSuffix(dot, "}\n"))
+	assert.Contains(dot, `i1 [shape=circle, label="I gen 0"];`)
+	assert.Contains(dot, `c2 -> i3 [label="\"a\" (0)"];`)
+	assert.Contains(dot, `[label="\"b\" (1)"];`)
+	assert.Contains(dot, `[label="\"c\\\"d\" (1)"];`)
+	assert.Contains(dot, `[shape=note, label="1 more branches\n1 subscribers"];`)
+	assert.NotContains(dot, `"e"`)
+
+	assert.Equal(errWriter, mb.ExportDOT(failingWriter{}, ExportOptions{}))
+}
+
+var errWriter = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWriter
+}
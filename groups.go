@@ -0,0 +1,367 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// GroupStrategy picks the member of a shared subscription group which
+// receives a message. Implementations must be safe for concurrent use.
+type GroupStrategy interface {
+	// Pick returns the member of the group which receives a message
+	// published to the topic. Members are sorted by ID and never empty.
+	Pick(group, topic string, members []Subscriber) Subscriber
+}
+
+// roundRobinStrategy picks the members of each group in turn.
+type roundRobinStrategy struct {
+	counters sync.Map
+}
+
+// NewRoundRobinStrategy returns a GroupStrategy which picks the members of
+// each group in turn.
+func NewRoundRobinStrategy() GroupStrategy {
+	return &roundRobinStrategy{}
+}
+
+// Pick returns the next member of the group.
+func (r *roundRobinStrategy) Pick(group, topic string, members []Subscriber) Subscriber {
+	counter, ok := r.counters.Load(group)
+	if !ok {
+		counter, _ = r.counters.LoadOrStore(group, new(uint64))
+	}
+	n := atomic.AddUint64(counter.(*uint64), 1) - 1
+	return members[n%uint64(len(members))]
+}
+
+// forget drops the group's counter.
+func (r *roundRobinStrategy) forget(group string) {
+	r.counters.Delete(group)
+}
+
+// groupForgetter is implemented by GroupStrategies which keep state for each
+// group, which is dropped once the group has no members left.
+type groupForgetter interface {
+	forget(group string)
+}
+
+// randomStrategy picks a member of each group at random.
+type randomStrategy struct{}
+
+// NewRandomStrategy returns a GroupStrategy which picks a member of each group
+// at random.
+func NewRandomStrategy() GroupStrategy {
+	return randomStrategy{}
+}
+
+// Pick returns a random member of the group.
+func (randomStrategy) Pick(group, topic string, members []Subscriber) Subscriber {
+	return members[rand.Intn(len(members))]
+}
+
+// consistentHashStrategy picks the member of each group with the highest hash
+// of the topic and member ID.
+type consistentHashStrategy struct{}
+
+// NewConsistentHashStrategy returns a GroupStrategy which always picks the
+// same member of a group for a topic. It uses rendezvous hashing, so members
+// joining or leaving a group only move the topics they gain or lose.
+func NewConsistentHashStrategy() GroupStrategy {
+	return consistentHashStrategy{}
+}
+
+// Pick returns the member of the group with the highest hash of the topic and
+// member ID.
+func (consistentHashStrategy) Pick(group, topic string, members []Subscriber) Subscriber {
+	var (
+		picked Subscriber
+		max    uint64
+	)
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(topic))
+		h.Write([]byte{0})
+		h.Write([]byte(member.ID()))
+		if sum := h.Sum64(); picked == nil || sum > max {
+			picked, max = member, sum
+		}
+	}
+	return picked
+}
+
+// groupMember is the Subscriber stored in the ctrie for a member of a shared
+// subscription group.
+type groupMember struct {
+	id         string
+	group      string
+	subscriber Subscriber
+}
+
+// newGroupMember creates a member of the group for the Subscriber. The quoted
+// group name keeps its ID distinct from other groups and from the IDs of
+// ungrouped Subscribers.
+func newGroupMember(group string, sub Subscriber) *groupMember {
+	return &groupMember{
+		id:         "\x00" + strconv.Quote(group) + sub.ID(),
+		group:      group,
+		subscriber: sub,
+	}
+}
+
+// ID returns the member's ID.
+func (g *groupMember) ID() string {
+	return g.id
+}
+
+// groupIndex keeps the members of each shared subscription group sorted by ID
+// as they join and leave, so deliveries needn't sort them. Members join the
+// index before they are inserted into the ctrie and leave it after they are
+// removed, so a lookup finds no members which aren't in the index except while
+// Changes are applied.
+type groupIndex struct {
+	mu       sync.RWMutex
+	groups   map[string]*groupMembers
+	strategy GroupStrategy
+}
+
+// groupMembers are the members of a group sorted by ID, which is replaced
+// rather than modified, and the number of patterns each is subscribed to.
+type groupMembers struct {
+	sorted   []Subscriber
+	patterns map[string]int
+}
+
+// newGroupIndex creates an empty groupIndex which tells the GroupStrategy
+// when a group empties.
+func newGroupIndex(strategy GroupStrategy) *groupIndex {
+	return &groupIndex{groups: map[string]*groupMembers{}, strategy: strategy}
+}
+
+// joined records the member subscribing to a pattern.
+func (g *groupIndex) joined(member *groupMember) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members, ok := g.groups[member.group]
+	if !ok {
+		members = &groupMembers{patterns: map[string]int{}}
+		g.groups[member.group] = members
+	}
+	id := member.subscriber.ID()
+	if members.patterns[id] == 0 {
+		n := sort.Search(len(members.sorted), func(i int) bool {
+			return members.sorted[i].ID() >= id
+		})
+		sorted := make([]Subscriber, 0, len(members.sorted)+1)
+		sorted = append(sorted, members.sorted[:n]...)
+		sorted = append(sorted, member.subscriber)
+		members.sorted = append(sorted, members.sorted[n:]...)
+	}
+	members.patterns[id]++
+}
+
+// left records the member unsubscribing from a pattern. The group is dropped
+// once it has no members left.
+func (g *groupIndex) left(member *groupMember) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members, ok := g.groups[member.group]
+	id := member.subscriber.ID()
+	if !ok || members.patterns[id] == 0 {
+		return
+	}
+	if members.patterns[id]--; members.patterns[id] > 0 {
+		return
+	}
+	delete(members.patterns, id)
+	if len(members.patterns) == 0 {
+		delete(g.groups, member.group)
+		if forgetter, ok := g.strategy.(groupForgetter); ok {
+			forgetter.forget(member.group)
+		}
+		return
+	}
+	sorted := make([]Subscriber, 0, len(members.sorted)-1)
+	for _, sub := range members.sorted {
+		if sub.ID() != id {
+			sorted = append(sorted, sub)
+		}
+	}
+	members.sorted = sorted
+}
+
+// members returns the group's matched members sorted by ID without
+// duplicates. They are taken from the index if it has them all, and sorted
+// otherwise.
+func (g *groupIndex) members(group string, matched []Subscriber) []Subscriber {
+	var sorted []Subscriber
+	if g != nil {
+		g.mu.RLock()
+		if members, ok := g.groups[group]; ok {
+			sorted = members.sorted
+		}
+		g.mu.RUnlock()
+	}
+	ids := make(map[string]bool, len(matched))
+	for _, sub := range matched {
+		ids[sub.ID()] = true
+	}
+	found := 0
+	for _, sub := range sorted {
+		if ids[sub.ID()] {
+			found++
+		}
+	}
+	switch {
+	case found == len(ids) && found == len(sorted):
+		return sorted
+	case found == len(ids):
+		members := make([]Subscriber, 0, found)
+		for _, sub := range sorted {
+			if ids[sub.ID()] {
+				members = append(members, sub)
+			}
+		}
+		return members
+	}
+	sort.Sort(subscribersByID(matched))
+	return uniqueSorted(matched)
+}
+
+// ungrouped replaces group members with their Subscribers, removing any
+// duplicates. The Subscribers are returned as they are if none are grouped.
+func ungrouped(subs []Subscriber) []Subscriber {
+	grouped := false
+	for _, sub := range subs {
+		if _, ok := sub.(*groupMember); ok {
+			grouped = true
+			break
+		}
+	}
+	if !grouped {
+		return subs
+	}
+	seen := make(map[string]bool, len(subs))
+	s := make([]Subscriber, 0, len(subs))
+	for _, sub := range subs {
+		if member, ok := sub.(*groupMember); ok {
+			sub = member.subscriber
+		}
+		if !seen[sub.ID()] {
+			seen[sub.ID()] = true
+			s = append(s, sub)
+		}
+	}
+	return s
+}
+
+// SubscribeGroup subscribes a Subscriber to a topic as a member of a shared
+// subscription group.
+func (m *matchbox) SubscribeGroup(group, topic string, subscriber Subscriber) error {
+	member := newGroupMember(group, subscriber)
+	keys := m.config.patternKeys(topic)
+	if err := m.config.checkRanges(keys); err != nil {
+		return err
+	}
+	op := &insertion{sub: member, topic: m.config.subscribedTopic(keys, topic)}
+	m.groups.joined(member)
+	m.insertOp(keys, op)
+	if !op.added {
+		m.groups.left(member)
+	}
+	return op.err
+}
+
+// UnsubscribeGroup unsubscribes a member of a shared subscription group from
+// a topic.
+func (m *matchbox) UnsubscribeGroup(group, topic string, subscriber Subscriber) {
+	member := newGroupMember(group, subscriber)
+	op := &removal{sub: member}
+	m.removeOp(m.config.patternKeys(topic), op)
+	if op.removed {
+		m.groups.left(member)
+	}
+}
+
+// SubscribersForDelivery returns every ungrouped Subscriber for a topic plus
+// one member of each shared subscription group.
+func (m *matchbox) SubscribersForDelivery(topic string) []Subscriber {
+	return pickGroupMembers(m.strategy, m.groups, topic, m.Lookup(topic))
+}
+
+// pickGroupMembers returns the ungrouped Subscribers plus the member of each
+// group picked by the strategy from its members sorted by the index.
+func pickGroupMembers(strategy GroupStrategy, index *groupIndex, topic string,
+	subs []Subscriber) []Subscriber {
+
+	var (
+		delivery = make([]Subscriber, 0, len(subs))
+		seen     = make(map[string]bool, len(subs))
+		groups   map[string][]Subscriber
+	)
+	for _, sub := range subs {
+		member, ok := sub.(*groupMember)
+		if !ok {
+			if !seen[sub.ID()] {
+				seen[sub.ID()] = true
+				delivery = append(delivery, sub)
+			}
+			continue
+		}
+		if groups == nil {
+			groups = map[string][]Subscriber{}
+		}
+		groups[member.group] = append(groups[member.group], member.subscriber)
+	}
+	for group, members := range groups {
+		picked := strategy.Pick(group, topic, index.members(group, members))
+		if !seen[picked.ID()] {
+			seen[picked.ID()] = true
+			delivery = append(delivery, picked)
+		}
+	}
+	return delivery
+}
+
+// subscribersByID sorts Subscribers by ID.
+type subscribersByID []Subscriber
+
+func (s subscribersByID) Len() int           { return len(s) }
+func (s subscribersByID) Less(i, j int) bool { return s[i].ID() < s[j].ID() }
+func (s subscribersByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// uniqueSorted removes adjacent Subscribers with the same ID.
+func uniqueSorted(subs []Subscriber) []Subscriber {
+	unique := subs[:1]
+	for _, sub := range subs[1:] {
+		if sub.ID() != unique[len(unique)-1].ID() {
+			unique = append(unique, sub)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeGroup(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+	sub4 := subscriber("jkl")
+
+	mb.Subscribe("a.b", sub1)
+	mb.SubscribeGroup("workers", "a.*", sub2)
+	mb.SubscribeGroup("workers", "a.b", sub3)
+	mb.SubscribeGroup("workers", "a.#", sub3)
+	mb.SubscribeGroup("audit", "#", sub4)
+
+	// Lookups return every Subscriber, grouped or not.
+	subscribers := mb.Subscribers("a.b")
+	assert.Len(subscribers, 4)
+	for _, sub := range []Subscriber{sub1, sub2, sub3, sub4} {
+		assert.Contains(subscribers, sub)
+	}
+	subscriptions := mb.Subscriptions()
+	assert.Equal([]Subscriber{sub3}, subscriptions["a.#"])
+	assert.Equal([]Subscriber{sub4}, subscriptions["#"])
+
+	// Delivery picks one member per group in turn.
+	picked := map[Subscriber]int{}
+	for i := 0; i < 10; i++ {
+		delivery := mb.SubscribersForDelivery("a.b")
+		assert.Len(delivery, 3)
+		assert.Contains(delivery, sub1)
+		assert.Contains(delivery, sub4)
+		for _, sub := range delivery {
+			picked[sub]++
+		}
+	}
+	assert.Equal(map[Subscriber]int{sub1: 10, sub2: 5, sub3: 5, sub4: 10}, picked)
+
+	// Members with only a single matching pattern are the sole pick.
+	assert.Equal([]Subscriber{sub4}, mb.SubscribersForDelivery("x"))
+	for i := 0; i < 3; i++ {
+		delivery := mb.SubscribersForDelivery("a.b.c")
+		assert.Len(delivery, 2)
+		assert.Contains(delivery, sub3)
+	}
+
+	// A Subscriber which is also ungrouped is delivered to once.
+	mb.Subscribe("a.b", sub3)
+	for i := 0; i < 4; i++ {
+		delivery := mb.SubscribersForDelivery("a.b")
+		assert.Contains(delivery, sub3)
+		assert.True(len(delivery) == 3 || len(delivery) == 4)
+	}
+	mb.Unsubscribe("a.b", sub3)
+
+	mb.UnsubscribeGroup("workers", "a.*", sub2)
+	mb.UnsubscribeGroup("workers", "a.b", sub3)
+	mb.UnsubscribeGroup("audit", "#", sub4)
+	assert.Len(mb.SubscribersForDelivery("a.b"), 2)
+	mb.UnsubscribeGroup("workers", "a.#", sub3)
+	assert.Equal([]Subscriber{sub1}, mb.SubscribersForDelivery("a.b"))
+}
+
+func TestGroupStrategies(t *testing.T) {
+	assert := assert.New(t)
+	members := []Subscriber{subscriber("a"), subscriber("b"), subscriber("c")}
+
+	rr := NewRoundRobinStrategy()
+	assert.Equal(members[0], rr.Pick("g", "t", members))
+	assert.Equal(members[1], rr.Pick("g", "u", members))
+	assert.Equal(members[0], rr.Pick("h", "t", members))
+	assert.Equal(members[2], rr.Pick("g", "t", members))
+	assert.Equal(members[0], rr.Pick("g", "t", members))
+
+	random := NewRandomStrategy()
+	for i := 0; i < 10; i++ {
+		assert.Contains(members, random.Pick("g", "t", members))
+	}
+
+	// Consistent hashing picks the same member for a topic, and removing a
+	// member only moves the topics it was picked for.
+	hash := NewConsistentHashStrategy()
+	moved := 0
+	for i := 0; i < 100; i++ {
+		topic := strconv.Itoa(i)
+		picked := hash.Pick("g", topic, members)
+		assert.Equal(picked, hash.Pick("g", topic, members))
+		if picked != members[2] {
+			assert.Equal(picked, hash.Pick("g", topic, members[:2]))
+		} else {
+			moved++
+		}
+	}
+	assert.True(moved > 0 && moved < 100)
+
+	config := NewAMQPConfig()
+	config.GroupStrategy = hash
+	mb := New(config).(*matchbox)
+	for _, member := range members {
+		mb.SubscribeGroup("g", "#", member)
+	}
+	for i := 0; i < 10; i++ {
+		topic := strconv.Itoa(i)
+		assert.Equal([]Subscriber{hash.Pick("g", topic, members)}, mb.SubscribersForDelivery(topic))
+	}
+}
+
+func TestGroupIndex(t *testing.T) {
+	assert := assert.New(t)
+	strategy := NewRoundRobinStrategy()
+	config := NewAMQPConfig()
+	config.GroupStrategy = strategy
+	mb := New(config).(*matchbox)
+	index := mb.groups
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+
+	// Members are kept sorted as they join.
+	mb.SubscribeGroup("g", "a.*", sub3)
+	mb.SubscribeGroup("g", "a.*", sub1)
+	mb.SubscribeGroup("g", "a.b", sub1)
+	mb.SubscribeGroup("g", "a.b", sub2)
+	mb.SubscribeGroup("g", "a.b", sub2)
+	assert.Equal([]Subscriber{sub1, sub2, sub3}, index.groups["g"].sorted)
+	assert.Equal([]Subscriber{sub1, sub3}, index.members("g", []Subscriber{sub3, sub1}))
+	assert.Equal([]Subscriber{sub1, sub2, sub3},
+		index.members("g", []Subscriber{sub3, sub1, sub2, sub1}))
+	assert.Equal([]Subscriber{sub1}, mb.SubscribersForDelivery("a.c"))
+	_, ok := strategy.(*roundRobinStrategy).counters.Load("g")
+	assert.True(ok)
+
+	// Members leave once they are unsubscribed from every pattern, and the
+	// group's counter is dropped once it has no members.
+	mb.UnsubscribeGroup("g", "a.*", sub1)
+	assert.Equal([]Subscriber{sub1, sub2, sub3}, index.groups["g"].sorted)
+	mb.UnsubscribeGroup("g", "a.b", sub1)
+	mb.UnsubscribeGroup("g", "a.b", sub1)
+	assert.Equal([]Subscriber{sub2, sub3}, index.groups["g"].sorted)
+	assert.Nil(mb.Apply([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.b", Subscriber: sub2, Group: "g"},
+		{Kind: ChangeSubscribe, Topic: "a.c", Subscriber: sub1, Group: "h"},
+	}))
+	assert.Equal([]Subscriber{sub1}, index.groups["h"].sorted)
+	mb.UnsubscribeGroup("g", "a.*", sub3)
+	assert.NotContains(index.groups, "g")
+	_, ok = strategy.(*roundRobinStrategy).counters.Load("g")
+	assert.False(ok)
+
+	// Members missing from the index are sorted.
+	assert.Equal([]Subscriber{sub1, sub2}, index.members("x", []Subscriber{sub2, sub1}))
+}
+
+func TestSubscribeGroupConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	mb.SubscribeGroup("g", "a.*", subscriber("x"))
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			mb.SubscribeGroup("g", "a."+strconv.Itoa(i), subscriber(strconv.Itoa(i)))
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			assert.Len(mb.SubscribersForDelivery("a."+strconv.Itoa(i)), 1)
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// headersPrefix is the prefix of headers which are ignored for matching.
+const headersPrefix = "x-"
+
+// emptyHeadersWords is the path of bindings without any headers to match. As
+// a single word, it never collides with the key and value of a header.
+var emptyHeadersWords = []string{headersPrefix}
+
+// XMatch determines how many of a binding's headers must match a message.
+type XMatch int
+
+const (
+	// XMatchAll requires every header of the binding to match.
+	XMatchAll XMatch = iota
+
+	// XMatchAny requires at least one header of the binding to match.
+	XMatchAny
+)
+
+// HeadersMatcher handles header-based subscription logic in the style of an
+// AMQP headers exchange. Subscribers are bound to sets of header key/value
+// pairs, and a binding value equal to the Config's SingleWildcard matches any
+// value for the key. Any other key or value is literal, even if it contains
+// the delimiter or looks like another wildcard. Headers prefixed with "x-" are
+// ignored for matching, so a binding without any other headers matches every
+// message with XMatchAll and none with XMatchAny.
+type HeadersMatcher interface {
+	// Bind a Subscriber to a set of headers. All of the headers are bound at
+	// once, so messages are matched against either none or all of them.
+	// ErrQuotaExceeded is returned, and none are bound, if they would exceed
+	// the Config's Limits, as is ErrContended if other bindings kept changing
+	// while they were being bound.
+	Bind(headers map[string]string, match XMatch, subscriber Subscriber) error
+
+	// Unbind a Subscriber from a set of headers. All of the headers are
+	// unbound at once, unless other bindings keep changing while they are
+	// being unbound, in which case they are unbound one at a time.
+	Unbind(headers map[string]string, match XMatch, subscriber Subscriber)
+
+	// Subscribers returns the Subscribers bound to headers which match the
+	// given message headers.
+	Subscribers(headers map[string]string) []Subscriber
+}
+
+// headersBinding is the Subscriber stored in the ctrie for each header of a
+// binding.
+type headersBinding struct {
+	id         string
+	match      XMatch
+	headers    int
+	subscriber Subscriber
+}
+
+// newHeadersBinding creates a binding of the Subscriber to the headers. The
+// binding's ID is derived from all of its parts, so binding the same headers
+// again yields an equal ID.
+func newHeadersBinding(headers map[string]string, match XMatch, sub Subscriber) *headersBinding {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		if !strings.HasPrefix(key, headersPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, 2*len(keys)+2)
+	parts = append(parts, strconv.Itoa(int(match)), strconv.Quote(sub.ID()))
+	for _, key := range keys {
+		parts = append(parts, strconv.Quote(key), strconv.Quote(headers[key]))
+	}
+	return &headersBinding{
+		id:         strings.Join(parts, " "),
+		match:      match,
+		headers:    len(keys),
+		subscriber: sub,
+	}
+}
+
+// ID returns the binding's ID.
+func (b *headersBinding) ID() string {
+	return b.id
+}
+
+// headersMatcher implements the HeadersMatcher interface using a backing
+// concurrent trie in which each binding is inserted once per header, keyed on
+// the header's key and value.
+type headersMatcher struct {
+	*ctrie
+}
+
+// NewHeadersMatcher creates a new HeadersMatcher with the given Config. If the
+// Config doesn't enable escaping, the HeadersMatcher escapes with `\` so the
+// literal keys and values of headers are kept apart from wildcards.
+func NewHeadersMatcher(config *Config) HeadersMatcher {
+	if config.Escape == "" {
+		escaping := *config
+		escaping.Escape = `\`
+		config = &escaping
+	}
+	ctrie := newCtrie(config)
+	ctrie.limiter = newLimiter(config.Limits)
+	return &headersMatcher{ctrie}
+}
+
+// headerKeys returns the ctrie keys for a header of a binding. The key and
+// value are literal, except for a value equal to the SingleWildcard.
+func (h *headersMatcher) headerKeys(key, value string) []string {
+	keys := h.config.wordKeys([]string{key, value}, true)
+	if value == h.config.SingleWildcard {
+		keys[1] = value
+	}
+	return keys
+}
+
+// Bind a Subscriber to a set of headers.
+func (h *headersMatcher) Bind(headers map[string]string, match XMatch, subscriber Subscriber) error {
+	binding := newHeadersBinding(headers, match, subscriber)
+	if binding.headers == 0 {
+		if match == XMatchAll {
+			return h.insert(emptyHeadersWords, binding, "", false)
+		}
+		return nil
+	}
+	return h.transact(func(staged *ctrie) error {
+		for key, value := range headers {
+			if strings.HasPrefix(key, headersPrefix) {
+				continue
+			}
+			if err := staged.insert(h.headerKeys(key, value), binding, "", false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Unbind a Subscriber from a set of headers.
+func (h *headersMatcher) Unbind(headers map[string]string, match XMatch, subscriber Subscriber) {
+	binding := newHeadersBinding(headers, match, subscriber)
+	if binding.headers == 0 {
+		h.remove(emptyHeadersWords, binding)
+		return
+	}
+	unbind := func(c *ctrie) error {
+		for key, value := range headers {
+			if !strings.HasPrefix(key, headersPrefix) {
+				c.remove(h.headerKeys(key, value), binding)
+			}
+		}
+		return nil
+	}
+	if h.transact(unbind) == ErrContended {
+		unbind(h.ctrie)
+	}
+}
+
+// Subscribers returns the Subscribers bound to headers which match the given
+// message headers. Every header is looked up in the same read-only snapshot.
+func (h *headersMatcher) Subscribers(headers map[string]string) []Subscriber {
+	var (
+		snapshot = h.ReadOnlySnapshot()
+		bindings = map[string]*headersBinding{}
+		matched  = map[string]int{}
+	)
+	for _, sub := range snapshot.LookupWords(emptyHeadersWords) {
+		binding := sub.(*headersBinding)
+		bindings[binding.id] = binding
+	}
+	for key, value := range headers {
+		if strings.HasPrefix(key, headersPrefix) {
+			continue
+		}
+		for _, sub := range snapshot.LookupWords([]string{key, value}) {
+			binding := sub.(*headersBinding)
+			bindings[binding.id] = binding
+			matched[binding.id]++
+		}
+	}
+	subs := map[string]Subscriber{}
+	for id, binding := range bindings {
+		if binding.match == XMatchAny || matched[id] == binding.headers {
+			subs[binding.subscriber.ID()] = binding.subscriber
+		}
+	}
+	s := make([]Subscriber, 0, len(subs))
+	for _, sub := range subs {
+		s = append(s, sub)
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadersMatcher(t *testing.T) {
+	assert := assert.New(t)
+	hm := NewHeadersMatcher(NewAMQPConfig())
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"format": "pdf"}))
+
+	hm.Bind(map[string]string{"format": "pdf", "type": "report"}, XMatchAll, sub1)
+	hm.Bind(map[string]string{"format": "pdf", "type": "log"}, XMatchAny, sub2)
+	hm.Bind(map[string]string{"format": "*", "x-match": "all"}, XMatchAll, sub3)
+
+	subscribers := hm.Subscribers(map[string]string{"format": "pdf", "type": "report"})
+	assert.Len(subscribers, 3)
+	assert.Contains(subscribers, sub1)
+	assert.Contains(subscribers, sub2)
+	assert.Contains(subscribers, sub3)
+
+	subscribers = hm.Subscribers(map[string]string{"format": "pdf"})
+	assert.Len(subscribers, 2)
+	assert.Contains(subscribers, sub2)
+	assert.Contains(subscribers, sub3)
+
+	assert.Equal([]Subscriber{sub2}, hm.Subscribers(map[string]string{"type": "log"}))
+	assert.Equal([]Subscriber{sub3}, hm.Subscribers(map[string]string{"format": "zip"}))
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"x-format": "pdf"}))
+
+	// Binding the same headers again is idempotent.
+	hm.Bind(map[string]string{"format": "pdf", "type": "report"}, XMatchAll, sub1)
+	hm.Unbind(map[string]string{"format": "pdf", "type": "report"}, XMatchAll, sub1)
+	subscribers = hm.Subscribers(map[string]string{"format": "pdf", "type": "report"})
+	assert.Len(subscribers, 2)
+	assert.NotContains(subscribers, sub1)
+
+	// Unbinding requires the same headers and x-match.
+	hm.Unbind(map[string]string{"format": "pdf"}, XMatchAny, sub2)
+	hm.Unbind(map[string]string{"format": "pdf", "type": "log"}, XMatchAll, sub2)
+	assert.Equal([]Subscriber{sub2}, hm.Subscribers(map[string]string{"type": "log"}))
+	hm.Unbind(map[string]string{"format": "pdf", "type": "log"}, XMatchAny, sub2)
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"type": "log"}))
+
+	// A Subscriber may have several bindings but is returned once.
+	hm.Bind(map[string]string{"type": "log"}, XMatchAll, sub3)
+	assert.Equal([]Subscriber{sub3}, hm.Subscribers(map[string]string{"format": "a", "type": "log"}))
+
+	// Keys and values may contain the delimiter.
+	hm.Bind(map[string]string{"a.b": "c.d"}, XMatchAll, sub1)
+	assert.Equal([]Subscriber{sub1}, hm.Subscribers(map[string]string{"a.b": "c.d"}))
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"a": "b.c.d"}))
+
+	// Keys and values other than the single wildcard value are literal.
+	assert.Nil(hm.Bind(map[string]string{"#": "#", "level": "{1,2}"}, XMatchAny, sub2))
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"#": "a"}))
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"*": "#"}))
+	assert.Equal([]Subscriber{sub2}, hm.Subscribers(map[string]string{"#": "#"}))
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"level": "a"}))
+	assert.Equal([]Subscriber{sub2}, hm.Subscribers(map[string]string{"level": "{1,2}"}))
+
+	// Bindings without any headers but "x-" headers match every message with
+	// XMatchAll and none with XMatchAny.
+	hm = NewHeadersMatcher(NewAMQPConfig())
+	hm.Bind(map[string]string{"x-match": "all"}, XMatchAll, sub1)
+	hm.Bind(map[string]string{"x-match": "any"}, XMatchAny, sub2)
+	assert.Equal([]Subscriber{sub1}, hm.Subscribers(map[string]string{"format": "pdf"}))
+	assert.Equal([]Subscriber{sub1}, hm.Subscribers(map[string]string{}))
+	hm.Unbind(map[string]string{"x-match": "all"}, XMatchAll, sub1)
+	assert.Equal([]Subscriber{}, hm.Subscribers(map[string]string{"format": "pdf"}))
+}
+
+func TestHeadersMatcherBindAtomically(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 2}
+	hm := NewHeadersMatcher(config)
+	sub := subscriber("abc")
+
+	// Each header of a binding counts as a pattern of its own.
+	headers := map[string]string{"a": "1", "b": "2", "c": "3"}
+	assert.Equal(ErrQuotaExceeded, hm.Bind(headers, XMatchAny, sub))
+	assert.Equal([]Subscriber{}, hm.Subscribers(headers))
+	assert.Nil(hm.Bind(map[string]string{"a": "1", "b": "2"}, XMatchAny, sub))
+	assert.Equal([]Subscriber{sub}, hm.Subscribers(map[string]string{"b": "2"}))
+	hm.Unbind(map[string]string{"a": "1", "b": "2"}, XMatchAny, sub)
+	assert.Equal([]Subscriber{}, hm.Subscribers(headers))
+}
+
+func TestHeadersMatcherConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	hm := NewHeadersMatcher(NewAMQPConfig())
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			hm.Bind(map[string]string{"a": strconv.Itoa(i), "b": "x"}, XMatchAll, subscriber(strconv.Itoa(i)))
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			// An XMatchAll binding is never matched half-inserted since it
+			// must match every header looked up in the same snapshot.
+			val := hm.Subscribers(map[string]string{"a": strconv.Itoa(i), "b": "x"})
+			if len(val) > 0 {
+				assert.Equal([]Subscriber{subscriber(strconv.Itoa(i))}, val)
+			}
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"hash/maphash"
+	"strings"
+	"sync"
+)
+
+// internerShards is the number of shards an Interner's words are spread
+// across, each with its own lock, so writers interning different words rarely
+// contend.
+const internerShards = 32
+
+// internedWord is the shared copy of a word and the number of branches keyed
+// on it.
+type internedWord struct {
+	word string
+	refs int
+}
+
+// Interner shares the storage of identical words across the branches of a
+// trie, which otherwise each keep their own copy of their word along with the
+// pattern it was split from. A word is evicted once no branch is keyed on it.
+// Every subscribe and unsubscribe locks the shard of each of its words, which
+// writers of the same words contend on. An Interner may be shared by the
+// Configs of several Matchboxes. It is safe for concurrent use.
+//
+// References are counted for the tries of the Matchboxes only. Writable
+// snapshots and Changes being applied share the words but count their own
+// references, which Changes take once they are made.
+type Interner struct {
+	seed   maphash.Seed
+	shards [internerShards]internerShard
+
+	// base is the Interner this one stages references for, if any, in which
+	// case references are counted relative to it and its words are shared.
+	base *Interner
+}
+
+// internerShard holds the words of an Interner which hash to it.
+type internerShard struct {
+	mu    sync.Mutex
+	words map[string]internedWord
+	bytes int
+}
+
+// NewInterner creates a new, empty Interner.
+func NewInterner() *Interner {
+	return newInterner(nil)
+}
+
+// newInterner creates an Interner staging references for the base, if any.
+func newInterner(base *Interner) *Interner {
+	in := &Interner{seed: maphash.MakeSeed(), base: base}
+	for i := range in.shards {
+		in.shards[i].words = map[string]internedWord{}
+	}
+	return in
+}
+
+// Len returns the number of distinct words interned.
+func (in *Interner) Len() int {
+	if in == nil {
+		return 0
+	}
+	n := 0
+	for i := range in.shards {
+		shard := &in.shards[i]
+		shard.mu.Lock()
+		n += len(shard.words)
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// Bytes returns the total length of the distinct words interned.
+func (in *Interner) Bytes() int {
+	if in == nil {
+		return 0
+	}
+	n := 0
+	for i := range in.shards {
+		shard := &in.shards[i]
+		shard.mu.Lock()
+		n += shard.bytes
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// staged returns an Interner which stages references to the Interner's words
+// without taking them, so they can be committed once the trie taking them is.
+// It returns nil if the Interner is nil.
+func (in *Interner) staged() *Interner {
+	if in == nil {
+		return nil
+	}
+	return newInterner(in)
+}
+
+// shard returns the shard of the word, locked.
+func (in *Interner) shard(word string) *internerShard {
+	shard := &in.shards[maphash.String(in.seed, word)%internerShards]
+	shard.mu.Lock()
+	return shard
+}
+
+// shared returns the shared copy of the word, if it is interned.
+func (in *Interner) shared(word string) (string, bool) {
+	if in == nil {
+		return "", false
+	}
+	shard := in.shard(word)
+	defer shard.mu.Unlock()
+	w, ok := shard.words[word]
+	return w.word, ok
+}
+
+// intern returns a copy of the key path with each word replaced by its shared
+// copy, taking a reference to each. The key path is returned as it is if the
+// Interner is nil.
+func (in *Interner) intern(keys []string) []string {
+	if in == nil {
+		return keys
+	}
+	interned := make([]string, len(keys))
+	for i, key := range keys {
+		shard := in.shard(key)
+		interned[i] = in.add(shard, key, 1)
+		shard.mu.Unlock()
+	}
+	return interned
+}
+
+// add adds n references to the word in its locked shard and returns its shared
+// copy.
+func (in *Interner) add(shard *internerShard, word string, n int) string {
+	w, ok := shard.words[word]
+	if !ok {
+		if w.word, ok = in.base.shared(word); !ok {
+			// Copy the word so it doesn't keep the pattern it was split from.
+			w.word = strings.Clone(word)
+		}
+		shard.bytes += len(word)
+	}
+	if w.refs += n; w.refs == 0 && in.base != nil {
+		// A staged Interner forgets words whose references cancel out.
+		delete(shard.words, word)
+		shard.bytes -= len(word)
+		return w.word
+	}
+	shard.words[w.word] = w
+	return w.word
+}
+
+// release releases a reference to each of the words, evicting those which are
+// no longer referenced. It does nothing if the Interner is nil.
+func (in *Interner) release(words ...string) {
+	if in == nil {
+		return
+	}
+	for _, word := range words {
+		shard := in.shard(word)
+		in.drop(shard, word, 1)
+		shard.mu.Unlock()
+	}
+}
+
+// drop releases n references to the word in its locked shard, evicting it if
+// it's no longer referenced. A staged Interner counts the references released
+// from its base.
+func (in *Interner) drop(shard *internerShard, word string, n int) {
+	if in.base != nil {
+		in.add(shard, word, -n)
+		return
+	}
+	w, ok := shard.words[word]
+	if !ok {
+		return
+	}
+	if w.refs -= n; w.refs > 0 {
+		shard.words[word] = w
+		return
+	}
+	delete(shard.words, word)
+	shard.bytes -= len(word)
+}
+
+// commit takes the references staged by an Interner staged from this one.
+// It does nothing if the Interner is nil.
+func (in *Interner) commit(staged *Interner) {
+	if in == nil {
+		return
+	}
+	for i := range staged.shards {
+		stagedShard := &staged.shards[i]
+		stagedShard.mu.Lock()
+		for _, w := range stagedShard.words {
+			shard := in.shard(w.word)
+			if w.refs > 0 {
+				in.add(shard, w.word, w.refs)
+			} else {
+				in.drop(shard, w.word, -w.refs)
+			}
+			shard.mu.Unlock()
+		}
+		stagedShard.mu.Unlock()
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterner(t *testing.T) {
+	assert := assert.New(t)
+	in := NewInterner()
+	topic := "foo.bar.foo"
+	keys := in.intern([]string{topic[:3], topic[4:7], topic[8:]})
+	assert.Equal([]string{"foo", "bar", "foo"}, keys)
+	assert.True(unsafe.StringData(keys[0]) == unsafe.StringData(keys[2]))
+	assert.False(unsafe.StringData(keys[0]) == unsafe.StringData(topic))
+	assert.Equal(2, in.Len())
+	assert.Equal(6, in.Bytes())
+
+	in.release("foo", "bar")
+	assert.Equal(1, in.Len())
+	in.release("foo", "baz")
+	assert.Equal(0, in.Len())
+	assert.Equal(0, in.Bytes())
+
+	var none *Interner
+	assert.Equal([]string{"foo"}, none.intern([]string{"foo"}))
+	none.release("foo")
+	assert.Equal(0, none.Len())
+}
+
+func TestInternedMatchbox(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Interner = NewInterner()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 3}
+	mb := New(config).(*matchbox)
+	sub := subscriber("abc")
+	assert.Nil(mb.TrySubscribe("a.b.c", sub))
+	assert.Nil(mb.TrySubscribe("a.b.d", sub))
+	assert.Nil(mb.TrySubscribe("x.b", sub))
+	assert.Nil(mb.TrySubscribe("x.b", sub))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("y.b", sub))
+	assert.Equal(5, config.Interner.Len())
+	assert.Equal([]Subscriber{sub}, mb.Subscribers("a.b.c"))
+
+	// Branches keyed on the same word share its storage.
+	root := gcasRead(mb.root, mb.ctrie).cNode
+	var words []string
+	for _, key := range []string{"a", "x"} {
+		for word := range gcasRead(root.branches[key].iNode, mb.ctrie).cNode.branches {
+			words = append(words, word)
+		}
+	}
+	assert.Equal([]string{"b", "b"}, words)
+	assert.True(unsafe.StringData(words[0]) == unsafe.StringData(words[1]))
+
+	stats := mb.Stats()
+	assert.Equal(5, stats.InternedWords)
+	assert.Equal(5, stats.InternedBytes)
+
+	// Words are evicted once no branch is keyed on them.
+	mb.Unsubscribe("a.b.c", sub)
+	assert.Equal(4, config.Interner.Len())
+	assert.Equal(trieWords(mb), config.Interner.Len())
+	mb.Unsubscribe("a.b.d", sub)
+	mb.Unsubscribe("x.b", sub)
+	assert.Equal(trieWords(mb), config.Interner.Len())
+}
+
+func TestInternedMatchboxConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Interner = NewInterner()
+	mb := New(config)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			sub := subscriber(strconv.Itoa(w))
+			for i := 0; i < 500; i++ {
+				topic := strconv.Itoa(i%5) + "." + strconv.Itoa(i%7) + "." + strconv.Itoa(i%3)
+				if (i+w)%3 == 0 {
+					mb.Unsubscribe(topic, sub)
+				} else {
+					mb.Subscribe(topic, sub)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(trieWords(mb), config.Interner.Len())
+}
+
+func TestInternedApply(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Interner = NewInterner()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 2}
+	mb := New(config).(*matchbox)
+	sub := subscriber("abc")
+	assert.Nil(mb.TrySubscribe("a.b", sub))
+	assert.Equal(2, config.Interner.Len())
+
+	// Changes which aren't made take no references and release none.
+	assert.Equal(ErrQuotaExceeded, mb.Apply([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.b", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "c.d", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "e.f", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "g.h", Subscriber: sub},
+	}))
+	assert.Equal(2, config.Interner.Len())
+	assert.Equal([]Subscriber{sub}, mb.Subscribers("a.b"))
+
+	assert.Nil(mb.Apply([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a.b", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "a.c", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "b.b", Subscriber: sub},
+	}))
+	assert.Equal(trieWords(mb), config.Interner.Len())
+	mb.Unsubscribe("a.c", sub)
+	mb.Unsubscribe("b.b", sub)
+	assert.Equal(0, config.Interner.Len())
+	assert.Equal(0, config.Interner.Bytes())
+}
+
+func TestInternedSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Interner = NewInterner()
+	mb := New(config).(*matchbox)
+	sub := subscriber("abc")
+	assert.Nil(mb.TrySubscribe("a.b", sub))
+
+	// A writable snapshot shares the words but not their references.
+	snapshot := mb.Snapshot()
+	snapshot.Remove("a.b", sub)
+	assert.Nil(snapshot.Insert("a.c", sub))
+	assert.Nil(snapshot.Insert("d", sub))
+	assert.Equal(2, config.Interner.Len())
+	assert.Equal(trieWords(mb), config.Interner.Len())
+	assert.Equal([]Subscriber{sub}, mb.Subscribers("a.b"))
+
+	// The Matchbox's references are its own, too.
+	mb.Unsubscribe("a.b", sub)
+	assert.Equal(trieWords(mb), config.Interner.Len())
+	assert.Equal([]Subscriber{sub}, snapshot.Lookup("a.c"))
+}
+
+func TestInternerShared(t *testing.T) {
+	assert := assert.New(t)
+	interner := NewInterner()
+	a, b := NewAMQPConfig(), NewAMQPConfig()
+	a.Interner, b.Interner = interner, interner
+	mbA, mbB := New(a).(*matchbox), New(b).(*matchbox)
+	sub := subscriber("abc")
+	assert.Nil(mbA.TrySubscribe("x.y", sub))
+	assert.Nil(mbB.TrySubscribe("x.z", sub))
+	assert.Equal(3, interner.Len())
+	mbA.Unsubscribe("x.y", sub)
+	assert.Equal(2, interner.Len())
+	assert.Equal([]Subscriber{sub}, mbB.Subscribers("x.z"))
+}
+
+// trieWords returns the number of distinct words keying the branches of the
+// Matchbox's trie.
+func trieWords(mb Matchbox) int {
+	c := mb.(*matchbox).ReadOnlySnapshot()
+	words := map[string]bool{}
+	var walk func(in *iNode)
+	walk = func(in *iNode) {
+		main := gcasRead(in, c)
+		if main.cNode == nil {
+			return
+		}
+		for key, br := range main.cNode.branches {
+			words[key] = true
+			if br.iNode != nil {
+				walk(br.iNode)
+			}
+		}
+	}
+	walk(c.root)
+	return len(words)
+}
@@ -21,12 +21,42 @@ AMQP-compliant implementation.
 */
 package matchbox
 
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
 const (
 	amqpSingleWildcard     = "*"
 	amqpZeroOrMoreWildcard = "#"
 	amqpDelimiter          = "."
 )
 
+// MaxRangeWords is the greatest number of words a ranged wildcard can match.
+// Automata built from patterns unroll ranged wildcards into a state per word,
+// so subscribing to a pattern with a greater bound returns ErrRangeTooLarge.
+const MaxRangeWords = 255
+
+// ErrNoWords is returned when subscribing to a pre-tokenized topic without
+// any words.
+var ErrNoWords = errors.New("matchbox: topic has no words")
+
+// ErrRangeTooLarge is returned when subscribing to a pattern with a ranged
+// wildcard which matches more than MaxRangeWords words.
+var ErrRangeTooLarge = errors.New("matchbox: ranged wildcard matches too many words")
+
+// ErrContended is returned when Changes can't be made atomically because the
+// trie kept being modified while they were being made.
+var ErrContended = errors.New("matchbox: too much contention to make changes atomically")
+
+// ErrUnsupported is returned by wrappers of a Matchbox when it doesn't
+// support an operation.
+var ErrUnsupported = errors.New("matchbox: operation not supported")
+
 // Subscriber is the value associated with a topic subscription.
 type Subscriber interface {
 	// ID returns a string which uniquely identifies the Subscriber.
@@ -50,10 +80,166 @@ type Config struct {
 	// Delimiter is ".", "foo.bar.baz" consists of the words "foo", "bar", and
 	// "baz".
 	Delimiter string
+
+	// RangeWildcardOpen and RangeWildcardClose enclose a ranged wildcard which
+	// matches between N and M words. For example, if they are "{" and "}",
+	// "foo.{1,3}.baz" matches "foo.bar.baz" and "foo.a.b.c.baz" but not
+	// "foo.baz". "{N}" is shorthand for "{N,N}". Ranged wildcards are
+	// disabled if either is empty.
+	RangeWildcardOpen  string
+	RangeWildcardClose string
+
+	// FoldCase enables case-insensitive matching. Words are case folded on
+	// both subscription and lookup, so "PRICE.stock" matches "price.STOCK".
+	FoldCase bool
+
+	// Normalization is the Unicode normalization form applied to words on
+	// both subscription and lookup. Words are not normalized by default.
+	Normalization Normalization
+
+	// RefCount enables reference-counted subscriptions. Subscribing the same
+	// Subscriber to a topic again increments a count rather than being a
+	// no-op, and it is only unsubscribed once every reference is released.
+	RefCount bool
+
+	// Limits bounds the subscriptions of a Matchbox. A subscription which
+	// would exceed them is dropped, and TrySubscribe returns
+	// ErrQuotaExceeded.
+	Limits Limits
+
+	// Metrics receives counters and histograms measuring operations. Metrics
+	// are disabled by default.
+	Metrics Metrics
+
+	// GroupStrategy picks the member of a shared subscription group which
+	// receives a message. Defaults to round robin.
+	GroupStrategy GroupStrategy
+
+	// Escape is the sequence which causes the following delimiter, escape or
+	// character to be taken literally. For example, if Escape is `\`,
+	// `foo.\*.b\.z` consists of the words "foo", a literal "*" which is not a
+	// wildcard, and "b.z". When escaping is enabled, every word of a topic
+	// being looked up is literal. Escaping is disabled if Escape is empty.
+	Escape string
+
+	// Interner, if set, shares the storage of identical words across the
+	// trie's branches, which saves memory when many patterns have words in
+	// common. Subscribing and unsubscribing lock the Interner's shard of each
+	// word, so writers of common words contend. Words are not interned by
+	// default.
+	Interner *Interner
+
+	// BatchWorkers is the number of goroutines SubscribersBatch splits large
+	// batches of topics across. Batches are looked up on the calling
+	// goroutine by default.
+	BatchWorkers int
+}
+
+// Normalization is a Unicode normalization form applied to words.
+type Normalization int
+
+const (
+	// NormalizeNone leaves words as they are.
+	NormalizeNone Normalization = iota
+
+	// NormalizeNFC applies canonical composition, e.g. "e\u0301" becomes
+	// "\u00e9".
+	NormalizeNFC
+
+	// NormalizeNFKC applies compatibility composition, e.g. "\ufb01" becomes
+	// "fi" in addition to canonical composition.
+	NormalizeNFKC
+)
+
+// normalizes indicates if words are case folded or Unicode normalized.
+func (c *Config) normalizes() bool {
+	return c.FoldCase || c.Normalization != NormalizeNone
+}
+
+// normalize case folds and Unicode normalizes the word according to the
+// Config.
+func (c *Config) normalize(word string) string {
+	if c.FoldCase {
+		word = cases.Fold().String(word)
+	}
+	switch c.Normalization {
+	case NormalizeNFC:
+		word = norm.NFC.String(word)
+	case NormalizeNFKC:
+		word = norm.NFKC.String(word)
+	}
+	return word
+}
+
+// wordRange is the parsed form of a ranged wildcard, matching between min and
+// max words inclusive.
+type wordRange struct {
+	min, max int
+}
+
+// parseRange returns the bounds of the ranged wildcard and true if the word is
+// a ranged wildcard, false otherwise.
+func (c *Config) parseRange(word string) (wordRange, bool) {
+	bounds, ok := c.parseBounds(word)
+	return bounds, ok && bounds.max <= MaxRangeWords
+}
+
+// oversizedRange indicates if the word would be a ranged wildcard but for
+// matching more than MaxRangeWords words.
+func (c *Config) oversizedRange(word string) bool {
+	bounds, ok := c.parseBounds(word)
+	return ok && bounds.max > MaxRangeWords
+}
+
+// checkRanges returns ErrRangeTooLarge if any of the pattern keys is an
+// oversized ranged wildcard.
+func (c *Config) checkRanges(keys []string) error {
+	for _, key := range keys {
+		if c.oversizedRange(key) {
+			return ErrRangeTooLarge
+		}
+	}
+	return nil
+}
+
+// parseBounds returns the bounds of the word and true if it has the form of
+// a ranged wildcard, however many words it matches.
+func (c *Config) parseBounds(word string) (wordRange, bool) {
+	if c.RangeWildcardOpen == "" || c.RangeWildcardClose == "" ||
+		len(word) < len(c.RangeWildcardOpen)+len(c.RangeWildcardClose)+1 ||
+		word[:len(c.RangeWildcardOpen)] != c.RangeWildcardOpen ||
+		word[len(word)-len(c.RangeWildcardClose):] != c.RangeWildcardClose {
+		return wordRange{}, false
+	}
+	bounds := word[len(c.RangeWildcardOpen) : len(word)-len(c.RangeWildcardClose)]
+	lower, upper := bounds, bounds
+	for i := 0; i < len(bounds); i++ {
+		if bounds[i] == ',' {
+			lower, upper = bounds[:i], bounds[i+1:]
+			break
+		}
+	}
+	min, err := strconv.Atoi(lower)
+	if err != nil || min < 0 {
+		return wordRange{}, false
+	}
+	max, err := strconv.Atoi(upper)
+	if err != nil || max < min || max == 0 {
+		return wordRange{}, false
+	}
+	return wordRange{min: min, max: max}, true
+}
+
+// formatRange returns the canonical word for the ranged wildcard.
+func (c *Config) formatRange(r wordRange) string {
+	return c.RangeWildcardOpen + strconv.Itoa(r.min) + "," + strconv.Itoa(r.max) +
+		c.RangeWildcardClose
 }
 
 // reduceZeroOrMoreWildcards reduces sequences of zero-or-more wildcards,
-// e.g. if zero-or-more wildcard is #, a.#.#.#.b reduces to a.#.b.
+// e.g. if zero-or-more wildcard is #, a.#.#.#.b reduces to a.#.b. Adjacent
+// ranged wildcards are merged, e.g. a.{1,2}.{0,3}.b reduces to a.{1,5}.b,
+// unless they would match more than MaxRangeWords words together.
 func (c *Config) reduceZeroOrMoreWildcards(words []string) []string {
 	reduced := make([]string, 0, len(words))
 	for i, word := range words {
@@ -61,6 +247,16 @@ func (c *Config) reduceZeroOrMoreWildcards(words []string) []string {
 			i+1 < len(words) && words[i+1] == c.ZeroOrMoreWildcard {
 			continue
 		}
+		if r, ok := c.parseRange(word); ok {
+			if n := len(reduced); n > 0 {
+				if prev, ok := c.parseRange(reduced[n-1]); ok && prev.max+r.max <= MaxRangeWords {
+					reduced[n-1] = c.formatRange(
+						wordRange{min: prev.min + r.min, max: prev.max + r.max})
+					continue
+				}
+			}
+			word = c.formatRange(r)
+		}
 		reduced = append(reduced, word)
 	}
 	return reduced
@@ -80,7 +276,9 @@ func NewAMQPConfig() *Config {
 // Matchbox handles topic subscription logic, including adding, removing, and
 // performing lookups.
 type Matchbox interface {
-	// Subscribe a Subscriber to a topic.
+	// Subscribe a Subscriber to a topic. A subscription which can't be made,
+	// e.g. because it would exceed the Config's Limits, is dropped; use
+	// TrySubscribe to find out why.
 	Subscribe(topic string, subscriber Subscriber)
 
 	// Unsubscribe a Subscriber from a topic.
@@ -89,21 +287,177 @@ type Matchbox interface {
 	// Subscribers returns the Subscribers for a topic.
 	Subscribers(topic string) []Subscriber
 
-	// Subscriptions returns a map of topics to Subscribers.
+	// Subscriptions returns a map of topics to Subscribers. Topics are
+	// reported as they were subscribed, even if the Config normalizes them.
 	Subscriptions() map[string][]Subscriber
 
-	// Topics returns all of the currently contained topics.
+	// Topics returns all of the currently contained topics. Subscribed
+	// patterns are reported as they were subscribed, even if the Config
+	// normalizes them.
 	Topics() []string
 }
 
+// The Matchboxes returned by New implement each of the following interfaces
+// besides Matchbox. Wrappers implement those they support, so assert them to
+// use a capability.
+
+// TrySubscriber is a Matchbox which reports why it didn't make a
+// subscription.
+type TrySubscriber interface {
+	// TrySubscribe subscribes a Subscriber to a topic like Subscribe.
+	// ErrQuotaExceeded is returned if the subscription would exceed the
+	// Config's Limits, ErrRangeTooLarge if the topic has a ranged wildcard
+	// matching more than MaxRangeWords words.
+	TrySubscribe(topic string, subscriber Subscriber) error
+}
+
+// WordMatchbox is a Matchbox which can be used with pre-tokenized topics and
+// topics held in byte slices.
+type WordMatchbox interface {
+	// SubscribeWords subscribes a Subscriber to a pre-tokenized topic. Words
+	// equal to a wildcard are wildcards, any other word is literal and may
+	// contain arbitrary bytes, including the delimiter. ErrNoWords is
+	// returned if there are no words, ErrRangeTooLarge if a word is a ranged
+	// wildcard matching more than MaxRangeWords words.
+	SubscribeWords(words []string, subscriber Subscriber) error
+
+	// UnsubscribeWords unsubscribes a Subscriber from a pre-tokenized topic.
+	UnsubscribeWords(words []string, subscriber Subscriber)
+
+	// SubscribersWords returns the Subscribers for a pre-tokenized topic.
+	// Every word is literal. A topic without any words has no Subscribers.
+	SubscribersWords(words []string) []Subscriber
+
+	// SubscribersBytes returns the Subscribers for a topic.
+	SubscribersBytes(topic []byte) []Subscriber
+}
+
+// BatchMatchbox is a Matchbox which looks up many topics at once.
+type BatchMatchbox interface {
+	// SubscribersBatch returns the Subscribers for each of the topics, in
+	// order, looked up from a single read-only snapshot.
+	SubscribersBatch(topics []string) [][]Subscriber
+}
+
+// RefCounter is a Matchbox which counts references to subscriptions.
+type RefCounter interface {
+	// RefCount returns the number of times the Subscriber with the given ID
+	// is subscribed to a topic, which is at most one unless the Config counts
+	// references.
+	RefCount(topic, id string) int
+}
+
+// GroupMatchbox is a Matchbox with shared subscription groups.
+type GroupMatchbox interface {
+	// SubscribeGroup subscribes a Subscriber to a topic as a member of a
+	// shared subscription group.
+	SubscribeGroup(group, topic string, subscriber Subscriber) error
+
+	// UnsubscribeGroup unsubscribes a member of a shared subscription group
+	// from a topic.
+	UnsubscribeGroup(group, topic string, subscriber Subscriber)
+
+	// SubscribersForDelivery returns the Subscribers which should receive a
+	// message published to a topic: every ungrouped Subscriber plus one
+	// member of each shared subscription group, picked by the Config's
+	// GroupStrategy.
+	SubscribersForDelivery(topic string) []Subscriber
+}
+
+// Explainer is a Matchbox which explains its lookups.
+type Explainer interface {
+	// Explain looks up the Subscribers for a topic like Subscribers,
+	// recording the path taken through the trie and the patterns which
+	// contributed Subscribers.
+	Explain(topic string) Explanation
+}
+
+// Inspector is a Matchbox which describes the trie backing it.
+type Inspector interface {
+	// Stats returns statistics about the shape of the trie, computed from a
+	// read-only snapshot.
+	Stats() Stats
+
+	// ExportDOT writes the structure of the trie, walked from a read-only
+	// snapshot, as a Graphviz DOT digraph.
+	ExportDOT(w io.Writer, opts ExportOptions) error
+
+	// ExportJSON writes the structure of the trie, walked from a read-only
+	// snapshot, as JSON.
+	ExportJSON(w io.Writer, opts ExportOptions) error
+}
+
+// Applier is a Matchbox which makes Changes atomically.
+type Applier interface {
+	// Apply makes the Changes, such as those returned by Diff, atomically.
+	// ErrQuotaExceeded is returned and none are made if they would exceed the
+	// Config's Limits, ErrContended if the trie is modified every time they
+	// are made.
+	Apply(changes []Change) error
+}
+
+// Compiler is a Matchbox which compiles into a Compiled matcher.
+type Compiler interface {
+	// Compile compiles a read-only snapshot of the Matchbox into an
+	// immutable matcher optimized for lookups.
+	Compile() *Compiled
+}
+
+// Snapshotter is a Matchbox which takes read-only snapshots of itself.
+type Snapshotter interface {
+	// ReadOnly returns a read-only, point-in-time snapshot of the Matchbox.
+	// Subscribing to or unsubscribing from it panics.
+	ReadOnly() Matchbox
+}
+
+// Enumerator is a Matchbox which looks up and pages through subscriptions
+// without building all of them at once.
+type Enumerator interface {
+	// Subscription returns the Subscribers to the pattern as it was
+	// subscribed.
+	Subscription(pattern string) Subscription
+
+	// Enumerate calls fn with the Subscription to each pattern after the
+	// cursor, in order, until it returns false. An empty cursor starts from
+	// the first pattern.
+	Enumerate(after string, fn func(Subscription) bool)
+}
+
+// TrySubscribe subscribes the Subscriber to the topic. If the Matchbox is a
+// TrySubscriber, the reason the subscription wasn't made is returned.
+func TrySubscribe(mb Matchbox, topic string, subscriber Subscriber) error {
+	if t, ok := mb.(TrySubscriber); ok {
+		return t.TrySubscribe(topic, subscriber)
+	}
+	mb.Subscribe(topic, subscriber)
+	return nil
+}
+
+// ReadOnly returns a read-only snapshot of the Matchbox if it is a
+// Snapshotter, or the Matchbox itself otherwise.
+func ReadOnly(mb Matchbox) Matchbox {
+	if s, ok := mb.(Snapshotter); ok {
+		return s.ReadOnly()
+	}
+	return mb
+}
+
 // matchbox implements the Matchbox interface using a backing concurrent trie.
 type matchbox struct {
 	*ctrie
+	strategy GroupStrategy
+	groups   *groupIndex
 }
 
 // NewMatchbox creates a new Matchbox with the given Config.
 func New(config *Config) Matchbox {
-	return &matchbox{newCtrie(config)}
+	strategy := config.GroupStrategy
+	if strategy == nil {
+		strategy = NewRoundRobinStrategy()
+	}
+	ctrie := newCtrie(config)
+	ctrie.limiter = newLimiter(config.Limits)
+	return &matchbox{ctrie: ctrie, strategy: strategy, groups: newGroupIndex(strategy)}
 }
 
 // Subscribe a Subscriber to a topic.
@@ -111,6 +465,13 @@ func (m *matchbox) Subscribe(topic string, subscriber Subscriber) {
 	m.Insert(topic, subscriber)
 }
 
+// TrySubscribe subscribes a Subscriber to a topic, returning ErrQuotaExceeded
+// if it would exceed the Config's Limits and ErrRangeTooLarge if the topic has
+// an oversized ranged wildcard.
+func (m *matchbox) TrySubscribe(topic string, subscriber Subscriber) error {
+	return m.Insert(topic, subscriber)
+}
+
 // Unsubscribe a Subscriber from a topic.
 func (m *matchbox) Unsubscribe(topic string, subscriber Subscriber) {
 	m.Remove(topic, subscriber)
@@ -118,7 +479,42 @@ func (m *matchbox) Unsubscribe(topic string, subscriber Subscriber) {
 
 // Subscribers returns the Subscribers for a topic.
 func (m *matchbox) Subscribers(topic string) []Subscriber {
-	return m.Lookup(topic)
+	return ungrouped(m.Lookup(topic))
+}
+
+// SubscribeWords subscribes a Subscriber to a pre-tokenized topic.
+func (m *matchbox) SubscribeWords(words []string, subscriber Subscriber) error {
+	return m.InsertWords(words, subscriber)
+}
+
+// UnsubscribeWords unsubscribes a Subscriber from a pre-tokenized topic.
+func (m *matchbox) UnsubscribeWords(words []string, subscriber Subscriber) {
+	m.RemoveWords(words, subscriber)
+}
+
+// SubscribersWords returns the Subscribers for a pre-tokenized topic.
+func (m *matchbox) SubscribersWords(words []string) []Subscriber {
+	return ungrouped(m.LookupWords(words))
+}
+
+// SubscribersBytes returns the Subscribers for a topic.
+func (m *matchbox) SubscribersBytes(topic []byte) []Subscriber {
+	return ungrouped(m.LookupBytes(topic))
+}
+
+// RefCount returns the number of times the Subscriber with the given ID is
+// subscribed to a topic.
+func (m *matchbox) RefCount(topic, id string) int {
+	br := m.exactBranch(m.config.patternKeys(topic))
+	if br == nil {
+		return 0
+	}
+	return br.refCount(id)
+}
+
+// ReadOnly returns a read-only, point-in-time snapshot of the Matchbox.
+func (m *matchbox) ReadOnly() Matchbox {
+	return &matchbox{ctrie: m.ReadOnlySnapshot(), strategy: m.strategy, groups: m.groups}
 }
 
 // Subscriptions returns a map of topics to Subscribers.
@@ -129,11 +525,22 @@ func (m *matchbox) Subscriptions() map[string][]Subscriber {
 	for key, br := range root.branches {
 		m.subscriptions(subscriptions, key, br)
 	}
+	for topic, subs := range subscriptions {
+		subscriptions[topic] = ungrouped(subs)
+	}
 	return subscriptions
 }
 
 func (m *matchbox) subscriptions(subscriptions map[string][]Subscriber, path string, br *branch) {
-	if len(br.subs) > 0 {
+	if len(br.topics) > 0 {
+		for id, sub := range br.subs {
+			topic, ok := br.topics[id]
+			if !ok {
+				topic = path
+			}
+			subscriptions[topic] = append(subscriptions[topic], sub)
+		}
+	} else if len(br.subs) > 0 {
 		subscriptions[path] = br.subscribers()
 	}
 	if br.iNode != nil && br.iNode.main.cNode != nil {
@@ -154,8 +561,26 @@ func (m *matchbox) Topics() []string {
 	return topics
 }
 
+// topics returns the topics rooted at the branch. Keys are stored in their
+// canonical escaped form, so joining them with the delimiter reconstructs a
+// topic which tokenizes back to the same words.
 func (m *matchbox) topics(path string, br *branch) []string {
 	topics := []string{path}
+	if len(br.topics) > 0 {
+		// Report the patterns as subscribed in place of the normalized path.
+		seen := make(map[string]bool, len(br.topics))
+		topics = topics[:0]
+		for id := range br.subs {
+			topic, ok := br.topics[id]
+			if !ok {
+				topic = path
+			}
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
 	if br.iNode != nil && br.iNode.main.cNode != nil {
 		for key, br := range br.iNode.main.cNode.branches {
 			topics = append(topics, m.topics(path+m.config.Delimiter+key, br)...)
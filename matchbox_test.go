@@ -111,14 +111,23 @@ func TestMatchbox(t *testing.T) {
 	}
 	assert.Equal([]Subscriber{sub3}, mb.Subscribers("x.y.z.z.z.z.z.z.z"))
 
+	// sub3 is subscribed to x.#, which matches any topic starting with x
+	// however many words follow, even once the zero-or-more wildcard branch
+	// has longer patterns below it.
 	mb.Subscribe("x.#.#.#.y.z", sub4)
-	assert.Equal([]Subscriber{sub4}, mb.Subscribers("x.a.y.z"))
-	assert.Equal([]Subscriber{sub4}, mb.Subscribers("x.a.a.a.y.z"))
-	assert.Equal([]Subscriber{}, mb.Subscribers("x.a.a.a.y"))
+	assert.ElementsMatch([]Subscriber{sub3, sub4}, mb.Subscribers("x.a.y.z"))
+	assert.ElementsMatch([]Subscriber{sub3, sub4}, mb.Subscribers("x.a.a.a.y.z"))
+	assert.Equal([]Subscriber{sub3}, mb.Subscribers("x.a.a.a.y"))
 	mb.Unsubscribe("x.#.#.#.y.z", sub4)
-	assert.Equal([]Subscriber{}, mb.Subscribers("x.a.y.z"))
-	assert.Equal([]Subscriber{}, mb.Subscribers("x.a.a.a.y.z"))
-	assert.Equal([]Subscriber{}, mb.Subscribers("x.a.a.a.y"))
+	assert.Equal([]Subscriber{sub3}, mb.Subscribers("x.a.y.z"))
+	assert.Equal([]Subscriber{sub3}, mb.Subscribers("x.a.a.a.y.z"))
+	assert.Equal([]Subscriber{sub3}, mb.Subscribers("x.a.a.a.y"))
+
+	// A zero-or-more wildcard matches the remaining words even when longer
+	// patterns continue past it.
+	mb.Subscribe("x.#.z", sub4)
+	assert.ElementsMatch([]Subscriber{sub3, sub4}, mb.Subscribers("x.z.z"))
+	assert.Equal([]Subscriber{sub3}, mb.Subscribers("x.z.y"))
 }
 
 func TestConfig(t *testing.T) {
@@ -150,6 +159,241 @@ func TestConfig(t *testing.T) {
 	assert.Equal([]Subscriber{}, mb.Subscribers("foo|baz"))
 }
 
+func TestRangeWildcard(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+	mb := New(config)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	mb.Subscribe("a.{1,3}.z", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("a.z"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.b.z"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.b.c.z"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.b.c.d.z"))
+	assert.Equal([]Subscriber{}, mb.Subscribers("a.b.c.d.e.z"))
+	assert.Equal([]Subscriber{}, mb.Subscribers("a.b.c"))
+	mb.Unsubscribe("a.{1,3}.z", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("a.b.z"))
+
+	mb.Subscribe("b.{0,2}", sub1)
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("b"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("b.c"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("b.c.d"))
+	assert.Equal([]Subscriber{}, mb.Subscribers("b.c.d.e"))
+
+	mb.Subscribe("c.{2}", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("c.d"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("c.d.e"))
+	assert.Equal([]Subscriber{}, mb.Subscribers("c.d.e.f"))
+	mb.Unsubscribe("c.{2,2}", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("c.d.e"))
+
+	mb.Subscribe("d.{1}.{0,1}.x", sub1)
+	mb.Subscribe("d.*.x", sub2)
+	assert.Contains(mb.Topics(), "d.{1,2}.x")
+	subscribers := mb.Subscribers("d.e.x")
+	assert.Len(subscribers, 2)
+	assert.Contains(subscribers, sub1)
+	assert.Contains(subscribers, sub2)
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("d.e.f.x"))
+
+	// Ranged wildcards may follow zero-or-more wildcards.
+	mb.Subscribe("e.#.{1}", sub2)
+	assert.Equal([]Subscriber{}, mb.Subscribers("e"))
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("e.z"))
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("e.y.z"))
+	mb.Subscribe("e.#.{0,1}", sub1)
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("e"))
+
+	// Ranged-wildcard branches are indexed as they are subscribed and
+	// unsubscribed.
+	mb.Subscribe("f.{1}", sub1)
+	mb.Subscribe("f.{2}", sub2)
+	mb.Subscribe("f.g", sub2)
+	assert.Len(mb.(*matchbox).ctrie.root.main.cNode.getBranch("f").iNode.main.cNode.ranges, 2)
+	mb.Unsubscribe("f.{1}", sub1)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("f.g"))
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("f.g.h"))
+	assert.Len(mb.(*matchbox).ctrie.root.main.cNode.getBranch("f").iNode.main.cNode.ranges, 1)
+
+	// Ranges matching more than MaxRangeWords words can't be subscribed to.
+	m := mb.(*matchbox)
+	assert.Equal(ErrRangeTooLarge, m.TrySubscribe("g.{256}", sub1))
+	assert.Equal(ErrRangeTooLarge, m.SubscribeWords([]string{"g", "{0,1000}"}, sub1))
+	assert.Equal(ErrRangeTooLarge, m.SubscribeGroup("workers", "g.{1,256}", sub1))
+	assert.Equal(ErrRangeTooLarge, m.Apply([]Change{
+		{Kind: ChangeSubscribe, Topic: "g.{1}", Subscriber: sub1},
+		{Kind: ChangeSubscribe, Topic: "g.{1,256}", Subscriber: sub1},
+	}))
+	assert.Equal([]Subscriber{}, m.Subscribers("g.h"))
+	assert.Nil(m.TrySubscribe("g.{255}", sub1))
+	assert.Contains(m.Topics(), "g.{255,255}")
+
+	// Without range delimiters configured, braces are ordinary words.
+	mb = New(NewAMQPConfig())
+	mb.Subscribe("a.{1,3}.z", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("a.b.z"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.{1,3}.z"))
+}
+
+func TestNormalization(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.FoldCase = true
+	config.Normalization = NormalizeNFKC
+	mb := New(config)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	mb.Subscribe("PRICE.stock.Nyse", sub1)
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("price.STOCK.NYSE"))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("Price.Stock.nyse"))
+	assert.Equal([]Subscriber{}, mb.Subscribers("price.stock.nasdaq"))
+
+	mb.Subscribe("caf\u00e9.\ufb01le", sub2)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("CAFE\u0301.file"))
+	mb.Unsubscribe("Cafe\u0301.FILE", sub2)
+	assert.Equal([]Subscriber{}, mb.Subscribers("caf\u00e9.file"))
+
+	mb.Subscribe("price.stock.#", sub2)
+	assert.Len(mb.Subscribers("PRICE.STOCK.NYSE"), 2)
+	assert.Equal(map[string][]Subscriber{
+		"PRICE.stock.Nyse": []Subscriber{sub1},
+		"price.stock.#":    []Subscriber{sub2},
+	}, mb.Subscriptions())
+	topics := mb.Topics()
+	assert.Len(topics, 4)
+	assert.Contains(topics, "PRICE.stock.Nyse")
+	assert.Contains(topics, "price.stock.#")
+
+	mb.Unsubscribe("price.stock.nyse", sub1)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("PRICE.STOCK.NYSE"))
+	assert.Equal(map[string][]Subscriber{
+		"price.stock.#": []Subscriber{sub2},
+	}, mb.Subscriptions())
+
+	// Without normalization, case and composition are significant.
+	mb = New(NewAMQPConfig())
+	mb.Subscribe("PRICE.stock", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("price.stock"))
+	mb.Subscribe("caf\u00e9", sub1)
+	assert.Equal([]Subscriber{}, mb.Subscribers("cafe\u0301"))
+}
+
+// Ensures subscribing to a prefix of an existing topic preserves the topic.
+func TestSubscribePrefix(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig())
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	mb.Subscribe("a.b", sub1)
+	mb.Subscribe("a", sub2)
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.b"))
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("a"))
+}
+
+func TestWords(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	mb.SubscribeWords([]string{"a", "b.c", "\x00\xff"}, sub1)
+	mb.SubscribeWords([]string{"a", "*", "#"}, sub2)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("a.b.c.d"))
+	subscribers := mb.SubscribersWords([]string{"a", "b.c", "\x00\xff"})
+	assert.Len(subscribers, 2)
+	assert.Contains(subscribers, sub1)
+	assert.Contains(subscribers, sub2)
+	assert.Equal([]Subscriber{sub2}, mb.SubscribersWords([]string{"a", "b", "c", "\x00\xff"}))
+	assert.Equal([]Subscriber{sub2}, mb.SubscribersBytes([]byte("a.b.c")))
+	assert.Equal([]Subscriber{}, mb.SubscribersBytes([]byte("b.c")))
+
+	mb.UnsubscribeWords([]string{"a", "b.c", "\x00\xff"}, sub1)
+	assert.Equal([]Subscriber{sub2}, mb.SubscribersWords([]string{"a", "b.c", "\x00\xff"}))
+	mb.UnsubscribeWords([]string{"a", "*", "#", "#"}, sub2)
+	assert.Equal([]Subscriber{}, mb.SubscribersWords([]string{"a", "b.c", "\x00\xff"}))
+
+	// With escaping enabled, literal words round-trip through Topics.
+	mb = New(newEscapeConfig()).(*matchbox)
+	mb.SubscribeWords([]string{"a.b", "*"}, sub1)
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers(`a\.b.c`))
+	assert.Equal([]Subscriber{sub1}, mb.SubscribersBytes([]byte(`a\.b.c`)))
+	assert.Equal([]Subscriber{}, mb.SubscribersWords([]string{"a", "b", "c"}))
+	assert.Equal(map[string][]Subscriber{`a\.b.*`: []Subscriber{sub1}}, mb.Subscriptions())
+
+	// Words are normalized like topics.
+	config := NewAMQPConfig()
+	config.FoldCase = true
+	mb = New(config).(*matchbox)
+	mb.SubscribeWords([]string{"A", "B"}, sub1)
+	assert.Equal([]Subscriber{sub1}, mb.SubscribersBytes([]byte("a.b")))
+	assert.Equal([]Subscriber{sub1}, mb.SubscribersWords([]string{"a", "B"}))
+	assert.Equal([]string{"a", "A.B"}, mb.Topics())
+
+	// Topics without any words are rejected, and have no subscribers.
+	mb = New(NewAMQPConfig()).(*matchbox)
+	mb.Subscribe("#", sub1)
+	assert.Equal(ErrNoWords, mb.SubscribeWords(nil, sub2))
+	assert.Equal(ErrNoWords, mb.SubscribeWords([]string{}, sub2))
+	mb.UnsubscribeWords(nil, sub1)
+	assert.Equal([]Subscriber{}, mb.SubscribersWords(nil))
+	assert.Equal([]Subscriber{}, mb.Compile().LookupWords(nil))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a"))
+}
+
+func TestRefCount(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RefCount = true
+	mb := New(config).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	assert.Equal(0, mb.RefCount("a.*", sub1.ID()))
+	mb.Subscribe("a.*", sub1)
+	mb.Subscribe("a.*", sub1)
+	mb.Subscribe("a.*", sub2)
+	mb.Subscribe("a.*.c", sub1)
+	assert.Equal(2, mb.RefCount("a.*", sub1.ID()))
+	assert.Equal(1, mb.RefCount("a.*", sub2.ID()))
+	assert.Equal(1, mb.RefCount("a.*.c", sub1.ID()))
+
+	// The Subscriber stays bound until every reference is released.
+	mb.Unsubscribe("a.*", sub1)
+	assert.Equal(1, mb.RefCount("a.*", sub1.ID()))
+	assert.Len(mb.Subscribers("a.b"), 2)
+	mb.Unsubscribe("a.*", sub1)
+	assert.Equal(0, mb.RefCount("a.*", sub1.ID()))
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("a.b"))
+	mb.Unsubscribe("a.*", sub1)
+	assert.Equal(0, mb.RefCount("a.*", sub1.ID()))
+
+	// Counts survive inserting below the branch.
+	mb.Subscribe("a.*", sub2)
+	mb.Subscribe("a.*.d", sub2)
+	assert.Equal(2, mb.RefCount("a.*", sub2.ID()))
+	assert.Equal([]Subscriber{sub1}, mb.Subscribers("a.b.c"))
+
+	// Counts are isolated across snapshots.
+	snapshot := &matchbox{ctrie: mb.Snapshot(), strategy: NewRoundRobinStrategy()}
+	mb.Unsubscribe("a.*", sub2)
+	assert.Equal(1, mb.RefCount("a.*", sub2.ID()))
+	assert.Equal(2, snapshot.RefCount("a.*", sub2.ID()))
+
+	// Without reference counting, subscribing again is a no-op.
+	mb = New(NewAMQPConfig()).(*matchbox)
+	mb.Subscribe("a.*", sub1)
+	mb.Subscribe("a.*", sub1)
+	assert.Equal(1, mb.RefCount("a.*", sub1.ID()))
+	mb.Unsubscribe("a.*", sub1)
+	assert.Equal(0, mb.RefCount("a.*", sub1.ID()))
+	assert.Equal([]Subscriber{}, mb.Subscribers("a.b"))
+}
+
 func TestSubscriptions(t *testing.T) {
 	assert := assert.New(t)
 	mb := New(NewAMQPConfig())
@@ -210,6 +454,72 @@ func TestTopics(t *testing.T) {
 	}
 }
 
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	mb.Subscribe("a.*", sub1)
+
+	snapshot := mb.ReadOnly()
+	mb.Subscribe("a.b", sub2)
+	assert.Equal([]Subscriber{sub1}, snapshot.Subscribers("a.b"))
+	assert.Len(mb.Subscribers("a.b"), 2)
+	assert.Panics(func() { snapshot.Subscribe("a.c", sub2) })
+	assert.Panics(func() { snapshot.Unsubscribe("a.*", sub1) })
+	assert.Equal(snapshot, snapshot.(Snapshotter).ReadOnly())
+}
+
+func TestCapabilities(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(NewAMQPConfig())
+	assert.Implements((*TrySubscriber)(nil), mb)
+	assert.Implements((*WordMatchbox)(nil), mb)
+	assert.Implements((*BatchMatchbox)(nil), mb)
+	assert.Implements((*RefCounter)(nil), mb)
+	assert.Implements((*GroupMatchbox)(nil), mb)
+	assert.Implements((*Explainer)(nil), mb)
+	assert.Implements((*Inspector)(nil), mb)
+	assert.Implements((*Applier)(nil), mb)
+	assert.Implements((*Compiler)(nil), mb)
+	assert.Implements((*Snapshotter)(nil), mb)
+	assert.Implements((*Enumerator)(nil), mb)
+
+	// A Matchbox without the capabilities is subscribed to and read as is.
+	o := opaque{mb}
+	assert.Nil(TrySubscribe(o, "a", subscriber("abc")))
+	assert.Equal([]Subscriber{subscriber("abc")}, ReadOnly(o).Subscribers("a"))
+	e := NewExpiring(o, ExpiryConfig{})
+	assert.Equal(ErrUnsupported, e.SubscribeWords([]string{"a"}, subscriber("abc")))
+	assert.Equal(ErrUnsupported, e.SubscribeGroup("g", "a", subscriber("abc")))
+	assert.Equal(ErrUnsupported, e.Apply(nil))
+	e.UnsubscribeWords([]string{"a"}, subscriber("abc"))
+	assert.Equal([]Subscriber{subscriber("abc")}, e.Subscribers("a"))
+}
+
+func TestLookupAfterSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	snapshots := map[string]func(*matchbox){
+		"ReadOnly":         func(mb *matchbox) { mb.ReadOnly() },
+		"Stats":            func(mb *matchbox) { mb.Stats() },
+		"SubscribersBatch": func(mb *matchbox) { mb.SubscribersBatch([]string{"a"}) },
+		"Compile":          func(mb *matchbox) { mb.Compile() },
+	}
+	for name, snapshot := range snapshots {
+		mb := New(NewAMQPConfig()).(*matchbox)
+		mb.Subscribe("*", subscriber("abc"))
+		mb.Subscribe("*.*.*.*", subscriber("def"))
+		mb.Subscribe("a.a.a", subscriber("ghi"))
+
+		// Lookups renewing the trie after a snapshot see the same
+		// Subscribers as before it.
+		assert.Equal([]Subscriber{}, mb.Subscribers("a.b"), name)
+		snapshot(mb)
+		assert.Equal([]Subscriber{}, mb.Subscribers("a.b"), name)
+		assert.Equal([]Subscriber{subscriber("ghi")}, mb.Subscribers("a.a.a"), name)
+	}
+}
+
 // Ensures reduceZeroOrMoreWildcards reduces sequences of # to a single
 // instance.
 func TestReduceZeroOrMoreWildcards(t *testing.T) {
@@ -228,6 +538,34 @@ func TestReduceZeroOrMoreWildcards(t *testing.T) {
 		config.reduceZeroOrMoreWildcards(words))
 }
 
+// Ensures reduceZeroOrMoreWildcards merges adjacent ranged wildcards.
+func TestReduceRangeWildcards(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+	words := []string{"a", "{1,2}", "b"}
+	assert.Equal(words, config.reduceZeroOrMoreWildcards(words))
+	words = []string{"a", "{2}", "b"}
+	assert.Equal([]string{"a", "{2,2}", "b"}, config.reduceZeroOrMoreWildcards(words))
+	words = []string{"a", "{1,2}", "{0,3}", "b"}
+	assert.Equal([]string{"a", "{1,5}", "b"}, config.reduceZeroOrMoreWildcards(words))
+	words = []string{"{1,2}", "{1}", "{0,1}"}
+	assert.Equal([]string{"{2,4}"}, config.reduceZeroOrMoreWildcards(words))
+	words = []string{"a", "{1,2}", "#", "{1,2}"}
+	assert.Equal(words, config.reduceZeroOrMoreWildcards(words))
+	words = []string{"a", "{2,1}", "{0,0}", "{x,1}", "{1,2"}
+	assert.Equal(words, config.reduceZeroOrMoreWildcards(words))
+
+	// Ranges are bounded by MaxRangeWords, and not merged beyond it.
+	words = []string{"a", "{0,255}", "{0,1000000000}"}
+	assert.Equal(words, config.reduceZeroOrMoreWildcards(words))
+	words = []string{"{0,200}", "{0,55}", "{1}"}
+	assert.Equal([]string{"{0,255}", "{1,1}"}, config.reduceZeroOrMoreWildcards(words))
+	assert.False(config.Overlaps("{0,1000000000}", "a"))
+	assert.True(config.Overlaps("{0,1000000000}", "{0,1000000000}"))
+}
+
 func BenchmarkSubscribeSingleChild(b *testing.B) {
 	mb := New(NewAMQPConfig())
 	sub := subscriber("abc")
@@ -319,6 +657,28 @@ func BenchmarkSubscribersLongBranch(b *testing.B) {
 	}
 }
 
+func BenchmarkSubscribersWordsLongBranch(b *testing.B) {
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub := subscriber("abc")
+	mb.Subscribe("a.b.c.d.e.f.g.h", sub)
+	words := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.SubscribersWords(words)
+	}
+}
+
+func BenchmarkSubscribersBytesLongBranch(b *testing.B) {
+	mb := New(NewAMQPConfig()).(*matchbox)
+	sub := subscriber("abc")
+	mb.Subscribe("a.b.c.d.e.f.g.h", sub)
+	topic := []byte("a.b.c.d.e.f.g.h")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.SubscribersBytes(topic)
+	}
+}
+
 func BenchmarkSubscribersFanOutChild(b *testing.B) {
 	mb := New(NewAMQPConfig())
 	sub := subscriber("abc")
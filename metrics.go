@@ -0,0 +1,198 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"expvar"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Names of the counters and histograms reported to Metrics.
+const (
+	// MetricInserts counts insert operations.
+	MetricInserts = "inserts"
+
+	// MetricRemoves counts remove operations.
+	MetricRemoves = "removes"
+
+	// MetricLookups counts lookup operations.
+	MetricLookups = "lookups"
+
+	// MetricInsertRetries counts inserts which were retried from the root.
+	MetricInsertRetries = "insert_retries"
+
+	// MetricRemoveRetries counts removes which were retried from the root.
+	MetricRemoveRetries = "remove_retries"
+
+	// MetricLookupRetries counts lookups which were retried from the root.
+	MetricLookupRetries = "lookup_retries"
+
+	// MetricGCASFailures counts GCAS operations which failed to commit.
+	MetricGCASFailures = "gcas_failures"
+
+	// MetricCleans counts C-nodes being compressed by clean.
+	MetricCleans = "cleans"
+
+	// MetricCleanParents counts attempts to contract a parent C-node after a
+	// removal tombed its child.
+	MetricCleanParents = "clean_parents"
+
+	// MetricLookupLatency is a histogram of lookup latency in seconds.
+	MetricLookupLatency = "lookup_latency_seconds"
+
+	// MetricLookupResults is a histogram of the number of Subscribers
+	// returned by lookups.
+	MetricLookupResults = "lookup_results"
+)
+
+// Metrics receives counters and histograms measuring the operations of a
+// Matchbox. Implementations must be safe for concurrent use. Metrics are
+// disabled if the Config has none, in which case they cost next to nothing.
+type Metrics interface {
+	// Count adds n to the named counter.
+	Count(name string, n int64)
+
+	// Observe records the value in the named histogram.
+	Observe(name string, value float64)
+}
+
+// count adds one to the named counter if Metrics are enabled.
+func (c *ctrie) count(name string) {
+	if m := c.config.Metrics; m != nil {
+		m.Count(name, 1)
+	}
+}
+
+// expvarMetrics implements Metrics by publishing them with expvar.
+type expvarMetrics struct {
+	vars       *expvar.Map
+	histograms sync.Map
+}
+
+// NewExpvarMetrics returns Metrics which are published as an expvar.Map with
+// the given name. Counters are integers within it, and each histogram is a
+// nested map with its count, sum and cumulative power-of-two buckets keyed on
+// their upper bound, e.g. "le_0.5" is the number of values of at most 0.5.
+// Only bounds which values fall on are reported. Like expvar.NewMap, it panics
+// if the name is already in use.
+func NewExpvarMetrics(name string) Metrics {
+	return &expvarMetrics{vars: expvar.NewMap(name)}
+}
+
+// Count adds n to the named counter.
+func (e *expvarMetrics) Count(name string, n int64) {
+	e.vars.Add(name, n)
+}
+
+// Observe records the value in the named histogram.
+func (e *expvarMetrics) Observe(name string, value float64) {
+	e.histogram(name).observe(value)
+}
+
+// histogram returns the named histogram, publishing it if necessary.
+func (e *expvarMetrics) histogram(name string) *histogram {
+	if h, ok := e.histograms.Load(name); ok {
+		return h.(*histogram)
+	}
+	h, loaded := e.histograms.LoadOrStore(name, new(histogram))
+	if !loaded {
+		e.vars.Set(name, expvar.Func(h.(*histogram).value))
+	}
+	return h.(*histogram)
+}
+
+// Bounds of the exponents of the power-of-two histogram buckets. Values beyond
+// them are counted in the first bucket or the +Inf one.
+const (
+	minBucketExp = -64
+	maxBucketExp = 64
+	numBuckets   = maxBucketExp - minBucketExp + 3
+)
+
+// histogram is a histogram of power-of-two buckets recorded with atomic
+// counters, so observing a value takes no locks.
+type histogram struct {
+	count atomic.Uint64
+	sum   atomic.Uint64 // bits of a float64
+	// buckets counts values of at most zero, then values of at most each power
+	// of two from 2^minBucketExp to 2^maxBucketExp, then any others.
+	buckets [numBuckets]atomic.Uint64
+}
+
+// observe records the value.
+func (h *histogram) observe(value float64) {
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			break
+		}
+	}
+	h.buckets[bucket(value)].Add(1)
+}
+
+// bucket returns the index of the value's bucket.
+func bucket(value float64) int {
+	if !(value > 0) {
+		return 0
+	}
+	if math.IsInf(value, 1) {
+		return numBuckets - 1
+	}
+	// The bucket's bound is 2^exp, the smallest power of two at least value.
+	frac, exp := math.Frexp(value)
+	if frac == 0.5 {
+		exp--
+	}
+	switch {
+	case exp < minBucketExp:
+		exp = minBucketExp
+	case exp > maxBucketExp:
+		return numBuckets - 1
+	}
+	return exp - minBucketExp + 1
+}
+
+// bucketBound returns the name of the bucket with the given index.
+func bucketBound(i int) string {
+	switch i {
+	case 0:
+		return "le_0"
+	case numBuckets - 1:
+		return "le_+Inf"
+	}
+	return "le_" + strconv.FormatFloat(math.Exp2(float64(i-1+minBucketExp)), 'g', -1, 64)
+}
+
+// value returns the histogram in the form published with expvar.
+func (h *histogram) value() any {
+	v := map[string]any{
+		"count": h.count.Load(),
+		"sum":   math.Float64frombits(h.sum.Load()),
+	}
+	cumulative := uint64(0)
+	for i := range h.buckets {
+		if n := h.buckets[i].Load(); n > 0 {
+			cumulative += n
+			v[bucketBound(i)] = cumulative
+		}
+	}
+	return v
+}
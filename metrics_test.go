@@ -0,0 +1,154 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMetrics is Metrics which records every measurement.
+type recordingMetrics struct {
+	mu           sync.Mutex
+	counters     map[string]int64
+	observations map[string][]float64
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{counters: map[string]int64{}, observations: map[string][]float64{}}
+}
+
+func (r *recordingMetrics) Count(name string, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += n
+}
+
+func (r *recordingMetrics) Observe(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observations[name] = append(r.observations[name], value)
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	metrics := newRecordingMetrics()
+	config := NewAMQPConfig()
+	config.Metrics = metrics
+	mb := New(config)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	mb.Subscribe("a.b", sub1)
+	mb.Subscribe("a.*", sub2)
+	mb.Subscribers("a.b")
+	mb.Subscribers("c")
+	mb.Unsubscribe("a.b", sub1)
+
+	assert.Equal(int64(2), metrics.counters[MetricInserts])
+	assert.Equal(int64(1), metrics.counters[MetricRemoves])
+	assert.Equal(int64(2), metrics.counters[MetricLookups])
+	assert.Equal([]float64{2, 0}, metrics.observations[MetricLookupResults])
+	assert.Len(metrics.observations[MetricLookupLatency], 2)
+	assert.Equal(int64(0), metrics.counters[MetricGCASFailures])
+}
+
+func TestMetricsContention(t *testing.T) {
+	assert := assert.New(t)
+	metrics := newRecordingMetrics()
+	config := NewAMQPConfig()
+	config.Metrics = metrics
+	mb := New(config)
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			for i := 0; i < 200; i++ {
+				sub := subscriber(strconv.Itoa(g))
+				mb.Subscribe("a."+strconv.Itoa(i), sub)
+				mb.Unsubscribe("a."+strconv.Itoa(i), sub)
+			}
+			wg.Done()
+		}(g)
+	}
+
+	wg.Wait()
+	assert.Equal(int64(800), metrics.counters[MetricInserts])
+	assert.Equal(int64(800), metrics.counters[MetricRemoves])
+	assert.Equal(int64(0), metrics.counters[MetricLookups])
+	// Every retry is caused by a failed GCAS or by cleaning a tombed I-node.
+	assert.True(metrics.counters[MetricInsertRetries]+metrics.counters[MetricRemoveRetries] <=
+		metrics.counters[MetricGCASFailures]+metrics.counters[MetricCleans])
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	assert := assert.New(t)
+	metrics := NewExpvarMetrics("matchbox_test")
+	metrics.Count(MetricInserts, 2)
+	metrics.Observe(MetricLookupResults, 3)
+	metrics.Observe(MetricLookupResults, 0)
+	metrics.Observe(MetricLookupLatency, 0.0003)
+
+	var vars map[string]any
+	assert.Nil(json.Unmarshal([]byte(expvar.Get("matchbox_test").String()), &vars))
+	assert.Equal(float64(2), vars[MetricInserts])
+	assert.Equal(map[string]any{"count": float64(2), "sum": float64(3), "le_4": float64(2), "le_0": float64(1)},
+		vars[MetricLookupResults])
+	latency := vars[MetricLookupLatency].(map[string]any)
+	assert.Equal(float64(1), latency["le_0.00048828125"])
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	assert := assert.New(t)
+	h := new(histogram)
+	for _, value := range []float64{-1, 0, 0.25, 0.3, 1, 2, 3, 4, 5, 1e-30, 1e30, math.Inf(1)} {
+		h.observe(value)
+	}
+
+	assert.Equal(map[string]any{
+		"count":                    uint64(12),
+		"sum":                      math.Inf(1),
+		"le_0":                     uint64(2),
+		"le_5.421010862427522e-20": uint64(3),
+		"le_0.25":                  uint64(4),
+		"le_0.5":                   uint64(5),
+		"le_1":                     uint64(6),
+		"le_2":                     uint64(7),
+		"le_4":                     uint64(9),
+		"le_8":                     uint64(10),
+		"le_+Inf":                  uint64(12),
+	}, h.value())
+}
+
+func BenchmarkSubscribersMetrics(b *testing.B) {
+	config := NewAMQPConfig()
+	config.Metrics = NewExpvarMetrics("matchbox_benchmark_" + strconv.Itoa(b.N))
+	mb := New(config)
+	sub := subscriber("abc")
+	mb.Subscribe("a.*.c", sub)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mb.Subscribers("a.b.c")
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TenantQuota limits a tenant's subscriptions. Zero means unlimited.
+type TenantQuota struct {
+	// MaxPatterns is the maximum number of distinct patterns subscribed to.
+	MaxPatterns int
+
+	// MaxSubscribers is the maximum number of subscriptions, counting a
+	// Subscriber once for each pattern it is subscribed to.
+	MaxSubscribers int
+}
+
+// TenantUsage is the number of patterns and subscriptions of a tenant.
+type TenantUsage struct {
+	Patterns    int
+	Subscribers int
+}
+
+// tenant tracks a tenant's usage against its quota. Subscriptions are
+// counted with lock-free counters while holding the read lock, which is held
+// exclusively while the tenant is dropped so its counters are reset with its
+// subscriptions. A tenant without a quota or subscriptions is deleted, after
+// which its tracker is no longer used.
+type tenant struct {
+	mu          sync.RWMutex
+	quota       TenantQuota
+	patterns    atomic.Int64
+	subscribers atomic.Int64
+	deleted     bool
+}
+
+// reserve capacity for the change or return ErrQuotaExceeded.
+func (t *tenant) reserve(change insertChange) error {
+	if !reserve(&t.subscribers, 1, t.quota.MaxSubscribers) {
+		return ErrQuotaExceeded
+	}
+	if change.newPattern() && !reserve(&t.patterns, 1, t.quota.MaxPatterns) {
+		t.subscribers.Add(-1)
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// release capacity used by the change.
+func (t *tenant) release(change insertChange) {
+	t.removed(change.newPattern())
+}
+
+// removed releases the capacity used by a subscription which was removed.
+// lastOnPattern indicates if it was the last one on its pattern.
+func (t *tenant) removed(lastOnPattern bool) {
+	t.subscribers.Add(-1)
+	if lastOnPattern {
+		t.patterns.Add(-1)
+	}
+}
+
+// Namespaced partitions a single backing concurrent trie into tenants, e.g.
+// AMQP virtual hosts. The tenant is the first level of the trie, so wildcards
+// never match across tenants, and each tenant can be given a quota and
+// dropped as a whole. The Config's Limits apply across all tenants, with the
+// tenant counting towards MaxDepth. Namespaced is safe for concurrent use.
+type Namespaced struct {
+	ctrie   *ctrie
+	tenants sync.Map
+}
+
+// NewNamespaced creates a new Namespaced matchbox with the given Config.
+func NewNamespaced(config *Config) *Namespaced {
+	ctrie := newCtrie(config)
+	ctrie.limiter = newLimiter(config.Limits)
+	return &Namespaced{ctrie: ctrie}
+}
+
+// tenant returns the tenant's usage tracker, creating it if necessary.
+func (n *Namespaced) tenant(name string) *tenant {
+	if t, ok := n.loadTenant(name); ok {
+		return t
+	}
+	t, _ := n.tenants.LoadOrStore(name, &tenant{})
+	return t.(*tenant)
+}
+
+// lockTenant returns the tenant's usage tracker and true with its lock held,
+// exclusively if exclusive is set. If create is set the tracker is created if
+// necessary, otherwise false is returned if the tenant doesn't exist.
+func (n *Namespaced) lockTenant(name string, create, exclusive bool) (*tenant, bool) {
+	for {
+		var t *tenant
+		if create {
+			t = n.tenant(name)
+		} else if loaded, ok := n.loadTenant(name); ok {
+			t = loaded
+		} else {
+			return nil, false
+		}
+		if exclusive {
+			t.mu.Lock()
+		} else {
+			t.mu.RLock()
+		}
+		if !t.deleted {
+			return t, true
+		}
+		// The tracker was deleted while waiting for the lock, so try again
+		// with its replacement.
+		t.unlock(exclusive)
+	}
+}
+
+// unlock releases the tenant's lock as taken by lockTenant.
+func (t *tenant) unlock(exclusive bool) {
+	if exclusive {
+		t.mu.Unlock()
+	} else {
+		t.mu.RUnlock()
+	}
+}
+
+// prune deletes the tenant's usage tracker if the tenant has neither a quota
+// nor subscriptions, so tenants which come and go aren't tracked forever.
+func (n *Namespaced) prune(name string, t *tenant) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.deleted && t.quota == (TenantQuota{}) && t.subscribers.Load() == 0 {
+		t.deleted = true
+		n.tenants.CompareAndDelete(name, t)
+	}
+}
+
+// loadTenant returns the tenant's usage tracker and true if it exists, so
+// reads needn't create one.
+func (n *Namespaced) loadTenant(name string) (*tenant, bool) {
+	t, ok := n.tenants.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return t.(*tenant), true
+}
+
+// SetQuota sets the tenant's quota. Existing subscriptions are kept even if
+// they exceed it.
+func (n *Namespaced) SetQuota(name string, quota TenantQuota) {
+	t, _ := n.lockTenant(name, true, true)
+	t.quota = quota
+	t.mu.Unlock()
+	n.prune(name, t)
+}
+
+// Usage returns the tenant's current usage.
+func (n *Namespaced) Usage(name string) TenantUsage {
+	t, ok := n.loadTenant(name)
+	if !ok {
+		return TenantUsage{}
+	}
+	return TenantUsage{
+		Patterns:    int(t.patterns.Load()),
+		Subscribers: int(t.subscribers.Load()),
+	}
+}
+
+// Subscribe a Subscriber to a topic within the tenant. ErrQuotaExceeded is
+// returned if the tenant's quota doesn't allow it, ErrRangeTooLarge if the
+// topic has an oversized ranged wildcard.
+func (n *Namespaced) Subscribe(name, topic string, subscriber Subscriber) error {
+	keys := n.ctrie.config.patternKeys(topic)
+	if err := n.ctrie.config.checkRanges(keys); err != nil {
+		return err
+	}
+	t, _ := n.lockTenant(name, true, false)
+	op := &insertion{sub: subscriber, topic: n.ctrie.config.subscribedTopic(keys, topic), quota: t}
+	n.ctrie.insertOp(append([]string{namespaceKey(name)}, keys...), op)
+	t.mu.RUnlock()
+	if op.err != nil {
+		n.prune(name, t)
+	}
+	return op.err
+}
+
+// Unsubscribe a Subscriber from a topic within the tenant.
+func (n *Namespaced) Unsubscribe(name, topic string, subscriber Subscriber) {
+	n.ctrie.assertReadWrite()
+	keys := append([]string{namespaceKey(name)}, n.ctrie.config.patternKeys(topic)...)
+	t, ok := n.lockTenant(name, false, false)
+	if !ok {
+		// The tenant has no subscriptions.
+		return
+	}
+	op := &removal{sub: subscriber}
+	n.ctrie.removeOp(keys, op)
+	if op.removed {
+		t.removed(op.lastOnPattern)
+	}
+	t.mu.RUnlock()
+	if op.removed {
+		n.prune(name, t)
+	}
+}
+
+// Subscribers returns the Subscribers within the tenant for the given topic.
+func (n *Namespaced) Subscribers(name, topic string) []Subscriber {
+	return n.ctrie.lookup(append([]string{namespaceKey(name)}, n.ctrie.config.topicKeys(topic)...))
+}
+
+// Drop removes all of the tenant's subscriptions atomically. Its quota is
+// kept, and a tenant without one is forgotten.
+func (n *Namespaced) Drop(name string) {
+	n.ctrie.assertReadWrite()
+	t, ok := n.lockTenant(name, false, true)
+	if !ok {
+		// The tenant has no subscriptions.
+		return
+	}
+	defer t.mu.Unlock()
+	n.ctrie.removeBranch(namespaceKey(name))
+	t.patterns.Store(0)
+	t.subscribers.Store(0)
+	if t.quota == (TenantQuota{}) {
+		t.deleted = true
+		n.tenants.CompareAndDelete(name, t)
+	}
+}
+
+// Tenants returns the tenants which have subscriptions.
+func (n *Namespaced) Tenants() []string {
+	snapshot := n.ctrie.ReadOnlySnapshot()
+	tenants := []string{}
+	for key := range snapshot.root.main.cNode.branches {
+		tenants = append(tenants, strings.TrimPrefix(key, namespaceKey("")))
+	}
+	return tenants
+}
+
+// Subscriptions returns a map of the tenant's topics to Subscribers.
+func (n *Namespaced) Subscriptions(name string) map[string][]Subscriber {
+	subscriptions := map[string][]Subscriber{}
+	m, root := n.tenantRoot(name)
+	if root != nil {
+		for key, br := range root.branches {
+			m.subscriptions(subscriptions, key, br)
+		}
+	}
+	return subscriptions
+}
+
+// Topics returns all of the tenant's topics.
+func (n *Namespaced) Topics(name string) []string {
+	topics := []string{}
+	m, root := n.tenantRoot(name)
+	if root != nil {
+		for key, br := range root.branches {
+			topics = append(topics, m.topics(key, br)...)
+		}
+	}
+	return topics
+}
+
+// tenantRoot returns a matchbox over a read-only snapshot along with the
+// C-node below the tenant's branch in it, or nil if the tenant has no
+// subscriptions.
+func (n *Namespaced) tenantRoot(name string) (*matchbox, *cNode) {
+	snapshot := n.ctrie.ReadOnlySnapshot()
+	m := &matchbox{ctrie: snapshot}
+	br := snapshot.exactBranch([]string{namespaceKey(name)})
+	if br == nil || br.iNode == nil {
+		return m, nil
+	}
+	return m, gcasRead(br.iNode, snapshot).cNode
+}
+
+// Snapshot returns a read-only snapshot of all tenants. Quotas and usage are
+// not part of the snapshot, and modifying it panics.
+func (n *Namespaced) Snapshot() *Namespaced {
+	return &Namespaced{ctrie: n.ctrie.ReadOnlySnapshot()}
+}
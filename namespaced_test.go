@@ -0,0 +1,175 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaced(t *testing.T) {
+	assert := assert.New(t)
+	n := NewNamespaced(NewAMQPConfig())
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	assert.Nil(n.Subscribe("vhost1", "a.#", sub1))
+	assert.Nil(n.Subscribe("vhost1", "a.b", sub2))
+	assert.Nil(n.Subscribe("vhost2", "#", sub2))
+	assert.Nil(n.Subscribe("*", "#", sub1))
+
+	// Wildcards never cross tenants.
+	assert.Equal([]Subscriber{sub1}, n.Subscribers("vhost1", "a.c"))
+	assert.Len(n.Subscribers("vhost1", "a.b"), 2)
+	assert.Equal([]Subscriber{sub2}, n.Subscribers("vhost2", "a.c"))
+	assert.Equal([]Subscriber{}, n.Subscribers("vhost3", "a.c"))
+
+	topics := n.Topics("vhost1")
+	sort.Strings(topics)
+	assert.Equal([]string{"a", "a.#", "a.b"}, topics)
+	assert.Equal(map[string][]Subscriber{"#": []Subscriber{sub2}}, n.Subscriptions("vhost2"))
+	assert.Equal([]string{}, n.Topics("vhost3"))
+	tenants := n.Tenants()
+	sort.Strings(tenants)
+	assert.Equal([]string{"*", "vhost1", "vhost2"}, tenants)
+	assert.Equal(TenantUsage{Patterns: 2, Subscribers: 2}, n.Usage("vhost1"))
+
+	snapshot := n.Snapshot()
+	n.Drop("vhost1")
+	assert.Equal([]Subscriber{}, n.Subscribers("vhost1", "a.b"))
+	assert.Equal([]Subscriber{sub2}, n.Subscribers("vhost2", "a.b"))
+	assert.Equal(TenantUsage{}, n.Usage("vhost1"))
+	assert.Len(snapshot.Subscribers("vhost1", "a.b"), 2)
+	assert.Panics(func() { snapshot.Drop("vhost2") })
+
+	n.Unsubscribe("vhost2", "#", sub2)
+	n.Unsubscribe("vhost2", "#", sub2)
+	assert.Equal(TenantUsage{}, n.Usage("vhost2"))
+	assert.Equal([]Subscriber{}, n.Subscribers("vhost2", "a.b"))
+
+	// Reading a tenant which never subscribed doesn't track it.
+	assert.Equal(TenantUsage{}, n.Usage("vhost3"))
+	assert.Equal([]Subscriber{}, n.Subscribers("vhost3", "a.b"))
+	n.Unsubscribe("vhost3", "a.b", sub1)
+	n.Drop("vhost3")
+	_, ok := n.tenants.Load("vhost3")
+	assert.False(ok)
+	assert.Panics(func() { snapshot.Drop("vhost3") })
+}
+
+func TestNamespacedQuota(t *testing.T) {
+	assert := assert.New(t)
+	n := NewNamespaced(NewAMQPConfig())
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+	n.SetQuota("vhost1", TenantQuota{MaxPatterns: 2, MaxSubscribers: 3})
+
+	assert.Nil(n.Subscribe("vhost1", "a", sub1))
+	assert.Nil(n.Subscribe("vhost1", "b", sub1))
+	assert.Equal(ErrQuotaExceeded, n.Subscribe("vhost1", "c", sub1))
+	assert.Nil(n.Subscribe("vhost1", "a", sub2))
+	assert.Nil(n.Subscribe("vhost1", "a", sub1))
+	assert.Equal(ErrQuotaExceeded, n.Subscribe("vhost1", "a", sub3))
+	assert.Equal(TenantUsage{Patterns: 2, Subscribers: 3}, n.Usage("vhost1"))
+	assert.Equal([]Subscriber{}, n.Subscribers("vhost1", "c"))
+
+	// Other tenants are unaffected.
+	assert.Nil(n.Subscribe("vhost2", "c", sub1))
+
+	n.Unsubscribe("vhost1", "b", sub1)
+	assert.Nil(n.Subscribe("vhost1", "c", sub1))
+	assert.Equal(TenantUsage{Patterns: 2, Subscribers: 3}, n.Usage("vhost1"))
+}
+
+func TestNamespacedQuotaConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	n := NewNamespaced(NewAMQPConfig())
+	n.SetQuota("vhost1", TenantQuota{MaxPatterns: 50})
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			for i := 0; i < 100; i++ {
+				sub := subscriber(strconv.Itoa(g))
+				n.Subscribe("vhost1", "a."+strconv.Itoa(i), sub)
+				if i%3 == 0 {
+					n.Unsubscribe("vhost1", "a."+strconv.Itoa(i), sub)
+				}
+			}
+			wg.Done()
+		}(g)
+	}
+
+	wg.Wait()
+	usage := n.Usage("vhost1")
+	assert.True(usage.Patterns <= 50)
+	assert.Len(n.Topics("vhost1"), usage.Patterns+1)
+	subscriptions := 0
+	for _, subs := range n.Subscriptions("vhost1") {
+		subscriptions += len(subs)
+	}
+	assert.Equal(usage.Subscribers, subscriptions)
+}
+
+func TestNamespacedForgetsTenants(t *testing.T) {
+	assert := assert.New(t)
+	n := NewNamespaced(NewAMQPConfig())
+	sub := subscriber("abc")
+	tenants := func() int {
+		count := 0
+		n.tenants.Range(func(_, _ interface{}) bool {
+			count++
+			return true
+		})
+		return count
+	}
+
+	assert.Nil(n.Subscribe("vhost1", "a", sub))
+	assert.Nil(n.Subscribe("vhost1", "b", sub))
+	assert.Nil(n.Subscribe("vhost2", "a", sub))
+	assert.Equal(2, tenants())
+
+	n.Unsubscribe("vhost1", "a", sub)
+	assert.Equal(2, tenants())
+	n.Unsubscribe("vhost1", "b", sub)
+	assert.Equal(1, tenants())
+	n.Drop("vhost2")
+	assert.Equal(0, tenants())
+
+	// Tenants with a quota are remembered until it's cleared.
+	n.SetQuota("vhost1", TenantQuota{MaxPatterns: 1})
+	assert.Nil(n.Subscribe("vhost1", "a", sub))
+	n.Drop("vhost1")
+	assert.Equal(1, tenants())
+	assert.Nil(n.Subscribe("vhost1", "a", sub))
+	assert.Equal(ErrQuotaExceeded, n.Subscribe("vhost1", "b", sub))
+	n.SetQuota("vhost1", TenantQuota{})
+	n.Unsubscribe("vhost1", "a", sub)
+	assert.Equal(0, tenants())
+	assert.Equal(TenantUsage{}, n.Usage("vhost1"))
+
+	// Tenants are resubscribed after being forgotten.
+	assert.Nil(n.Subscribe("vhost1", "a", sub))
+	assert.Equal(TenantUsage{Patterns: 1, Subscribers: 1}, n.Usage("vhost1"))
+	assert.Equal([]Subscriber{sub}, n.Subscribers("vhost1", "a"))
+}
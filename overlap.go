@@ -0,0 +1,224 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+// patternStep is a single step of a patternNFA. A literal step consumes the
+// word, any other step consumes any word. An optional step may be skipped,
+// and a repeated step may consume any number of words.
+type patternStep struct {
+	word     string
+	literal  bool
+	optional bool
+	repeat   bool
+}
+
+// accepts indicates if the step consumes the word. A word which is other is
+// distinct from every literal.
+func (s patternStep) accepts(word string, other bool) bool {
+	return !s.literal || (!other && s.word == word)
+}
+
+// patternNFA is a nondeterministic finite automaton accepting the topics
+// matched by a pattern. Its states are the indices of its steps, and it
+// accepts in the state after the last step.
+type patternNFA struct {
+	steps []patternStep
+}
+
+// compilePattern returns the automaton for the pattern keys. A ranged
+// wildcard {n,m} becomes n single-word steps followed by m-n optional ones.
+func (c *Config) compilePattern(keys []string) *patternNFA {
+	steps := make([]patternStep, 0, len(keys))
+	for _, key := range keys {
+		if bounds, ok := c.parseRange(key); ok {
+			for i := 0; i < bounds.max; i++ {
+				steps = append(steps, patternStep{optional: i >= bounds.min})
+			}
+			continue
+		}
+		switch key {
+		case c.SingleWildcard:
+			steps = append(steps, patternStep{})
+		case c.ZeroOrMoreWildcard:
+			steps = append(steps, patternStep{optional: true, repeat: true})
+		default:
+			steps = append(steps, patternStep{word: key, literal: true})
+		}
+	}
+	return &patternNFA{steps: steps}
+}
+
+// start returns the initial set of states.
+func (p *patternNFA) start() []bool {
+	states := make([]bool, len(p.steps)+1)
+	states[0] = true
+	return p.closure(states)
+}
+
+// closure adds the states reachable by skipping optional steps. Skipping
+// only ever moves forward, so a single pass suffices.
+func (p *patternNFA) closure(states []bool) []bool {
+	for i, step := range p.steps {
+		if states[i] && step.optional {
+			states[i+1] = true
+		}
+	}
+	return states
+}
+
+// next returns the set of states reached from the given ones by consuming
+// the word.
+func (p *patternNFA) next(states []bool, word string, other bool) []bool {
+	next := make([]bool, len(p.steps)+1)
+	for i, step := range p.steps {
+		if !states[i] || !step.accepts(word, other) {
+			continue
+		}
+		if step.repeat {
+			next[i] = true
+		} else {
+			next[i+1] = true
+		}
+	}
+	return p.closure(next)
+}
+
+// accepting indicates if the set of states includes the final state.
+func (p *patternNFA) accepting(states []bool) bool {
+	return states[len(p.steps)]
+}
+
+// specificity returns the number of literal words and zero-or-more wildcards
+// in the pattern. A pattern with more literal words is more specific, and
+// ties go to the pattern with fewer zero-or-more wildcards.
+func (p *patternNFA) specificity() (int, int) {
+	var literals, unbounded int
+	for _, step := range p.steps {
+		switch {
+		case step.literal:
+			literals++
+		case step.repeat:
+			unbounded++
+		}
+	}
+	return literals, unbounded
+}
+
+// compareSpecificity returns a positive number if a is more specific than b,
+// a negative number if it is less specific and zero if they are tied.
+func compareSpecificity(a, b *patternNFA) int {
+	aLiterals, aUnbounded := a.specificity()
+	bLiterals, bUnbounded := b.specificity()
+	if aLiterals != bLiterals {
+		return aLiterals - bLiterals
+	}
+	return bUnbounded - aUnbounded
+}
+
+// explore runs both automata in lockstep over every sequence of words and
+// reports if it reaches a pair of state sets for which found returns true.
+// Words which aren't literal in either pattern behave identically, so a
+// single other word stands in for all of them.
+func explore(a, b *patternNFA, found func(aStates, bStates []bool) bool) bool {
+	type pair struct{ a, b []bool }
+	var (
+		words []string
+		seen  = map[string]bool{}
+		queue = []pair{{a.start(), b.start()}}
+	)
+	for _, p := range []*patternNFA{a, b} {
+		for _, step := range p.steps {
+			if step.literal {
+				words = append(words, step.word)
+			}
+		}
+	}
+	key := func(p pair) string {
+		k := make([]byte, 0, len(p.a)+len(p.b)+1)
+		for _, states := range [][]bool{p.a, nil, p.b} {
+			if states == nil {
+				k = append(k, '|')
+			}
+			for _, s := range states {
+				if s {
+					k = append(k, '1')
+				} else {
+					k = append(k, '0')
+				}
+			}
+		}
+		return string(k)
+	}
+	seen[key(queue[0])] = true
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if found(p.a, p.b) {
+			return true
+		}
+		for i := 0; i <= len(words); i++ {
+			var n pair
+			if i < len(words) {
+				n = pair{a.next(p.a, words[i], false), b.next(p.b, words[i], false)}
+			} else {
+				n = pair{a.next(p.a, "", true), b.next(p.b, "", true)}
+			}
+			if k := key(n); !seen[k] {
+				seen[k] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return false
+}
+
+// overlaps indicates if some topic is matched by both automata.
+func overlaps(a, b *patternNFA) bool {
+	return explore(a, b, func(aStates, bStates []bool) bool {
+		return a.accepting(aStates) && b.accepting(bStates)
+	})
+}
+
+// contains indicates if every topic matched by b is also matched by a.
+func contains(a, b *patternNFA) bool {
+	return !explore(a, b, func(aStates, bStates []bool) bool {
+		return b.accepting(bStates) && !a.accepting(aStates)
+	})
+}
+
+// Overlaps indicates if some topic is matched by both patterns, i.e. if a
+// message could be delivered to subscriptions to each of them.
+func (c *Config) Overlaps(a, b string) bool {
+	return overlaps(c.compilePattern(c.patternKeys(a)), c.compilePattern(c.patternKeys(b)))
+}
+
+// Contains indicates if every topic matched by the filter is also matched by
+// the pattern.
+func (c *Config) Contains(pattern, filter string) bool {
+	return contains(c.compilePattern(c.patternKeys(pattern)), c.compilePattern(c.patternKeys(filter)))
+}
+
+// LeadingLiteral returns the normalized leading word of the pattern and true
+// if it's a literal rather than a wildcard. Patterns led by different literals
+// never overlap, so they can be bucketed by it before comparing them.
+func (c *Config) LeadingLiteral(pattern string) (string, bool) {
+	key := c.patternKeys(pattern)[0]
+	if c.hasWildcardForm(key) {
+		return "", false
+	}
+	return key, true
+}
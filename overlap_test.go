@@ -0,0 +1,92 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlaps(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+
+	assert.True(config.Overlaps("a.b", "a.b"))
+	assert.False(config.Overlaps("a.b", "a.c"))
+	assert.True(config.Overlaps("a.*", "*.b"))
+	assert.False(config.Overlaps("a.*", "a"))
+	assert.True(config.Overlaps("a.#", "a"))
+	assert.True(config.Overlaps("#.c", "a.#"))
+	assert.True(config.Overlaps("a.#.b", "#.c.#"))
+	assert.False(config.Overlaps("a.*.b", "a.#.c"))
+	assert.True(config.Overlaps("a.{2,3}", "a.*.*.*"))
+	assert.False(config.Overlaps("a.{2,3}", "a.*.*.*.*"))
+	assert.True(config.Overlaps("a.{0,1}.b", "a.b"))
+}
+
+func TestContains(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+
+	assert.True(config.Contains("#", "a.b.#"))
+	assert.True(config.Contains("a.#", "a.b.*"))
+	assert.True(config.Contains("a.#", "a"))
+	assert.False(config.Contains("a.*", "a.#"))
+	assert.True(config.Contains("a.*", "a.b"))
+	assert.False(config.Contains("a.b", "a.*"))
+	assert.True(config.Contains("*.#", "#.*"))
+	assert.True(config.Contains("#.*", "*.#"))
+	assert.False(config.Contains("a.#.b", "a.#"))
+	assert.True(config.Contains("a.{1,3}", "a.*.{0,2}"))
+	assert.False(config.Contains("a.{1,3}", "a.*.{0,3}"))
+	assert.True(config.Contains("a.#", "a.{0,5}"))
+}
+
+func TestLeadingLiteral(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+	config.FoldCase = true
+
+	word, ok := config.LeadingLiteral("Stock.#")
+	assert.True(ok)
+	assert.Equal("stock", word)
+	word, ok = config.LeadingLiteral("a")
+	assert.True(ok)
+	assert.Equal("a", word)
+	_, ok = config.LeadingLiteral("*.a")
+	assert.False(ok)
+	_, ok = config.LeadingLiteral("#")
+	assert.False(ok)
+	_, ok = config.LeadingLiteral("{0,2}.a")
+	assert.False(ok)
+
+	// Escaped wildcards are literals, and distinct from the wildcards.
+	config.Escape = `\`
+	word, ok = config.LeadingLiteral(`\*.a`)
+	assert.True(ok)
+	other, _ := config.LeadingLiteral(`\*.b`)
+	assert.Equal(word, other)
+	_, ok = config.LeadingLiteral("*.a")
+	assert.False(ok)
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrQuotaExceeded is returned when a subscription would exceed a quota.
+var ErrQuotaExceeded = errors.New("matchbox: quota exceeded")
+
+// Limits bounds the subscriptions of a Matchbox, protecting it from clients
+// which subscribe excessively. Zero means unlimited.
+type Limits struct {
+	// MaxPatternsPerSubscriber is the maximum number of patterns a Subscriber
+	// can be subscribed to.
+	MaxPatternsPerSubscriber int
+
+	// MaxSubscribersPerPattern is the maximum number of Subscribers which can
+	// be subscribed to a pattern.
+	MaxSubscribersPerPattern int
+
+	// MaxDepth is the maximum number of words in a pattern.
+	MaxDepth int
+
+	// MaxNodes is the maximum number of branches in the trie, i.e. the number
+	// of distinct pattern prefixes.
+	MaxNodes int
+}
+
+// insertChange describes a subscription about to be added to the ctrie.
+type insertChange struct {
+	sub Subscriber
+
+	// subscribers is the number of Subscribers already on the pattern, and
+	// nodes the number of branches being created for it.
+	subscribers int
+	nodes       int
+}
+
+// newPattern indicates if the subscription is the first on its pattern.
+func (c insertChange) newPattern() bool {
+	return c.subscribers == 0
+}
+
+// quota limits the subscriptions added to a ctrie.
+type quota interface {
+	// reserve capacity for the change or return an error if there is none.
+	reserve(change insertChange) error
+
+	// release capacity previously reserved or used by the change.
+	release(change insertChange)
+}
+
+// reserve increments the counter by n unless it would exceed the limit.
+func reserve(counter *atomic.Int64, n, limit int) bool {
+	for {
+		current := counter.Load()
+		if limit > 0 && current+int64(n) > int64(limit) {
+			return false
+		}
+		if counter.CompareAndSwap(current, current+int64(n)) {
+			return true
+		}
+	}
+}
+
+// deadCounter marks a counter which was zero and is being removed from the
+// limiter, so it must no longer be used.
+const deadCounter = math.MinInt64
+
+// limiter enforces the Limits of a ctrie. Capacity is reserved with lock-free
+// counters before a subscription is committed and released if the commit
+// fails, so the counters remain correct across retries. A Subscriber's
+// counter is removed once it has no patterns.
+type limiter struct {
+	limits   Limits
+	nodes    atomic.Int64
+	patterns sync.Map // Subscriber ID to *atomic.Int64
+
+	// base is the limiter this one was derived from, if any, in which case
+	// its counters are relative to the base's usage.
+	base *limiter
+}
+
+// newLimiter returns a limiter for the Limits, or nil if they are unlimited.
+func newLimiter(limits Limits) *limiter {
+	if limits == (Limits{}) {
+		return nil
+	}
+	return &limiter{limits: limits}
+}
+
+// derived returns a limiter whose usage starts out as the limiter's and
+// counts its own changes relative to it, so it is created in constant time.
+// Changes to the limiter count towards it too.
+func (l *limiter) derived() *limiter {
+	if l == nil {
+		return nil
+	}
+	return &limiter{limits: l.limits, base: l}
+}
+
+// nodeUsage returns the number of branches in the trie.
+func (l *limiter) nodeUsage() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.nodes.Load() + l.base.nodeUsage()
+}
+
+// patternUsage returns the number of patterns the Subscriber with the ID is
+// subscribed to.
+func (l *limiter) patternUsage(id string) int64 {
+	if l == nil {
+		return 0
+	}
+	n := l.base.patternUsage(id)
+	if counter, ok := l.patterns.Load(id); ok {
+		if current := counter.(*atomic.Int64).Load(); current != deadCounter {
+			n += current
+		}
+	}
+	return n
+}
+
+// subscriberPatterns returns the counter of the Subscriber's patterns.
+func (l *limiter) subscriberPatterns(id string) *atomic.Int64 {
+	if counter, ok := l.patterns.Load(id); ok {
+		return counter.(*atomic.Int64)
+	}
+	counter, _ := l.patterns.LoadOrStore(id, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+// addPatterns adds delta to the number of patterns the Subscriber with the ID
+// is subscribed to, unless it would exceed the limit, in which case false is
+// returned. A counter which reaches zero is marked dead before it is removed,
+// so updates racing with its removal retry with a new counter.
+func (l *limiter) addPatterns(id string, delta int64, limit int) bool {
+	offset := l.base.patternUsage(id)
+	for {
+		counter := l.subscriberPatterns(id)
+		current := counter.Load()
+		if current == deadCounter {
+			l.patterns.CompareAndDelete(id, counter)
+			continue
+		}
+		next := current + delta
+		if delta > 0 && limit > 0 && offset+next > int64(limit) {
+			return false
+		}
+		if next == 0 {
+			if counter.CompareAndSwap(current, deadCounter) {
+				l.patterns.CompareAndDelete(id, counter)
+				return true
+			}
+			continue
+		}
+		if counter.CompareAndSwap(current, next) {
+			return true
+		}
+	}
+}
+
+// checkDepth returns ErrQuotaExceeded if the pattern keys are too deep.
+func (l *limiter) checkDepth(keys []string) error {
+	if l != nil && l.limits.MaxDepth > 0 && len(keys) > l.limits.MaxDepth {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// reserve capacity for the change or return ErrQuotaExceeded.
+func (l *limiter) reserve(change insertChange) error {
+	if l.limits.MaxSubscribersPerPattern > 0 && change.subscribers >= l.limits.MaxSubscribersPerPattern {
+		return ErrQuotaExceeded
+	}
+	id := change.sub.ID()
+	if !l.addPatterns(id, 1, l.limits.MaxPatternsPerSubscriber) {
+		return ErrQuotaExceeded
+	}
+	if !l.reserveNodes(change.nodes) {
+		l.addPatterns(id, -1, 0)
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// reserveNodes reserves n branches unless they would exceed MaxNodes.
+func (l *limiter) reserveNodes(n int) bool {
+	limit := l.limits.MaxNodes
+	if limit == 0 || n <= 0 {
+		return reserve(&l.nodes, n, 0)
+	}
+	offset := l.base.nodeUsage()
+	for {
+		current := l.nodes.Load()
+		if offset+current+int64(n) > int64(limit) {
+			return false
+		}
+		if l.nodes.CompareAndSwap(current, current+int64(n)) {
+			return true
+		}
+	}
+}
+
+// release capacity used by the change.
+func (l *limiter) release(change insertChange) {
+	l.removed(change.sub, change.nodes)
+}
+
+// removed releases the capacity used by a subscription which was removed
+// along with the given number of branches.
+func (l *limiter) removed(sub Subscriber, nodes int) {
+	if l == nil {
+		return
+	}
+	l.addPatterns(sub.ID(), -1, 0)
+	l.pruned(nodes)
+}
+
+// pruned releases the capacity used by branches which were pruned.
+func (l *limiter) pruned(nodes int) {
+	if l != nil && nodes != 0 {
+		l.nodes.Add(-int64(nodes))
+	}
+}
+
+// add adds the changes counted by a limiter derived from this one to it.
+func (l *limiter) add(derived *limiter) {
+	if l == nil {
+		return
+	}
+	l.pruned(-int(derived.nodes.Load()))
+	derived.patterns.Range(func(id, counter any) bool {
+		if delta := counter.(*atomic.Int64).Load(); delta != deadCounter && delta != 0 {
+			l.addPatterns(id.(string), delta, 0)
+		}
+		return true
+	})
+}
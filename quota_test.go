@@ -0,0 +1,187 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 2, MaxSubscribersPerPattern: 2, MaxDepth: 3}
+	mb := New(config).(*matchbox)
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+
+	assert.Nil(mb.TrySubscribe("a.b", sub1))
+	assert.Nil(mb.TrySubscribe("a.b", sub1))
+	assert.Nil(mb.TrySubscribe("a.*", sub1))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("a.c", sub1))
+	assert.Nil(mb.TrySubscribe("a.b", sub2))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("a.b", sub3))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("a.b.c.d", sub3))
+	assert.Equal(ErrQuotaExceeded, mb.SubscribeWords([]string{"a", "b", "c", "d"}, sub3))
+	assert.Nil(mb.TrySubscribe("a.b.c", sub3))
+	assert.Equal(0, mb.RefCount("a.c", sub1.ID()))
+	assert.Len(mb.Subscribers("a.b"), 2)
+
+	mb.Unsubscribe("a.*", sub1)
+	mb.Unsubscribe("a.*", sub1)
+	assert.Nil(mb.TrySubscribe("a.c", sub1))
+	mb.Unsubscribe("a.b", sub2)
+	assert.Nil(mb.TrySubscribe("a.b", sub3))
+
+	// Subscribing through wrappers is limited too.
+	e := NewExchange(config, ConsumerConfig{})
+	defer e.Close()
+	_, err := e.Bind("a.b.c.d")
+	assert.Equal(ErrQuotaExceeded, err)
+	x := NewExpiring(mb, ExpiryConfig{})
+	defer x.Close()
+	assert.Equal(ErrQuotaExceeded, x.SubscribeWithTTL("a.b", sub2, 0))
+}
+
+func TestLimitsMaxNodes(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxNodes: 4}
+	mb := New(config).(*matchbox)
+	limiter := mb.limiter
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+
+	assert.Nil(mb.TrySubscribe("a.b.c", sub1))
+	assert.Equal(int64(3), limiter.nodes.Load())
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("a.c.d", sub1))
+	assert.Nil(mb.TrySubscribe("a.c", sub1))
+	assert.Nil(mb.TrySubscribe("a.b", sub2))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("b", sub1))
+
+	mb.Unsubscribe("a.b.c", sub1)
+	mb.Unsubscribe("a.c", sub1)
+	assert.Equal(int64(2), limiter.nodes.Load())
+	assert.Nil(mb.TrySubscribe("b.c", sub1))
+	assert.Equal(int64(4), limiter.nodes.Load())
+
+	// Writable snapshots are limited independently.
+	snapshot := mb.Snapshot()
+	snapshot.Remove("b.c", sub1)
+	assert.Nil(snapshot.Insert("c", sub1))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("c", sub1))
+	assert.Equal(int64(4), snapshot.limiter.nodeUsage())
+	assert.Equal(int64(4), limiter.nodeUsage())
+}
+
+func TestLimitsPrunesSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 2}
+	mb := New(config).(*matchbox)
+	live := mb.limiter
+	sub := subscriber("abc")
+	counters := func(l *limiter) int {
+		n := 0
+		l.patterns.Range(func(_, _ any) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	assert.Nil(mb.TrySubscribe("a", sub))
+	assert.Nil(mb.TrySubscribe("b", sub))
+	assert.Equal(ErrQuotaExceeded, mb.TrySubscribe("c", sub))
+	assert.Equal(1, counters(live))
+	mb.Unsubscribe("a", sub)
+	mb.Unsubscribe("b", sub)
+	assert.Equal(0, counters(live))
+	assert.Equal(int64(0), live.patternUsage("abc"))
+
+	// Changes to a snapshot are counted relative to the Matchbox.
+	assert.Nil(mb.TrySubscribe("a", sub))
+	snapshot := mb.Snapshot()
+	assert.Nil(snapshot.Insert("b", sub))
+	assert.Equal(ErrQuotaExceeded, snapshot.Insert("c", sub))
+	assert.Equal(int64(2), snapshot.limiter.patternUsage("abc"))
+	snapshot.Remove("b", sub)
+	assert.Equal(0, counters(snapshot.limiter))
+	assert.Equal(int64(1), live.patternUsage("abc"))
+
+	// Applied changes are added to the Matchbox once committed.
+	assert.Nil(mb.Apply([]Change{{Kind: ChangeSubscribe, Topic: "b", Subscriber: sub}}))
+	assert.Equal(int64(2), live.patternUsage("abc"))
+	assert.Equal(ErrQuotaExceeded, mb.Apply([]Change{
+		{Kind: ChangeUnsubscribe, Topic: "a", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "c", Subscriber: sub},
+		{Kind: ChangeSubscribe, Topic: "d", Subscriber: sub},
+	}))
+	assert.Equal(int64(2), live.patternUsage("abc"))
+	mb.Unsubscribe("a", sub)
+	mb.Unsubscribe("b", sub)
+	assert.Equal(0, counters(live))
+}
+
+func TestLimitsConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 30, MaxNodes: 100}
+	mb := New(config)
+	limiter := mb.(*matchbox).limiter
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			sub := subscriber(strconv.Itoa(g))
+			for i := 0; i < 100; i++ {
+				topic := strconv.Itoa(i%10) + "." + strconv.Itoa(i)
+				mb.Subscribe(topic, sub)
+				if i%4 == 0 {
+					mb.Unsubscribe(topic, sub)
+				}
+			}
+			wg.Done()
+		}(g)
+	}
+
+	wg.Wait()
+	nodes := 0
+	for _, topic := range mb.Topics() {
+		if len(topic) > 0 {
+			nodes++
+		}
+	}
+	assert.Equal(int64(nodes), limiter.nodes.Load())
+	assert.True(nodes <= 100)
+	patterns := map[string]int{}
+	for _, subs := range mb.Subscriptions() {
+		for _, sub := range subs {
+			patterns[sub.ID()]++
+		}
+	}
+	for g := 0; g < 4; g++ {
+		id := strconv.Itoa(g)
+		assert.Equal(int64(patterns[id]), limiter.patternUsage(id))
+		assert.True(patterns[id] <= 30)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Workiva/matchbox"
+)
+
+// FollowerOptions configures a Follower.
+type FollowerOptions struct {
+	// NewSubscriber returns the Subscriber for a replicated ID. By default,
+	// Subscribers are identified by their ID alone.
+	NewSubscriber func(id string) matchbox.Subscriber
+}
+
+// Follower applies the subscriptions replicated by a Leader to a Matchbox
+// which can only be read through its View. Follower is safe for concurrent
+// use, but only one Sync may run at a time.
+type Follower struct {
+	config        *matchbox.Config
+	newSubscriber func(id string) matchbox.Subscriber
+
+	mu      sync.Mutex
+	current atomic.Pointer[matchbox.Matchbox]
+	epoch   atomic.Uint64
+	seq     atomic.Uint64
+}
+
+// NewFollower returns a Follower with no subscriptions. The Config must match
+// the Leader's.
+func NewFollower(config *matchbox.Config, opts FollowerOptions) *Follower {
+	if opts.NewSubscriber == nil {
+		opts.NewSubscriber = func(id string) matchbox.Subscriber {
+			return subscriber(id)
+		}
+	}
+	f := &Follower{config: config, newSubscriber: opts.NewSubscriber}
+	mb := matchbox.New(config)
+	f.current.Store(&mb)
+	return f
+}
+
+// Seq returns the sequence number of the last operation applied.
+func (f *Follower) Seq() uint64 {
+	return f.seq.Load()
+}
+
+// Sync replicates from the Leader connected over the conn, resuming from the
+// last operation applied, until either end closes it. It returns the error
+// which ended replication, io.EOF if the Leader closed the conn. The conn is
+// closed when it returns. Call it again with a new conn to reconnect.
+func (f *Follower) Sync(conn net.Conn) error {
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(hello{Epoch: f.epoch.Load(), Resume: f.Seq()}); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(conn)
+	// A snapshot is loaded into a new Matchbox chunk by chunk, replacing the
+	// current one once it's complete.
+	var snapshot matchbox.Matchbox
+	for {
+		var m message
+		if err := decoder.Decode(&m); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return io.EOF
+			}
+			return err
+		}
+		if m.Type != typeSnapshot {
+			if err := f.apply(m); err != nil {
+				return err
+			}
+			continue
+		}
+		if snapshot == nil {
+			snapshot = matchbox.New(f.config)
+		}
+		if err := f.load(snapshot, m); err != nil {
+			return err
+		}
+		if !m.More {
+			f.install(snapshot, m)
+			snapshot = nil
+		}
+	}
+}
+
+// load subscribes the Matchbox to the subscriptions in the chunk of a
+// snapshot.
+func (f *Follower) load(mb matchbox.Matchbox, m message) error {
+	for _, s := range m.Subscriptions {
+		sub := f.newSubscriber(s.Subscriber)
+		for i := 0; i < s.Count; i++ {
+			if err := matchbox.TrySubscribe(mb, s.Pattern, sub); err != nil {
+				return fmt.Errorf("replication: subscribing %s to %q: %w", s.Subscriber, s.Pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// install replaces the current Matchbox with the complete snapshot.
+func (f *Follower) install(mb matchbox.Matchbox, m message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.current.Store(&mb)
+	f.epoch.Store(m.Epoch)
+	f.seq.Store(m.Seq)
+}
+
+// apply applies the operation from the Leader.
+func (f *Follower) apply(m message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if expected := f.seq.Load() + 1; m.Seq != expected {
+		return fmt.Errorf("replication: expected sequence %d, got %d", expected, m.Seq)
+	}
+	mb := *f.current.Load()
+	sub := f.newSubscriber(m.Subscriber)
+	switch m.Type {
+	case typeSubscribe:
+		if err := matchbox.TrySubscribe(mb, m.Pattern, sub); err != nil {
+			return fmt.Errorf("replication: subscribing %s to %q: %w", m.Subscriber, m.Pattern, err)
+		}
+	case typeUnsubscribe:
+		mb.Unsubscribe(m.Pattern, sub)
+	default:
+		return fmt.Errorf("replication: unknown message type %q", m.Type)
+	}
+	f.seq.Store(m.Seq)
+	return nil
+}
+
+// View returns a Matchbox reading the Follower's current subscriptions.
+// Subscriptions can't be changed through it: Subscribe and Unsubscribe do
+// nothing and TrySubscribe returns ErrReadOnly.
+func (f *Follower) View() matchbox.Matchbox {
+	return view{f}
+}
+
+// view is a read-only Matchbox over a Follower's current subscriptions.
+type view struct {
+	f *Follower
+}
+
+// mb returns the Follower's current Matchbox.
+func (v view) mb() matchbox.Matchbox {
+	return *v.f.current.Load()
+}
+
+// Subscribe does nothing.
+func (v view) Subscribe(topic string, subscriber matchbox.Subscriber) {}
+
+// TrySubscribe returns ErrReadOnly.
+func (v view) TrySubscribe(topic string, subscriber matchbox.Subscriber) error {
+	return ErrReadOnly
+}
+
+// Unsubscribe does nothing.
+func (v view) Unsubscribe(topic string, subscriber matchbox.Subscriber) {}
+
+// Subscribers returns the Subscribers for a topic.
+func (v view) Subscribers(topic string) []matchbox.Subscriber {
+	return v.mb().Subscribers(topic)
+}
+
+// ReadOnly returns a read-only, point-in-time snapshot of the current
+// subscriptions, which implements the Follower's Matchbox's other interfaces.
+func (v view) ReadOnly() matchbox.Matchbox {
+	return matchbox.ReadOnly(v.mb())
+}
+
+// Subscriptions returns a map of topics to Subscribers.
+func (v view) Subscriptions() map[string][]matchbox.Subscriber {
+	return v.mb().Subscriptions()
+}
+
+// Topics returns all of the currently contained topics.
+func (v view) Topics() []string {
+	return v.mb().Topics()
+}
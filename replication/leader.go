@@ -0,0 +1,195 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replication
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/Workiva/matchbox"
+)
+
+const (
+	// DefaultRetain is the number of operations a Leader retains for
+	// followers to resume from by default.
+	DefaultRetain = 4096
+
+	// DefaultSnapshotChunk is the number of subscriptions a Leader sends in
+	// each message of a snapshot by default.
+	DefaultSnapshotChunk = 1024
+)
+
+// LeaderOptions configures a Leader.
+type LeaderOptions struct {
+	// Retain is the number of recent operations retained for followers to
+	// resume from. Followers which fall further behind are sent a snapshot.
+	// Defaults to DefaultRetain.
+	Retain int
+
+	// SnapshotChunk is the maximum number of subscriptions sent in each
+	// message of a snapshot, so no message grows with the number of
+	// subscriptions. Defaults to DefaultSnapshotChunk.
+	SnapshotChunk int
+}
+
+// Leader replicates the subscriptions of a Matchbox to Followers. Every write
+// must go through the Leader to be replicated. Writes are serialized so each
+// is assigned the next sequence number. Leader is safe for concurrent use.
+type Leader struct {
+	mb     matchbox.Matchbox
+	retain int
+	chunk  int
+	epoch  uint64
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	seq    uint64
+	log    []message // the operations with sequence numbers from start
+	start  uint64
+	closed bool
+}
+
+// NewLeader returns a Leader replicating the Matchbox, which may already have
+// subscriptions.
+func NewLeader(mb matchbox.Matchbox, opts LeaderOptions) *Leader {
+	if opts.Retain <= 0 {
+		opts.Retain = DefaultRetain
+	}
+	if opts.SnapshotChunk <= 0 {
+		opts.SnapshotChunk = DefaultSnapshotChunk
+	}
+	l := &Leader{mb: mb, retain: opts.Retain, chunk: opts.SnapshotChunk, epoch: newEpoch(), start: 1}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// newEpoch returns a random, non-zero epoch identifying a Leader's sequence
+// numbers.
+func newEpoch() uint64 {
+	for {
+		if epoch := rand.Uint64(); epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// Subscribe a Subscriber to a topic, replicating it if it succeeds.
+func (l *Leader) Subscribe(topic string, sub matchbox.Subscriber) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := matchbox.TrySubscribe(l.mb, topic, sub); err != nil {
+		return err
+	}
+	l.append(typeSubscribe, topic, sub)
+	return nil
+}
+
+// Unsubscribe a Subscriber from a topic, replicating it.
+func (l *Leader) Unsubscribe(topic string, sub matchbox.Subscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mb.Unsubscribe(topic, sub)
+	l.append(typeUnsubscribe, topic, sub)
+}
+
+// append assigns the operation the next sequence number, retains it and
+// wakes the followers. The lock must be held.
+func (l *Leader) append(typ, topic string, sub matchbox.Subscriber) {
+	l.seq++
+	l.log = append(l.log, message{Type: typ, Seq: l.seq, Pattern: topic, Subscriber: sub.ID()})
+	if len(l.log) >= 2*l.retain {
+		l.log = append([]message(nil), l.log[len(l.log)-l.retain:]...)
+		l.start = l.log[0].Seq
+	}
+	l.cond.Broadcast()
+}
+
+// Seq returns the sequence number of the last operation.
+func (l *Leader) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Close stops serving Followers. Serve returns nil once it notices.
+func (l *Leader) Close() {
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// Serve replicates to the Follower connected over the conn until either end
+// closes it or the Leader is closed, which returns nil. The conn is closed
+// when it returns.
+func (l *Leader) Serve(conn net.Conn) error {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	var h hello
+	if err := decoder.Decode(&h); err != nil {
+		return err
+	}
+
+	// The follower sends nothing more, so a read returns when it hangs up.
+	hungUp := false
+	go func() {
+		io.Copy(io.Discard, io.MultiReader(decoder.Buffered(), conn))
+		l.mu.Lock()
+		hungUp = true
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	}()
+
+	encoder := json.NewEncoder(conn)
+	// A follower of another epoch has followed another leader, so its
+	// sequence numbers mean nothing here.
+	next, resync := h.Resume+1, h.Resume == 0 || h.Epoch != l.epoch
+	for {
+		l.mu.Lock()
+		for !resync && next > l.seq && !l.closed && !hungUp {
+			l.cond.Wait()
+		}
+		if l.closed || hungUp {
+			l.mu.Unlock()
+			return nil
+		}
+		var messages []message
+		var snapshot matchbox.Matchbox
+		seq := l.seq
+		if resync || next < l.start {
+			snapshot = matchbox.ReadOnly(l.mb)
+		} else {
+			messages = append(messages, l.log[next-l.start:]...)
+		}
+		next, resync = seq+1, false
+		l.mu.Unlock()
+
+		if snapshot != nil {
+			if err := writeSnapshot(encoder, snapshot, l.epoch, seq, l.chunk); err != nil {
+				return err
+			}
+		}
+		for _, m := range messages {
+			if err := encoder.Encode(m); err != nil {
+				return err
+			}
+		}
+	}
+}
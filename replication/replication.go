@@ -0,0 +1,127 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package replication keeps the subscriptions of follower Matchboxes in sync with
+a leader over any net.Conn.
+
+Every subscribe and unsubscribe made through a Leader is assigned the next
+sequence number. A Follower connecting for the first time is sent a snapshot of
+the leader's subscriptions followed by an ordered stream of the operations after
+it. A Follower reconnecting resumes from the last sequence number it applied,
+receiving only the operations it missed if the Leader still retains them and a
+fresh snapshot otherwise. Each Leader has a random epoch, sent with its
+snapshots, so a Follower reconnecting to a different Leader is sent a snapshot
+rather than operations numbered by another.
+
+Subscribers are replicated by ID, so Followers must be given a way to turn IDs
+back into Subscribers unless IDs alone suffice. Shared subscription groups are
+not replicated, so their members are left out of snapshots.
+
+The protocol is a stream of JSON values. The follower sends a hello with the
+epoch and sequence number to resume from, after which the leader sends snapshot,
+subscribe and unsubscribe messages. A snapshot is sent in chunks of a bounded
+number of subscriptions, each but the last marked as having more to follow, and
+is applied once the last arrives.
+*/
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/Workiva/matchbox"
+)
+
+// ErrReadOnly is returned when subscribing to a Follower's view.
+var ErrReadOnly = errors.New("replication: follower is read-only")
+
+// Message types sent by the leader.
+const (
+	typeSnapshot    = "snapshot"
+	typeSubscribe   = "subscribe"
+	typeUnsubscribe = "unsubscribe"
+)
+
+// hello is sent by the follower when it connects. Resume is the sequence
+// number of the last operation it applied, or zero if it has none, and Epoch
+// the epoch of the leader which sent it.
+type hello struct {
+	Epoch  uint64 `json:"epoch,omitempty"`
+	Resume uint64 `json:"resume"`
+}
+
+// message is sent by the leader: either a chunk of a snapshot of its
+// subscriptions as of the sequence number, along with the leader's epoch and
+// whether more chunks follow, or the operation with the sequence number.
+type message struct {
+	Type  string `json:"type"`
+	Epoch uint64 `json:"epoch,omitempty"`
+	Seq   uint64 `json:"seq"`
+
+	Pattern    string `json:"pattern,omitempty"`
+	Subscriber string `json:"subscriber,omitempty"`
+
+	Subscriptions []subscription `json:"subscriptions,omitempty"`
+	More          bool           `json:"more,omitempty"`
+}
+
+// subscription is a pattern subscribed to by the Subscriber with the ID Count
+// times, which is more than once only if the Config counts references.
+type subscription struct {
+	Pattern    string `json:"pattern"`
+	Subscriber string `json:"subscriber"`
+	Count      int    `json:"count"`
+}
+
+// subscriber is a Subscriber identified by its ID alone.
+type subscriber string
+
+// ID returns the Subscriber's ID.
+func (s subscriber) ID() string {
+	return string(s)
+}
+
+// writeSnapshot writes a snapshot of the subscriptions of the read-only
+// Matchbox as of the sequence number in the epoch, in chunks of at most chunk
+// subscriptions enumerated as they are written. Members of shared
+// subscription groups are left out, as groups are not replicated.
+func writeSnapshot(encoder *json.Encoder, snapshot matchbox.Matchbox, epoch, seq uint64, chunk int) error {
+	m := message{Type: typeSnapshot, Epoch: epoch, Seq: seq, Subscriptions: []subscription{}, More: true}
+	refCounter, counted := snapshot.(matchbox.RefCounter)
+	var err error
+	matchbox.Enumerate(snapshot, "", func(s matchbox.Subscription) bool {
+		for _, sub := range s.Subscribers {
+			if len(m.Subscriptions) == chunk {
+				if err = encoder.Encode(m); err != nil {
+					return false
+				}
+				m.Subscriptions = m.Subscriptions[:0]
+			}
+			count := 1
+			if counted {
+				count = refCounter.RefCount(s.Pattern, sub.ID())
+			}
+			m.Subscriptions = append(m.Subscriptions, subscription{Pattern: s.Pattern, Subscriber: sub.ID(), Count: count})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	m.More = false
+	return encoder.Encode(m)
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Workiva/matchbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// connection replicates from the Leader to the Follower over a pipe,
+// returning the follower's end of it and a channel receiving the errors
+// which ended Serve and Sync, in that order.
+func connection(l *Leader, f *Follower) (net.Conn, chan error) {
+	leaderConn, followerConn := net.Pipe()
+	serveErr, syncErr := make(chan error, 1), make(chan error, 1)
+	go func() { serveErr <- l.Serve(leaderConn) }()
+	go func() { syncErr <- f.Sync(followerConn) }()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- <-serveErr
+		errs <- <-syncErr
+	}()
+	return followerConn, errs
+}
+
+// caughtUp waits for the Follower to apply every operation of the Leader.
+func caughtUp(t *testing.T, l *Leader, f *Follower) {
+	assert.Eventually(t, func() bool { return f.Seq() == l.Seq() }, time.Second, time.Millisecond)
+}
+
+// ids returns the sorted IDs of the Subscribers.
+func ids(subs []matchbox.Subscriber) []string {
+	ids := []string{}
+	for _, sub := range subs {
+		ids = append(ids, sub.ID())
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestReplication(t *testing.T) {
+	assert := assert.New(t)
+	mb := matchbox.New(matchbox.NewAMQPConfig())
+	mb.Subscribe("a.*", subscriber("abc"))
+	l := NewLeader(mb, LeaderOptions{})
+	assert.Nil(l.Subscribe("a.b", subscriber("def")))
+	f := NewFollower(matchbox.NewAMQPConfig(), FollowerOptions{})
+
+	conn, errs := connection(l, f)
+	caughtUp(t, l, f)
+	view := f.View()
+	assert.Equal([]string{"abc", "def"}, ids(view.Subscribers("a.b")))
+
+	assert.Nil(l.Subscribe("a.#", subscriber("ghi")))
+	l.Unsubscribe("a.*", subscriber("abc"))
+	caughtUp(t, l, f)
+	assert.Equal(uint64(3), f.Seq())
+	assert.Equal([]string{"def", "ghi"}, ids(view.Subscribers("a.b")))
+	assert.Equal(mb.Subscriptions(), view.Subscriptions())
+
+	conn.Close()
+	assert.Nil(<-errs)
+	assert.NotNil(<-errs)
+}
+
+func TestResume(t *testing.T) {
+	assert := assert.New(t)
+	l := NewLeader(matchbox.New(matchbox.NewAMQPConfig()), LeaderOptions{Retain: 2})
+	f := NewFollower(matchbox.NewAMQPConfig(), FollowerOptions{})
+	l.Subscribe("a", subscriber("abc"))
+
+	conn, errs := connection(l, f)
+	caughtUp(t, l, f)
+	conn.Close()
+	<-errs
+	<-errs
+
+	// The missed operation is retained, so only it is sent.
+	resumed := f.current.Load()
+	l.Subscribe("b", subscriber("abc"))
+	conn, errs = connection(l, f)
+	caughtUp(t, l, f)
+	assert.True(resumed == f.current.Load())
+	assert.Equal([]string{"abc"}, ids(f.View().Subscribers("b")))
+	conn.Close()
+	<-errs
+	<-errs
+
+	// Missed operations which are no longer retained are sent as a snapshot.
+	for _, topic := range []string{"c", "d", "e", "f"} {
+		l.Subscribe(topic, subscriber("def"))
+	}
+	conn, errs = connection(l, f)
+	caughtUp(t, l, f)
+	assert.False(resumed == f.current.Load())
+	assert.Equal(uint64(6), f.Seq())
+	assert.Len(f.View().Subscriptions(), 6)
+
+	l.Close()
+	assert.Nil(<-errs)
+	assert.NotNil(<-errs)
+	conn.Close()
+}
+
+func TestResumeFromNewLeader(t *testing.T) {
+	assert := assert.New(t)
+	l := NewLeader(matchbox.New(matchbox.NewAMQPConfig()), LeaderOptions{})
+	f := NewFollower(matchbox.NewAMQPConfig(), FollowerOptions{})
+	l.Subscribe("a", subscriber("abc"))
+	l.Subscribe("b", subscriber("abc"))
+	conn, errs := connection(l, f)
+	caughtUp(t, l, f)
+	conn.Close()
+	<-errs
+	<-errs
+
+	// A replacement leader is behind the follower, which is resynchronized.
+	l = NewLeader(matchbox.New(matchbox.NewAMQPConfig()), LeaderOptions{})
+	l.Subscribe("c", subscriber("def"))
+	conn, errs = connection(l, f)
+	caughtUp(t, l, f)
+	assert.Equal(map[string][]matchbox.Subscriber{"c": {subscriber("def")}}, f.View().Subscriptions())
+	conn.Close()
+	<-errs
+	<-errs
+
+	// So is a follower which a replacement leader is ahead of, as its
+	// sequence numbers are from another epoch.
+	l = NewLeader(matchbox.New(matchbox.NewAMQPConfig()), LeaderOptions{})
+	l.Subscribe("d", subscriber("ghi"))
+	l.Subscribe("e", subscriber("ghi"))
+	conn, errs = connection(l, f)
+	caughtUp(t, l, f)
+	assert.Equal(l.epoch, f.epoch.Load())
+	assert.ElementsMatch([]string{"d", "e"}, f.View().Topics())
+	conn.Close()
+	<-errs
+	<-errs
+}
+
+func TestReplicateWithoutGroups(t *testing.T) {
+	assert := assert.New(t)
+	mb := matchbox.New(matchbox.NewAMQPConfig())
+	mb.Subscribe("a", subscriber("abc"))
+	assert.Nil(mb.(matchbox.GroupMatchbox).SubscribeGroup("g", "a", subscriber("abc")))
+	assert.Nil(mb.(matchbox.GroupMatchbox).SubscribeGroup("g", "b", subscriber("def")))
+	l := NewLeader(mb, LeaderOptions{})
+
+	assert.Equal([]message{{Type: typeSnapshot, Epoch: l.epoch, Seq: 2,
+		Subscriptions: []subscription{{Pattern: "a", Subscriber: "abc", Count: 1}}}},
+		snapshotMessages(t, matchbox.ReadOnly(mb), l.epoch, DefaultSnapshotChunk))
+}
+
+// snapshotMessages returns the messages of a snapshot of the Matchbox as of
+// sequence number 2, in chunks of the given size.
+func snapshotMessages(t *testing.T, snapshot matchbox.Matchbox, epoch uint64, chunk int) []message {
+	var buf bytes.Buffer
+	assert.Nil(t, writeSnapshot(json.NewEncoder(&buf), snapshot, epoch, 2, chunk))
+	messages := []message{}
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var m message
+		assert.Nil(t, decoder.Decode(&m))
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestReplicateSnapshotChunks(t *testing.T) {
+	assert := assert.New(t)
+	mb := matchbox.New(matchbox.NewAMQPConfig())
+	mb.Subscribe("a", subscriber("abc"))
+	mb.Subscribe("a", subscriber("def"))
+	mb.Subscribe("b", subscriber("abc"))
+	mb.Subscribe("c.*", subscriber("ghi"))
+	mb.Subscribe("d", subscriber("abc"))
+
+	assert.Equal([]message{
+		{Type: typeSnapshot, Epoch: 1, Seq: 2, More: true, Subscriptions: []subscription{
+			{Pattern: "a", Subscriber: "abc", Count: 1}, {Pattern: "a", Subscriber: "def", Count: 1}}},
+		{Type: typeSnapshot, Epoch: 1, Seq: 2, More: true, Subscriptions: []subscription{
+			{Pattern: "b", Subscriber: "abc", Count: 1}, {Pattern: "c.*", Subscriber: "ghi", Count: 1}}},
+		{Type: typeSnapshot, Epoch: 1, Seq: 2, Subscriptions: []subscription{
+			{Pattern: "d", Subscriber: "abc", Count: 1}}},
+	}, snapshotMessages(t, matchbox.ReadOnly(mb), 1, 2))
+	assert.Equal([]message{{Type: typeSnapshot, Epoch: 1, Seq: 2}},
+		snapshotMessages(t, matchbox.New(matchbox.NewAMQPConfig()), 1, 2))
+
+	// The Follower loads every chunk before replacing its subscriptions.
+	l := NewLeader(mb, LeaderOptions{SnapshotChunk: 1})
+	f := NewFollower(matchbox.NewAMQPConfig(), FollowerOptions{})
+	conn, errs := connection(l, f)
+	caughtUp(t, l, f)
+	assert.Eventually(func() bool { return len(f.View().Subscriptions()) == 4 }, time.Second, time.Millisecond)
+	assert.ElementsMatch([]matchbox.Subscriber{subscriber("abc"), subscriber("def")}, f.View().Subscribers("a"))
+	conn.Close()
+	<-errs
+	<-errs
+}
+
+func TestReplicateRefCounts(t *testing.T) {
+	assert := assert.New(t)
+	config := matchbox.NewAMQPConfig()
+	config.RefCount = true
+	mb := matchbox.New(config)
+	mb.Subscribe("a", subscriber("abc"))
+	mb.Subscribe("a", subscriber("abc"))
+	l := NewLeader(mb, LeaderOptions{})
+	f := NewFollower(config, FollowerOptions{})
+
+	conn, errs := connection(l, f)
+	caughtUp(t, l, f)
+	refCount := func() int {
+		return matchbox.ReadOnly(f.View()).(matchbox.RefCounter).RefCount("a", "abc")
+	}
+	assert.Eventually(func() bool { return refCount() == 2 }, time.Second, time.Millisecond)
+	l.Unsubscribe("a", subscriber("abc"))
+	caughtUp(t, l, f)
+	assert.Equal(1, refCount())
+	conn.Close()
+	<-errs
+	<-errs
+}
+
+func TestView(t *testing.T) {
+	assert := assert.New(t)
+	type named struct {
+		subscriber
+		name string
+	}
+	f := NewFollower(matchbox.NewAMQPConfig(), FollowerOptions{
+		NewSubscriber: func(id string) matchbox.Subscriber { return named{subscriber(id), "sub " + id} },
+	})
+	assert.Nil(f.apply(message{Type: typeSubscribe, Seq: 1, Pattern: "a.*", Subscriber: "abc"}))
+	assert.EqualError(f.apply(message{Type: typeSubscribe, Seq: 3, Pattern: "a", Subscriber: "abc"}),
+		"replication: expected sequence 2, got 3")
+
+	view := f.View()
+	assert.Equal([]matchbox.Subscriber{named{subscriber("abc"), "sub abc"}}, view.Subscribers("a.b"))
+	assert.Equal(ErrReadOnly, matchbox.TrySubscribe(view, "a", subscriber("abc")))
+	view.Subscribe("a", subscriber("abc"))
+	view.Unsubscribe("a.*", subscriber("abc"))
+	assert.Equal([]matchbox.Subscriber{named{subscriber("abc"), "sub abc"}}, view.Subscribers("a.b"))
+	assert.ElementsMatch([]string{"a", "a.*"}, matchbox.ReadOnly(view).Topics())
+	_, ok := view.(matchbox.GroupMatchbox)
+	assert.False(ok)
+}
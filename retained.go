@@ -0,0 +1,177 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"iter"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Retained is a message retained for a concrete topic.
+type Retained struct {
+	Topic   string
+	Payload []byte
+}
+
+// retainedMessage is the Subscriber stored in the ctrie for a retained
+// message. Every message has the same ID, so retaining another message for a
+// topic replaces the previous one.
+type retainedMessage struct {
+	Retained
+}
+
+// ID returns the retained message's ID.
+func (r *retainedMessage) ID() string {
+	return ""
+}
+
+// RetainedStore stores the last message retained for each concrete topic and
+// retrieves those matching a filter, the inverse of looking up the
+// Subscribers for a topic. Wildcards in filters follow the Config.
+type RetainedStore struct {
+	ctrie *ctrie
+}
+
+// NewRetainedStore creates a new RetainedStore with the given Config.
+func NewRetainedStore(config *Config) *RetainedStore {
+	return &RetainedStore{ctrie: newCtrie(config)}
+}
+
+// Retain stores the payload as the retained message for the topic, replacing
+// any previous one. An empty payload clears the retained message.
+func (r *RetainedStore) Retain(topic string, payload []byte) {
+	keys := r.ctrie.config.topicKeys(topic)
+	msg := &retainedMessage{Retained{Topic: topic, Payload: payload}}
+	if len(payload) == 0 {
+		r.ctrie.remove(keys, msg)
+		return
+	}
+	r.ctrie.insert(keys, msg, "", true)
+}
+
+// Clear removes the retained message for the topic, if any.
+func (r *RetainedStore) Clear(topic string) {
+	r.Retain(topic, nil)
+}
+
+// Get returns the retained message for the topic and true, or false if there
+// is none.
+func (r *RetainedStore) Get(topic string) (Retained, bool) {
+	br := r.ctrie.exactBranch(r.ctrie.config.topicKeys(topic))
+	if br == nil {
+		return Retained{}, false
+	}
+	return retainedOn(br)
+}
+
+// Match returns an iterator over the retained messages whose topics match the
+// filter. The messages are read from a snapshot taken when iteration begins.
+func (r *RetainedStore) Match(filter string) iter.Seq[Retained] {
+	keys := r.ctrie.config.patternKeys(filter)
+	return func(yield func(Retained) bool) {
+		snapshot := r.ctrie.ReadOnlySnapshot()
+		m := &retainedMatch{config: snapshot.config, yield: yield, seen: map[string]bool{}}
+		m.match(nil, snapshot.root, keys)
+	}
+}
+
+// retainedOn returns the retained message on the branch and true, or false if
+// there is none.
+func retainedOn(br *branch) (Retained, bool) {
+	if sub, ok := br.subs[""]; ok {
+		return sub.(*retainedMessage).Retained, true
+	}
+	return Retained{}, false
+}
+
+// retainedMatch walks a read-only snapshot, yielding the retained messages
+// matching a filter.
+type retainedMatch struct {
+	config *Config
+	yield  func(Retained) bool
+	seen   map[string]bool
+}
+
+// match yields the retained messages matching the keys, starting from the
+// branch for the words consumed so far, whose children are below the I-node.
+// The branch is nil at the root. False is returned if iteration was stopped.
+func (m *retainedMatch) match(br *branch, in *iNode, keys []string) bool {
+	if len(keys) == 0 {
+		if br == nil {
+			return true
+		}
+		msg, ok := retainedOn(br)
+		if !ok || m.seen[msg.Topic] {
+			return true
+		}
+		m.seen[msg.Topic] = true
+		return m.yield(msg)
+	}
+	var children map[string]*branch
+	if in != nil {
+		main := (*mainNode)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&in.main))))
+		if main.cNode != nil {
+			children = main.cNode.branches
+		}
+	}
+	key := keys[0]
+	if bounds, ok := m.config.parseRange(key); ok {
+		// Consume one word at a time until the range is exhausted.
+		if bounds.min == 0 && !m.match(br, in, keys[1:]) {
+			return false
+		}
+		rest := keys[1:]
+		if bounds.max > 1 {
+			next := wordRange{min: bounds.min - 1, max: bounds.max - 1}
+			if next.min < 0 {
+				next.min = 0
+			}
+			rest = append([]string{m.config.formatRange(next)}, rest...)
+		}
+		for _, child := range children {
+			if !m.match(child, child.iNode, rest) {
+				return false
+			}
+		}
+		return true
+	}
+	switch key {
+	case m.config.ZeroOrMoreWildcard:
+		// Match zero words, then one or more by consuming a word and keeping
+		// the wildcard.
+		if !m.match(br, in, keys[1:]) {
+			return false
+		}
+		for _, child := range children {
+			if !m.match(child, child.iNode, keys) {
+				return false
+			}
+		}
+	case m.config.SingleWildcard:
+		for _, child := range children {
+			if !m.match(child, child.iNode, keys[1:]) {
+				return false
+			}
+		}
+	default:
+		if child, ok := children[key]; ok {
+			return m.match(child, child.iNode, keys[1:])
+		}
+	}
+	return true
+}
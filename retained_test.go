@@ -0,0 +1,109 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// retainedTopics returns the sorted topics of the retained messages matching
+// the filter.
+func retainedTopics(r *RetainedStore, filter string) []string {
+	topics := []string{}
+	for msg := range r.Match(filter) {
+		topics = append(topics, msg.Topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestRetainedStore(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+	r := NewRetainedStore(config)
+
+	_, ok := r.Get("a")
+	assert.False(ok)
+	assert.Equal([]string{}, retainedTopics(r, "#"))
+
+	r.Retain("a", []byte("1"))
+	r.Retain("a.b", []byte("2"))
+	r.Retain("a.b.c", []byte("3"))
+	r.Retain("a.x.c", []byte("4"))
+	r.Retain("b.c", []byte("5"))
+
+	msg, ok := r.Get("a.b")
+	assert.True(ok)
+	assert.Equal(Retained{Topic: "a.b", Payload: []byte("2")}, msg)
+	_, ok = r.Get("a.b.c.d")
+	assert.False(ok)
+	_, ok = r.Get("a.x")
+	assert.False(ok)
+
+	assert.Equal([]string{"a", "a.b", "a.b.c", "a.x.c", "b.c"}, retainedTopics(r, "#"))
+	assert.Equal([]string{"a", "a.b", "a.b.c", "a.x.c"}, retainedTopics(r, "a.#"))
+	assert.Equal([]string{"a.b.c", "a.x.c"}, retainedTopics(r, "a.*.c"))
+	assert.Equal([]string{"a.b.c", "a.x.c", "b.c"}, retainedTopics(r, "#.c"))
+	assert.Equal([]string{"a.b", "b.c"}, retainedTopics(r, "*.*"))
+	assert.Equal([]string{"a.b"}, retainedTopics(r, "a.b"))
+	assert.Equal([]string{}, retainedTopics(r, "a.b.c.*"))
+	assert.Equal([]string{"a.b", "a.b.c", "a.x.c"}, retainedTopics(r, "a.{1,2}"))
+	assert.Equal([]string{"a", "a.b"}, retainedTopics(r, "a.{0,1}"))
+	assert.Equal([]string{"a.b.c", "a.x.c"}, retainedTopics(r, "{2}.c"))
+
+	// Retaining again replaces the message, an empty payload clears it.
+	r.Retain("a.b", []byte("6"))
+	msg, _ = r.Get("a.b")
+	assert.Equal([]byte("6"), msg.Payload)
+	r.Retain("a.b", nil)
+	_, ok = r.Get("a.b")
+	assert.False(ok)
+	assert.Equal([]string{"a", "a.b.c", "a.x.c"}, retainedTopics(r, "a.{0,2}"))
+	r.Clear("a.b.c")
+	assert.Equal([]string{"a", "a.x.c"}, retainedTopics(r, "a.#"))
+
+	// Iteration can stop early.
+	count := 0
+	for range r.Match("#") {
+		count++
+		break
+	}
+	assert.Equal(1, count)
+}
+
+func TestRetainedStoreSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRetainedStore(NewAMQPConfig())
+	r.Retain("a.b", []byte("1"))
+	r.Retain("a.c", []byte("2"))
+
+	// Changes made during iteration are not observed.
+	topics := []string{}
+	for msg := range r.Match("a.*") {
+		topics = append(topics, msg.Topic)
+		r.Retain("a.d", []byte("3"))
+		r.Clear("a.b")
+		r.Clear("a.c")
+	}
+	assert.Len(topics, 2)
+	assert.Equal([]string{"a.d"}, retainedTopics(r, "a.*"))
+}
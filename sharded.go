@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+const (
+	// DefaultShards is the default number of shards for patterns which begin
+	// with literal words.
+	DefaultShards = 16
+)
+
+// ShardConfig configures how a Sharded matchbox partitions patterns.
+type ShardConfig struct {
+	// Shards is the number of shards for patterns which begin with literal
+	// words. Defaults to DefaultShards.
+	Shards int
+
+	// Words is the number of leading words patterns are partitioned by.
+	// Patterns with a wildcard among them go to a dedicated wildcard shard.
+	// Defaults to one.
+	Words int
+}
+
+// shard is one of the independent tries of a Sharded matchbox. Writes hold the
+// read lock, which is held exclusively while snapshotting.
+type shard struct {
+	mu    sync.RWMutex
+	ctrie *ctrie
+}
+
+// Sharded partitions patterns across independent concurrent tries by their
+// leading words, so writers to different partitions never contend on the same
+// I-nodes. Patterns led by a wildcard go to a dedicated shard, which every
+// lookup searches in addition to the topic's own shard. The Config's Limits
+// apply across all shards. Sharded is safe for concurrent use.
+type Sharded struct {
+	config *Config
+	words  int
+	seed   maphash.Seed
+
+	// shards holds the shards for literal-led patterns followed by the
+	// wildcard shard.
+	shards []*shard
+}
+
+// NewSharded creates a new Sharded matchbox with the given Configs.
+func NewSharded(config *Config, shardConfig ShardConfig) *Sharded {
+	if shardConfig.Shards <= 0 {
+		shardConfig.Shards = DefaultShards
+	}
+	if shardConfig.Words <= 0 {
+		shardConfig.Words = 1
+	}
+	limiter := newLimiter(config.Limits)
+	s := &Sharded{config: config, words: shardConfig.Words, seed: maphash.MakeSeed()}
+	for i := 0; i <= shardConfig.Shards; i++ {
+		ctrie := newCtrie(config)
+		ctrie.limiter = limiter
+		s.shards = append(s.shards, &shard{ctrie: ctrie})
+	}
+	return s
+}
+
+// wildcardShard returns the shard for patterns led by a wildcard.
+func (s *Sharded) wildcardShard() *shard {
+	return s.shards[len(s.shards)-1]
+}
+
+// shard returns the shard for the key path. If pattern is true, wildcards
+// among the leading words select the wildcard shard.
+func (s *Sharded) shard(keys []string, pattern bool) *shard {
+	n := len(keys)
+	if n > s.words {
+		n = s.words
+	}
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	for _, key := range keys[:n] {
+		if pattern && s.config.isWildcard(key) {
+			return s.wildcardShard()
+		}
+		h.WriteString(key)
+		// Separate the words with a zero byte.
+		h.WriteByte(0)
+	}
+	return s.shards[h.Sum64()%uint64(len(s.shards)-1)]
+}
+
+// Subscribe a Subscriber to a topic.
+func (s *Sharded) Subscribe(topic string, subscriber Subscriber) {
+	s.TrySubscribe(topic, subscriber)
+}
+
+// TrySubscribe subscribes a Subscriber to a topic, returning ErrQuotaExceeded
+// if it would exceed the Config's Limits and ErrRangeTooLarge if the topic has
+// an oversized ranged wildcard.
+func (s *Sharded) TrySubscribe(topic string, subscriber Subscriber) error {
+	keys := s.config.patternKeys(topic)
+	if err := s.config.checkRanges(keys); err != nil {
+		return err
+	}
+	shard := s.shard(keys, true)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.ctrie.insert(keys, subscriber, s.config.subscribedTopic(keys, topic), false)
+}
+
+// Unsubscribe a Subscriber from a topic.
+func (s *Sharded) Unsubscribe(topic string, subscriber Subscriber) {
+	keys := s.config.patternKeys(topic)
+	shard := s.shard(keys, true)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	shard.ctrie.remove(keys, subscriber)
+}
+
+// Subscribers returns the Subscribers for a topic, merging those of the
+// topic's shard with those of the wildcard shard.
+func (s *Sharded) Subscribers(topic string) []Subscriber {
+	keys := s.config.topicKeys(topic)
+	subs := s.shard(keys, false).ctrie.lookup(keys)
+	wildcard := s.wildcardShard().ctrie.lookup(keys)
+	if len(subs) == 0 {
+		return wildcard
+	}
+	if len(wildcard) == 0 {
+		return subs
+	}
+	seen := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		seen[sub.ID()] = true
+	}
+	for _, sub := range wildcard {
+		if !seen[sub.ID()] {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// Subscriptions returns a map of topics to Subscribers across all shards, as
+// of a consistent snapshot.
+func (s *Sharded) Subscriptions() map[string][]Subscriber {
+	subscriptions := map[string][]Subscriber{}
+	for _, shard := range s.Snapshot().shards {
+		for topic, subs := range (&matchbox{ctrie: shard.ctrie}).Subscriptions() {
+			subscriptions[topic] = subs
+		}
+	}
+	return subscriptions
+}
+
+// Topics returns all of the topics across all shards, as of a consistent
+// snapshot.
+func (s *Sharded) Topics() []string {
+	seen := map[string]bool{}
+	topics := []string{}
+	for _, shard := range s.Snapshot().shards {
+		for _, topic := range (&matchbox{ctrie: shard.ctrie}).Topics() {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	return topics
+}
+
+// Snapshot returns a read-only snapshot which is consistent across shards: it
+// reflects every write which completed before it was taken and none which
+// began after. Writes are briefly blocked while it is taken, lookups never
+// are. Modifying it panics.
+func (s *Sharded) Snapshot() *Sharded {
+	snapshot := &Sharded{config: s.config, words: s.words, seed: s.seed}
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+	for _, sh := range s.shards {
+		snapshot.shards = append(snapshot.shards, &shard{ctrie: sh.ctrie.ReadOnlySnapshot()})
+	}
+	return snapshot
+}
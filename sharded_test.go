@@ -0,0 +1,230 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharded(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSharded(NewAMQPConfig(), ShardConfig{Shards: 4})
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+	assert.Nil(s.TrySubscribe("a.b", sub1))
+	assert.Nil(s.TrySubscribe("a.*", sub2))
+	assert.Nil(s.TrySubscribe("*.b", sub1))
+	assert.Nil(s.TrySubscribe("#", sub3))
+	assert.Nil(s.TrySubscribe("c.d", sub2))
+
+	assert.ElementsMatch([]Subscriber{sub1, sub2, sub3}, s.Subscribers("a.b"))
+	assert.ElementsMatch([]Subscriber{sub2, sub3}, s.Subscribers("a.c"))
+	assert.ElementsMatch([]Subscriber{sub2, sub3}, s.Subscribers("c.d"))
+	assert.Equal([]Subscriber{sub3}, s.Subscribers("d"))
+
+	// Wildcard-led patterns are in the wildcard shard, others are not.
+	assert.Len((&matchbox{ctrie: s.wildcardShard().ctrie}).Subscriptions(), 2)
+	assert.True(s.shard([]string{"a", "b"}, true) == s.shard([]string{"a"}, false))
+	assert.True(s.shard([]string{"*", "b"}, true) == s.wildcardShard())
+
+	s.Unsubscribe("*.b", sub1)
+	s.Unsubscribe("a.b", sub1)
+	assert.ElementsMatch([]Subscriber{sub2, sub3}, s.Subscribers("a.b"))
+	assert.Equal(map[string][]Subscriber{
+		"a.*": {sub2},
+		"#":   {sub3},
+		"c.d": {sub2},
+	}, s.Subscriptions())
+	assert.ElementsMatch([]string{"a", "a.*", "#", "c", "c.d"}, s.Topics())
+}
+
+func TestShardedWords(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSharded(NewAMQPConfig(), ShardConfig{Shards: 64, Words: 2})
+	sub := subscriber("abc")
+	s.Subscribe("a.b.c", sub)
+	s.Subscribe("a.*", sub)
+	s.Subscribe("a", sub)
+
+	assert.True(s.shard([]string{"a", "*"}, true) == s.wildcardShard())
+	assert.True(s.shard([]string{"a", "b", "c"}, true) == s.shard([]string{"a", "b", "x"}, false))
+	assert.Equal([]Subscriber{sub}, s.Subscribers("a.b.c"))
+	assert.Equal([]Subscriber{sub}, s.Subscribers("a.b"))
+	assert.Equal([]Subscriber{sub}, s.Subscribers("a"))
+	assert.Len(s.Subscribers("a.b.d"), 0)
+}
+
+func TestShardedLimits(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.Limits = Limits{MaxPatternsPerSubscriber: 2}
+	s := NewSharded(config, ShardConfig{})
+	sub := subscriber("abc")
+
+	// Limits apply across shards.
+	assert.Nil(s.TrySubscribe("a", sub))
+	assert.Nil(s.TrySubscribe("*.b", sub))
+	assert.Equal(ErrQuotaExceeded, s.TrySubscribe("c", sub))
+}
+
+func TestShardedSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSharded(NewAMQPConfig(), ShardConfig{Shards: 8})
+
+	// Each writer subscribes to one shard after the other, so a consistent
+	// snapshot never has a later subscription without the earlier one.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			sub := subscriber(strconv.Itoa(w))
+			for i := 0; i < 200; i++ {
+				s.Subscribe("x"+strconv.Itoa(i)+".a", sub)
+				s.Subscribe("y"+strconv.Itoa(i)+".a", sub)
+			}
+		}(w)
+	}
+	for i := 0; i < 50; i++ {
+		subscriptions := s.Snapshot().Subscriptions()
+		for topic, subs := range subscriptions {
+			if topic[0] == 'y' {
+				assert.Len(subscriptions["x"+topic[1:]], len(subs))
+			}
+		}
+	}
+	wg.Wait()
+
+	snapshot := s.Snapshot()
+	assert.Len(snapshot.Subscriptions(), 400)
+	// The snapshot hashes topics to the same shards.
+	for topic := range snapshot.Subscriptions() {
+		assert.Len(snapshot.Subscribers(topic), len(s.Subscribers(topic)))
+	}
+	assert.Panics(func() { snapshot.Subscribe("z", subscriber("abc")) })
+}
+
+func BenchmarkShardedMultithreaded5050Insert1Threads(b *testing.B) {
+	benchmarkSharded5050(b, 1000, 1)
+}
+
+func BenchmarkShardedMultithreaded5050Insert4Threads(b *testing.B) {
+	benchmarkSharded5050(b, 1000, 4)
+}
+
+func BenchmarkShardedMultithreaded5050Insert8Threads(b *testing.B) {
+	benchmarkSharded5050(b, 1000, 8)
+}
+
+func BenchmarkShardedMultithreaded5050Insert16Threads(b *testing.B) {
+	benchmarkSharded5050(b, 1000, 16)
+}
+
+func BenchmarkShardedMultithreaded2575Insert1Threads(b *testing.B) {
+	benchmarkSharded2575(b, 1000, 1)
+}
+
+func BenchmarkShardedMultithreaded2575Insert4Threads(b *testing.B) {
+	benchmarkSharded2575(b, 1000, 4)
+}
+
+func BenchmarkShardedMultithreaded2575Insert8Threads(b *testing.B) {
+	benchmarkSharded2575(b, 1000, 8)
+}
+
+func BenchmarkShardedMultithreaded2575Insert16Threads(b *testing.B) {
+	benchmarkSharded2575(b, 1000, 16)
+}
+
+func benchmarkSharded5050(b *testing.B, numItems, numThreads int) {
+	itemsToInsert := make([][]string, 0, numThreads)
+	for i := 0; i < numThreads; i++ {
+		items := make([]string, 0, numItems)
+		for j := 0; j < numItems; j++ {
+			topic := strconv.Itoa(j%10) + "." + strconv.Itoa(j%50) + "." + strconv.Itoa(j)
+			items = append(items, topic)
+		}
+		itemsToInsert = append(itemsToInsert, items)
+	}
+
+	var wg sync.WaitGroup
+	s := NewSharded(NewAMQPConfig(), ShardConfig{})
+	sub := subscriber("abc")
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		wg.Add(numThreads)
+		for j := 0; j < numThreads; j++ {
+			go func(j int) {
+				if j%2 != 0 {
+					for _, key := range itemsToInsert[j] {
+						s.Subscribe(key, sub)
+					}
+				} else {
+					for _, key := range itemsToInsert[j] {
+						s.Subscribers(key)
+					}
+				}
+
+				wg.Done()
+			}(j)
+		}
+		wg.Wait()
+	}
+}
+
+func benchmarkSharded2575(b *testing.B, numItems, numThreads int) {
+	itemsToInsert := make([][]string, 0, numThreads)
+	for i := 0; i < numThreads; i++ {
+		items := make([]string, 0, numItems)
+		for j := 0; j < numItems; j++ {
+			topic := strconv.Itoa(j%10) + "." + strconv.Itoa(j%50) + "." + strconv.Itoa(j)
+			items = append(items, topic)
+		}
+		itemsToInsert = append(itemsToInsert, items)
+	}
+
+	var wg sync.WaitGroup
+	s := NewSharded(NewAMQPConfig(), ShardConfig{})
+	sub := subscriber("abc")
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		wg.Add(numThreads)
+		for j := 0; j < numThreads; j++ {
+			go func(j int) {
+				if j%4 == 0 {
+					for _, key := range itemsToInsert[j] {
+						s.Subscribe(key, sub)
+					}
+				} else {
+					for _, key := range itemsToInsert[j] {
+						s.Subscribers(key)
+					}
+				}
+
+				wg.Done()
+			}(j)
+		}
+		wg.Wait()
+	}
+}
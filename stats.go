@@ -0,0 +1,143 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import "unsafe"
+
+// mapEntryOverhead approximates the memory used by a map entry beyond its key
+// and value, i.e. its share of the buckets and their metadata.
+const mapEntryOverhead = 16
+
+// Stats describes the shape of the trie backing a Matchbox.
+type Stats struct {
+	// INodes, CNodes, TNodes and Branches are the number of each kind of node
+	// in the trie.
+	INodes   int
+	CNodes   int
+	TNodes   int
+	Branches int
+
+	// Patterns is the number of distinct patterns subscribed to, and
+	// Subscriptions the number of Subscribers over all of them.
+	Patterns      int
+	Subscriptions int
+
+	// MaxDepth and AverageDepth are the maximum and average number of words
+	// in the patterns subscribed to.
+	MaxDepth     int
+	AverageDepth float64
+
+	// FanOut is a histogram of the number of branches of the C-nodes at each
+	// level, where FanOut[level][n] is the number of C-nodes with n branches.
+	// The root C-node is at level zero.
+	FanOut []map[int]int
+
+	// SingleWildcardBranches, ZeroOrMoreWildcardBranches and
+	// RangeWildcardBranches are the number of branches keyed on each kind of
+	// wildcard.
+	SingleWildcardBranches     int
+	ZeroOrMoreWildcardBranches int
+	RangeWildcardBranches      int
+
+	// InternedWords and InternedBytes are the number and total length of the
+	// distinct words in the Config's Interner, if it has one.
+	InternedWords int
+	InternedBytes int
+
+	// MemoryBytes is an approximation of the memory used by the trie,
+	// excluding the Subscribers themselves. Interned words are counted once,
+	// as part of InternedBytes.
+	MemoryBytes int
+}
+
+// Stats returns statistics about the shape of the trie, computed from a
+// read-only snapshot.
+func (m *matchbox) Stats() Stats {
+	snapshot := m.ReadOnlySnapshot()
+	stats, depths := Stats{}, 0
+	snapshot.stats(&stats, &depths, snapshot.root, 0)
+	if interner := m.config.Interner; interner != nil {
+		stats.InternedWords = interner.Len()
+		stats.InternedBytes = interner.Bytes()
+		stats.MemoryBytes += stats.InternedBytes
+	}
+	if stats.Patterns > 0 {
+		stats.AverageDepth = float64(depths) / float64(stats.Patterns)
+	}
+	return stats
+}
+
+// stats adds the statistics of the I-node at the given level and everything
+// below it, accumulating the sum of the depths of the patterns in depths.
+func (c *ctrie) stats(stats *Stats, depths *int, in *iNode, level int) {
+	stats.INodes++
+	stats.MemoryBytes += int(unsafe.Sizeof(iNode{}) + unsafe.Sizeof(mainNode{}))
+	main := gcasRead(in, c)
+	if main.tNode != nil {
+		stats.TNodes++
+		stats.MemoryBytes += int(unsafe.Sizeof(tNode{}))
+	}
+	if main.cNode == nil {
+		return
+	}
+	stats.CNodes++
+	stats.MemoryBytes += int(unsafe.Sizeof(cNode{}))
+	for len(stats.FanOut) <= level {
+		stats.FanOut = append(stats.FanOut, map[int]int{})
+	}
+	stats.FanOut[level][len(main.cNode.branches)]++
+	for key, br := range main.cNode.branches {
+		stats.Branches++
+		stats.MemoryBytes += int(unsafe.Sizeof(key)+unsafe.Sizeof(br)+unsafe.Sizeof(branch{})) +
+			mapEntryOverhead
+		if c.config.Interner == nil {
+			stats.MemoryBytes += len(key)
+		}
+		if _, ok := main.cNode.ranges[key]; ok {
+			stats.RangeWildcardBranches++
+		} else {
+			switch key {
+			case c.config.SingleWildcard:
+				stats.SingleWildcardBranches++
+			case c.config.ZeroOrMoreWildcard:
+				stats.ZeroOrMoreWildcardBranches++
+			}
+		}
+		if len(br.subs) > 0 {
+			depth := level + 1
+			stats.Patterns++
+			stats.Subscriptions += len(br.subs)
+			*depths += depth
+			if depth > stats.MaxDepth {
+				stats.MaxDepth = depth
+			}
+		}
+		for id := range br.subs {
+			stats.MemoryBytes += len(id) + int(unsafe.Sizeof(id)+unsafe.Sizeof(Subscriber(nil))) +
+				mapEntryOverhead
+		}
+		for id, topic := range br.topics {
+			stats.MemoryBytes += len(id) + len(topic) + int(2*unsafe.Sizeof(topic)) + mapEntryOverhead
+		}
+		for id := range br.refs {
+			stats.MemoryBytes += len(id) + int(unsafe.Sizeof(id)+unsafe.Sizeof(0)) + mapEntryOverhead
+		}
+		if br.iNode != nil {
+			c.stats(stats, depths, br.iNode, level+1)
+		}
+	}
+}
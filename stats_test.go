@@ -0,0 +1,70 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	config := NewAMQPConfig()
+	config.RangeWildcardOpen = "{"
+	config.RangeWildcardClose = "}"
+	mb := New(config).(*matchbox)
+
+	stats := mb.Stats()
+	assert.Equal(1, stats.INodes)
+	assert.Equal(1, stats.CNodes)
+	assert.Equal(0, stats.Branches)
+	assert.Equal([]map[int]int{{0: 1}}, stats.FanOut)
+	assert.Equal(0.0, stats.AverageDepth)
+	empty := stats.MemoryBytes
+	assert.True(empty > 0)
+
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	mb.Subscribe("a.b.c", sub1)
+	mb.Subscribe("a.b.c", sub2)
+	mb.Subscribe("a.*", sub1)
+	mb.Subscribe("a.#", sub2)
+	mb.Subscribe("b.{1,2}", sub2)
+	mb.Subscribe("c", sub1)
+
+	stats = mb.Stats()
+	assert.Equal(4, stats.INodes)
+	assert.Equal(4, stats.CNodes)
+	assert.Equal(0, stats.TNodes)
+	assert.Equal(8, stats.Branches)
+	assert.Equal(5, stats.Patterns)
+	assert.Equal(6, stats.Subscriptions)
+	assert.Equal(3, stats.MaxDepth)
+	assert.Equal(2.0, stats.AverageDepth)
+	assert.Equal([]map[int]int{{3: 1}, {3: 1, 1: 1}, {1: 1}}, stats.FanOut)
+	assert.Equal(1, stats.SingleWildcardBranches)
+	assert.Equal(1, stats.ZeroOrMoreWildcardBranches)
+	assert.Equal(1, stats.RangeWildcardBranches)
+	assert.True(stats.MemoryBytes > empty)
+
+	mb.Unsubscribe("a.b.c", sub1)
+	mb.Unsubscribe("a.b.c", sub2)
+	stats = mb.Stats()
+	assert.Equal(4, stats.Patterns)
+	assert.Equal(2, stats.MaxDepth)
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// patternKeys splits the pattern into the keys under which its subscriptions
+// are stored in the ctrie.
+func (c *Config) patternKeys(pattern string) []string {
+	return c.reduceZeroOrMoreWildcards(c.keys(pattern, false))
+}
+
+// subscribedTopic returns the pattern to retain for a subscription with the
+// given keys, or empty if it is the same as the keys joined.
+func (c *Config) subscribedTopic(keys []string, pattern string) string {
+	if c.normalizes() && strings.Join(keys, c.Delimiter) != pattern {
+		return pattern
+	}
+	return ""
+}
+
+// topicKeys splits the topic into the keys used to look up its subscribers in
+// the ctrie.
+func (c *Config) topicKeys(topic string) []string {
+	return c.keys(topic, true)
+}
+
+// wordKeys returns the ctrie keys for the pre-tokenized words. Words equal to
+// a wildcard are wildcards unless literal is true.
+func (c *Config) wordKeys(words []string, literal bool) []string {
+	if c.Escape == "" && !c.normalizes() {
+		return words
+	}
+	keys := make([]string, len(words))
+	for i, word := range words {
+		if !literal && c.hasWildcardForm(word) {
+			keys[i] = word
+			continue
+		}
+		keys[i] = c.escapeWord(c.normalize(word))
+	}
+	return keys
+}
+
+// bytesKeys splits the topic into the keys used to look up its subscribers in
+// the ctrie.
+func (c *Config) bytesKeys(topic []byte) []string {
+	if c.Escape != "" {
+		return c.topicKeys(string(topic))
+	}
+	delimiter := []byte(c.Delimiter)
+	keys := make([]string, 0, bytes.Count(topic, delimiter)+1)
+	for {
+		i := bytes.Index(topic, delimiter)
+		if i < 0 {
+			break
+		}
+		keys = append(keys, string(topic[:i]))
+		topic = topic[i+len(delimiter):]
+	}
+	keys = append(keys, string(topic))
+	if c.normalizes() {
+		for i, key := range keys {
+			if !c.isWildcard(key) {
+				keys[i] = c.normalize(key)
+			}
+		}
+	}
+	return keys
+}
+
+// join returns the topic for the pattern words, escaping literal words if
+// escaping is enabled.
+func (c *Config) join(words []string) string {
+	if c.Escape == "" {
+		return strings.Join(words, c.Delimiter)
+	}
+	escaped := make([]string, len(words))
+	for i, word := range words {
+		if c.isWildcard(word) {
+			escaped[i] = word
+		} else {
+			escaped[i] = c.escapeWord(word)
+		}
+	}
+	return strings.Join(escaped, c.Delimiter)
+}
+
+// keys splits the topic into normalized ctrie keys. If escaping is enabled,
+// literal words are stored in their canonical escaped form so they remain
+// distinct from wildcards and can be joined back into a topic with the
+// delimiter. If literal is true, no word is treated as a wildcard.
+func (c *Config) keys(topic string, literal bool) []string {
+	if c.Escape == "" {
+		words := strings.Split(topic, c.Delimiter)
+		if c.normalizes() {
+			for i, word := range words {
+				if !c.isWildcard(word) {
+					words[i] = c.normalize(word)
+				}
+			}
+		}
+		return words
+	}
+	words, escaped := c.tokenize(topic)
+	for i, word := range words {
+		if !literal && !escaped[i] && c.hasWildcardForm(word) {
+			continue
+		}
+		words[i] = c.escapeWord(c.normalize(word))
+	}
+	return words
+}
+
+// isWildcard indicates if the word is a single, zero-or-more or ranged
+// wildcard.
+func (c *Config) isWildcard(word string) bool {
+	if word == c.SingleWildcard || word == c.ZeroOrMoreWildcard {
+		return true
+	}
+	_, ok := c.parseRange(word)
+	return ok
+}
+
+// hasWildcardForm indicates if the word is a wildcard or has the form of one,
+// like an oversized ranged wildcard, so a pattern word keeps it to be
+// rejected and a literal word is escaped.
+func (c *Config) hasWildcardForm(word string) bool {
+	return c.isWildcard(word) || c.oversizedRange(word)
+}
+
+// tokenize splits the topic into unescaped words. The returned flags indicate
+// which words contained an escape and are therefore never wildcards.
+func (c *Config) tokenize(topic string) ([]string, []bool) {
+	var (
+		words   []string
+		escaped []bool
+		word    []byte
+		esc     bool
+	)
+	for i := 0; i < len(topic); {
+		switch rest := topic[i:]; {
+		case strings.HasPrefix(rest, c.Escape):
+			// Take the following escape, delimiter or character literally. A
+			// trailing escape is itself taken literally.
+			rest = rest[len(c.Escape):]
+			i += len(c.Escape)
+			esc = true
+			switch {
+			case rest == "":
+				word = append(word, c.Escape...)
+			case strings.HasPrefix(rest, c.Escape):
+				word = append(word, c.Escape...)
+				i += len(c.Escape)
+			case strings.HasPrefix(rest, c.Delimiter):
+				word = append(word, c.Delimiter...)
+				i += len(c.Delimiter)
+			default:
+				_, size := utf8.DecodeRuneInString(rest)
+				word = append(word, rest[:size]...)
+				i += size
+			}
+		case strings.HasPrefix(rest, c.Delimiter):
+			words = append(words, string(word))
+			escaped = append(escaped, esc)
+			word, esc = word[:0], false
+			i += len(c.Delimiter)
+		default:
+			word = append(word, topic[i])
+			i++
+		}
+	}
+	return append(words, string(word)), append(escaped, esc)
+}
+
+// escapeWord returns the canonical escaped form of the literal word, which
+// escapes any escape and delimiter sequences as well as a word which would
+// otherwise be a wildcard.
+func (c *Config) escapeWord(word string) string {
+	if c.Escape == "" {
+		return word
+	}
+	if strings.Contains(word, c.Escape) || strings.Contains(word, c.Delimiter) {
+		var escaped []byte
+		for i := 0; i < len(word); {
+			switch rest := word[i:]; {
+			case strings.HasPrefix(rest, c.Escape):
+				escaped = append(append(escaped, c.Escape...), c.Escape...)
+				i += len(c.Escape)
+			case strings.HasPrefix(rest, c.Delimiter):
+				escaped = append(append(escaped, c.Escape...), c.Delimiter...)
+				i += len(c.Delimiter)
+			default:
+				escaped = append(escaped, word[i])
+				i++
+			}
+		}
+		word = string(escaped)
+	}
+	if c.hasWildcardForm(word) {
+		word = c.Escape + word
+	}
+	return word
+}
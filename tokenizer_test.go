@@ -0,0 +1,114 @@
+/*
+Copyright 2015 Workiva
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package matchbox
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEscapeConfig() *Config {
+	config := NewAMQPConfig()
+	config.Escape = `\`
+	return config
+}
+
+func TestTokenize(t *testing.T) {
+	assert := assert.New(t)
+	config := newEscapeConfig()
+
+	words, escaped := config.tokenize("a.b.c")
+	assert.Equal([]string{"a", "b", "c"}, words)
+	assert.Equal([]bool{false, false, false}, escaped)
+
+	words, escaped = config.tokenize(`a\.b.\*.\\.c\`)
+	assert.Equal([]string{"a.b", "*", `\`, `c\`}, words)
+	assert.Equal([]bool{true, true, true, true}, escaped)
+
+	words, escaped = config.tokenize(`\é..`)
+	assert.Equal([]string{"é", "", ""}, words)
+	assert.Equal([]bool{true, false, false}, escaped)
+
+	config = &Config{Delimiter: "::", SingleWildcard: "*", ZeroOrMoreWildcard: "#", Escape: "%%"}
+	words, _ = config.tokenize("a%%::b::c%%%%::d")
+	assert.Equal([]string{"a::b", "c%%", "d"}, words)
+}
+
+func TestKeys(t *testing.T) {
+	assert := assert.New(t)
+	config := newEscapeConfig()
+
+	assert.Equal([]string{"a", "*", "#"}, config.patternKeys("a.*.#"))
+	assert.Equal([]string{"a", `\*`, `\#`}, config.topicKeys("a.*.#"))
+	assert.Equal([]string{"a", `\*`, `\#`}, config.patternKeys(`a.\*.\#`))
+	assert.Equal([]string{`a\.b`, `\\`}, config.patternKeys(`a\.b.\\`))
+	assert.Equal([]string{"a", "b"}, config.patternKeys(`\a.b`))
+	assert.Equal([]string{"#"}, config.patternKeys("#.#"))
+	assert.Equal([]string{`\#`, `\#`}, config.patternKeys(`\#.\#`))
+
+	// An escaped oversized range is a literal word, distinct from the
+	// unescaped pattern, which can't be subscribed to.
+	config.RangeWildcardOpen, config.RangeWildcardClose = "{", "}"
+	assert.Equal([]string{"a", `\{256}`}, config.patternKeys(`a.\{256}`))
+	assert.Equal(ErrRangeTooLarge, config.checkRanges(config.patternKeys("a.{256}")))
+	assert.Nil(config.checkRanges(config.patternKeys(`a.\{256}`)))
+	config.RangeWildcardOpen, config.RangeWildcardClose = "", ""
+
+	// Canonical keys round-trip through the delimiter.
+	for _, word := range []string{"*", "#", `\`, ".", `a.\b`, `\.`, "", "é"} {
+		key := config.escapeWord(word)
+		words, _ := config.tokenize(strings.Join([]string{key, key}, "."))
+		assert.Equal([]string{word, word}, words, word)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert := assert.New(t)
+	mb := New(newEscapeConfig())
+	sub1 := subscriber("abc")
+	sub2 := subscriber("def")
+	sub3 := subscriber("ghi")
+
+	mb.Subscribe(`a.\*`, sub1)
+	mb.Subscribe("a.*", sub2)
+	mb.Subscribe(`a\.b`, sub3)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers("a.b"))
+	subscribers := mb.Subscribers(`a.\*`)
+	assert.Len(subscribers, 2)
+	assert.Contains(subscribers, sub1)
+	assert.Contains(subscribers, sub2)
+	assert.Len(mb.Subscribers("a.*"), 2)
+	assert.Equal([]Subscriber{sub3}, mb.Subscribers(`a\.b`))
+
+	topics := mb.Topics()
+	assert.Len(topics, 4)
+	for _, topic := range []string{"a", `a.\*`, "a.*", `a\.b`} {
+		assert.Contains(topics, topic)
+	}
+	assert.Equal(map[string][]Subscriber{
+		`a.\*`: []Subscriber{sub1},
+		"a.*":  []Subscriber{sub2},
+		`a\.b`: []Subscriber{sub3},
+	}, mb.Subscriptions())
+
+	mb.Unsubscribe(`a.\*`, sub1)
+	assert.Equal([]Subscriber{sub2}, mb.Subscribers(`a.\*`))
+	mb.Unsubscribe(`a\.b`, sub3)
+	assert.Equal([]Subscriber{}, mb.Subscribers(`a\.b`))
+}